@@ -0,0 +1,141 @@
+// Command kubevoyage-audit creates audit signing keys and verifies the
+// tamper-evident audit log, either in the database or from an exported
+// bundle.
+//
+//	kubevoyage-audit genkey
+//	kubevoyage-audit verify [-pubkey KEY]
+//	kubevoyage-audit verify-bundle -pubkey KEY FILE
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	application "github.com/B-Urb/KubeVoyage/internal/app"
+	"github.com/B-Urb/KubeVoyage/internal/audit"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "genkey":
+		err = genkey()
+	case "verify":
+		err = verify(os.Args[2:])
+	case "verify-bundle":
+		err = verifyBundle(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kubevoyage-audit genkey | verify [-pubkey KEY] | verify-bundle -pubkey KEY FILE")
+	os.Exit(2)
+}
+
+// genkey prints a new AUDIT_SIGNING_KEY and the public key to verify with.
+func genkey() error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("AUDIT_SIGNING_KEY=%s\n", base64.StdEncoding.EncodeToString(private.Seed()))
+	fmt.Printf("public key: %s\n", base64.StdEncoding.EncodeToString(public))
+	return nil
+}
+
+// verify checks the chain in the database configured like the server. The
+// public key defaults to the one of AUDIT_SIGNING_KEY.
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	pubkey := flags.String("pubkey", "", "base64 Ed25519 public key the seals were signed with")
+	flags.Parse(args)
+
+	key, err := publicKey(*pubkey)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		private, err := audit.SigningKeyFromEnv()
+		if err != nil {
+			return err
+		}
+		if private != nil {
+			key = private.Public().(ed25519.PublicKey)
+		}
+	}
+	app, err := application.NewApp()
+	if err != nil {
+		return err
+	}
+	report, err := audit.VerifyDB(app.DB, key)
+	if err != nil {
+		return err
+	}
+	return printReport(report)
+}
+
+// verifyBundle checks an exported bundle against a trusted public key.
+func verifyBundle(args []string) error {
+	flags := flag.NewFlagSet("verify-bundle", flag.ExitOnError)
+	pubkey := flags.String("pubkey", "", "base64 Ed25519 public key the bundle was signed with")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *pubkey == "" {
+		usage()
+	}
+
+	key, err := publicKey(*pubkey)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var bundle audit.Bundle
+	if err := json.Unmarshal(content, &bundle); err != nil {
+		return fmt.Errorf("reading bundle: %w", err)
+	}
+	report, err := bundle.Verify(key)
+	if err != nil {
+		return err
+	}
+	return printReport(report)
+}
+
+func publicKey(encoded string) (ed25519.PublicKey, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("the public key must be a base64 encoded 32 byte Ed25519 key")
+	}
+	return key, nil
+}
+
+// printReport prints the report as JSON and fails if it found problems.
+func printReport(report *audit.Report) error {
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	if !report.Valid {
+		return fmt.Errorf("audit log verification failed with %d problems", len(report.Problems))
+	}
+	return nil
+}
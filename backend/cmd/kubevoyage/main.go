@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/B-Urb/KubeVoyage/internal/app"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
 	"github.com/B-Urb/KubeVoyage/internal/handlers"
 	"github.com/B-Urb/KubeVoyage/internal/util"
 	"github.com/rs/cors"
@@ -34,6 +37,12 @@ func (lrw *loggingResponseWriter) WriteHeader(statusCode int) {
 	lrw.statusCode = statusCode
 	lrw.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Unwrap lets http.ResponseController reach the flusher of the event stream.
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
 func logMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		lrw := &loggingResponseWriter{ResponseWriter: w}
@@ -59,17 +68,76 @@ func main() {
 		log.Fatalf(err.Error())
 	}
 
-	handler := handlers.NewHandler(app.DB)
 	err = app.Init()
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+	// The audit chain continues from the migrated database.
+	handler := handlers.NewHandler(app.DB)
+
+	expiryInterval, _ := util.GetEnvOrDefault("GRANT_EXPIRY_INTERVAL", "1m")
+	interval, err := time.ParseDuration(expiryInterval)
+	if err != nil {
+		log.Fatalf("invalid GRANT_EXPIRY_INTERVAL: %v", err)
+	}
+	go handler.RunGrantExpiry(context.Background(), interval)
+
+	sealInterval, _ := util.GetEnvOrDefault("AUDIT_SEAL_INTERVAL", "1h")
+	interval, err = time.ParseDuration(sealInterval)
+	if err != nil {
+		log.Fatalf("invalid AUDIT_SEAL_INTERVAL: %v", err)
+	}
+	go handler.RunAuditSealer(context.Background(), interval)
+
+	webhookInterval, _ := util.GetEnvOrDefault("WEBHOOK_DELIVERY_INTERVAL", "10s")
+	interval, err = time.ParseDuration(webhookInterval)
+	if err != nil {
+		log.Fatalf("invalid WEBHOOK_DELIVERY_INTERVAL: %v", err)
+	}
+	go handler.RunWebhookDelivery(context.Background(), interval)
+
+	notificationInterval, _ := util.GetEnvOrDefault("NOTIFICATION_INTERVAL", "30s")
+	interval, err = time.ParseDuration(notificationInterval)
+	if err != nil {
+		log.Fatalf("invalid NOTIFICATION_INTERVAL: %v", err)
+	}
+	go handler.RunNotifications(context.Background(), interval)
 
 	mux := setupServer(handler)
 
+	certFile, _ := util.GetEnvOrDefault("TLS_CERT_FILE", "")
+	keyFile, _ := util.GetEnvOrDefault("TLS_KEY_FILE", "")
+	if certFile != "" && keyFile != "" {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		server := &http.Server{Addr: ":8080", Handler: mux, TLSConfig: tlsConfig}
+		log.Println("Starting TLS server on :8080")
+		log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
+	}
+
 	log.Println("Starting server on :8080")
 	log.Fatal(http.ListenAndServe(":8080", mux))
 }
+
+// newTLSConfig asks clients for a certificate when CLIENT_CA_FILES is set, so
+// machine clients and admin laptops can authenticate with mutual TLS. Clients
+// without a certificate can still log in normally.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	caFiles := util.GetEnvList("CLIENT_CA_FILES")
+	if len(caFiles) == 0 {
+		return config, nil
+	}
+	pool, err := auth.LoadCertPool(caFiles)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
 func setupServer(handle *handlers.Handler) http.Handler {
 	mux := http.NewServeMux()
 
@@ -109,15 +177,30 @@ func setupServer(handle *handlers.Handler) http.Handler {
 	mux.Handle("/api/requests", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleRequests(w, r)
 	})))
+	mux.Handle("/api/requests/events", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleRequestEvents(w, r)
+	})))
 	mux.Handle("/api/requests/update", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleUpdateSiteState(w, r)
 	})))
+	mux.Handle("/api/decide", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleDecisionLink(w, r)
+	})))
 	mux.Handle("/api/register", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleRegister(w, r)
 	})))
 	mux.Handle("/api/login", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleLogin(w, r)
 	})))
+	mux.Handle("/api/login/email", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleLoginEmail(w, r)
+	})))
+	mux.Handle("/api/login/magic", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleLoginMagic(w, r)
+	})))
+	mux.Handle("/api/login/code", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleLoginCode(w, r)
+	})))
 	mux.Handle("/api/authenticate", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleAuthenticate(w, r)
 	})))
@@ -127,9 +210,111 @@ func setupServer(handle *handlers.Handler) http.Handler {
 	mux.Handle("/api/request", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleRequestSite(w, r)
 	})))
+	mux.Handle("/api/request/status", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleRequestStatus(w, r)
+	})))
+	mux.Handle("/api/request/comments", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleRequestComments(w, r)
+	})))
+	mux.Handle("/api/request/history", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleRequestHistory(w, r)
+	})))
+	mux.Handle("/api/history", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleHistory(w, r)
+	})))
+	mux.Handle("/api/request/withdraw", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleWithdrawRequest(w, r)
+	})))
+	mux.Handle("/api/request/extend", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleRequestExtension(w, r)
+	})))
 	mux.Handle("/api/logout", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleLogout(w, r)
 	})))
+	mux.Handle("/api/tokens", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleTokens(w, r)
+	})))
+	mux.Handle("/api/sites", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleSites(w, r)
+	})))
+	mux.Handle("/api/sites/update", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleUpdateSite(w, r)
+	})))
+	mux.Handle("/api/sites/owners", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleSiteOwners(w, r)
+	})))
+	mux.Handle("/api/sites/approvers", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleSiteApprovers(w, r)
+	})))
+	mux.Handle("/api/sites/policies", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleSitePolicies(w, r)
+	})))
+	mux.Handle("/api/policies/test", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandlePolicyTest(w, r)
+	})))
+	mux.Handle("/api/audit/events", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleAuditEvents(w, r)
+	})))
+	mux.Handle("/api/audit/export", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleAuditExport(w, r)
+	})))
+	mux.Handle("/api/audit/verify", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleAuditVerify(w, r)
+	})))
+	mux.Handle("/api/audit/bundle", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleAuditBundle(w, r)
+	})))
+	mux.Handle("/api/notifications/preferences", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleNotificationPreferences(w, r)
+	})))
+	mux.Handle("/api/webhooks", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleWebhooks(w, r)
+	})))
+	mux.Handle("/api/webhooks/deliveries", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleWebhookDeliveries(w, r)
+	})))
+	mux.Handle("/api/chat/interaction", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleChatInteraction(w, r)
+	})))
+	mux.Handle("/api/chat/users", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleChatUsers(w, r)
+	})))
+	mux.Handle("/api/explain", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleExplain(w, r)
+	})))
+	mux.Handle("/api/access/me", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleMyAccess(w, r)
+	})))
+	mux.Handle("/api/access/check", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleAccessCheck(w, r)
+	})))
+	mux.Handle("/api/access/site", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleSiteAccess(w, r)
+	})))
+	mux.Handle("/api/access/user", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleUserAccess(w, r)
+	})))
+	mux.Handle("/api/access/matrix", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleAccessMatrix(w, r)
+	})))
+	mux.Handle("/api/rules", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleRules(w, r)
+	})))
+	mux.Handle("/api/groups", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleGroups(w, r)
+	})))
+	mux.Handle("/api/groups/members", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleGroupMembers(w, r)
+	})))
+	mux.Handle("/api/groups/sites", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleGroupSites(w, r)
+	})))
+	mux.Handle("/api/users", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleUsers(w, r)
+	})))
+	mux.Handle("/api/users/role", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle.HandleUpdateUserRole(w, r)
+	})))
 	mux.Handle("/api/validate-session", logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handle.HandleValidateSession(w, r)
 	})))
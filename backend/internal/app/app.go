@@ -27,7 +27,13 @@ func NewApp() (*App, error) {
 }
 
 func (app *App) Init() error {
-	err := app.DB.AutoMigrate(models.User{}, models.Site{}, models.UserSite{})
+	err := app.DB.AutoMigrate(models.User{}, models.Site{}, models.UserSite{}, models.AppToken{}, models.LoginChallenge{},
+		models.Group{}, models.GroupMember{}, models.GroupSite{}, models.SiteOwner{}, models.SiteApprover{},
+		models.SiteApproverGroup{}, models.RequestComment{}, models.SiteApprovalGroup{}, models.RequestApproval{},
+		models.RequestApprover{}, models.ApprovalRule{}, models.SitePolicy{}, models.RequestHistory{},
+		models.AuthEvent{}, models.AuditHead{}, models.AuditSeal{}, models.Webhook{}, models.WebhookDelivery{},
+		models.NotificationPreference{}, models.Cursor{}, models.DecisionLink{},
+		models.ChatIdentity{}, models.SiteUse{})
 	if err != nil {
 		return err
 	}
@@ -59,7 +65,7 @@ func createAdminUserIfNotExist(db *gorm.DB) error {
 	adminUser := models.User{
 		Email:    adminEmail,
 		Password: hash,
-		Role:     "admin",
+		Role:     models.RoleSuperAdmin,
 	}
 
 	if err := db.Create(&adminUser).Error; err != nil {
@@ -0,0 +1,120 @@
+// Package audit delivers authentication decisions to the configured audit
+// sinks.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/util"
+	"gorm.io/gorm"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sink stores audit events.
+type Sink interface {
+	Write(ctx context.Context, event *models.AuthEvent) error
+}
+
+// NewSinkFromEnv returns the sinks listed in AUDIT_SINKS: "db" (the
+// default) stores events in the database, where the audit API can query
+// them, "file" appends JSON lines to AUDIT_FILE and "stdout" prints them.
+// "none" returns nil and disables the audit log. Events are hash-chained in
+// the database, or else continuing from the last event in the file.
+func NewSinkFromEnv(db *gorm.DB) (Sink, error) {
+	names := util.GetEnvList("AUDIT_SINKS")
+	if len(names) == 0 {
+		names = []string{"db"}
+	}
+	var sinks Multi
+	var path string
+	inDB := false
+	for _, name := range names {
+		switch name {
+		case "none":
+			return nil, nil
+		case "db":
+			inDB = true
+		case "file":
+			path, _ = util.GetEnvOrDefault("AUDIT_FILE", "audit.jsonl")
+			sink, err := NewFileSink(path)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "stdout":
+			sinks = append(sinks, NewWriterSink(os.Stdout))
+		default:
+			return nil, fmt.Errorf("unsupported audit sink: %s", name)
+		}
+	}
+	var next Sink = sinks
+	if len(sinks) == 1 {
+		next = sinks[0]
+	}
+	if inDB {
+		if len(sinks) == 0 {
+			next = nil
+		}
+		chain, err := NewDBChain(db, next)
+		if err != nil {
+			return nil, fmt.Errorf("finding the head of the audit chain: %w", err)
+		}
+		return chain, nil
+	}
+	var head string
+	if path != "" {
+		var err error
+		if head, err = lastFileHash(path); err != nil {
+			return nil, fmt.Errorf("finding the head of the audit chain: %w", err)
+		}
+	}
+	return NewChain(next, head), nil
+}
+
+// Multi writes every event to all of its sinks.
+type Multi []Sink
+
+func (m Multi) Write(ctx context.Context, event *models.AuthEvent) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WriterSink writes events as JSON lines.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(_ context.Context, event *models.AuthEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// NewFileSink appends JSON lines to the file at path, creating it if needed.
+func NewFileSink(path string) (*WriterSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %w", err)
+	}
+	return NewWriterSink(file), nil
+}
@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSinkAppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 2; i++ {
+		sink, err := NewFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Write(context.Background(), &models.AuthEvent{
+			Time: time.Now(), Action: models.AuthActionLogin, User: "alice@example.com", Outcome: models.AuthOutcomeAllow,
+		}))
+	}
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var events []models.AuthEvent
+	for scanner.Scan() {
+		var event models.AuthEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.Len(t, events, 2, "reopening the file appends to it")
+	assert.Equal(t, "alice@example.com", events[1].User)
+}
+
+func TestNewSinkFromEnv(t *testing.T) {
+	t.Setenv("AUDIT_SINKS", "stdout, file")
+	t.Setenv("AUDIT_FILE", filepath.Join(t.TempDir(), "audit.jsonl"))
+	sink, err := NewSinkFromEnv(nil)
+	require.NoError(t, err)
+	require.IsType(t, &Chain{}, sink)
+	assert.Len(t, sink.(*Chain).next, 2)
+
+	t.Setenv("AUDIT_SINKS", "syslog")
+	_, err = NewSinkFromEnv(nil)
+	assert.Error(t, err)
+}
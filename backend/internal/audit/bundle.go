@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"time"
+)
+
+// BundleVersion is the format version of export bundles.
+const BundleVersion = 1
+
+// Bundle is a signed, self-contained excerpt of the audit chain that can be
+// verified offline. Anchor is the previous hash of the first event, so an
+// excerpt from the middle of the chain verifies on its own.
+type Bundle struct {
+	Version   int                `json:"version"`
+	CreatedAt time.Time          `json:"createdAt"`
+	PublicKey ed25519.PublicKey  `json:"publicKey"`
+	Anchor    string             `json:"anchor"`
+	Events    []models.AuthEvent `json:"events"`
+	Seals     []models.AuditSeal `json:"seals"`
+	Signature []byte             `json:"signature"`
+}
+
+// digest hashes the bundle without its signature.
+func (b *Bundle) digest() ([]byte, error) {
+	unsigned := *b
+	unsigned.Signature = nil
+	content, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	return sum[:], nil
+}
+
+// NewBundle signs events, which must be consecutive and in id order, along
+// with the seals over them.
+func NewBundle(key ed25519.PrivateKey, events []models.AuthEvent, seals []models.AuditSeal, now time.Time) (*Bundle, error) {
+	bundle := &Bundle{
+		Version:   BundleVersion,
+		CreatedAt: now.UTC(),
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Events:    events,
+		Seals:     seals,
+	}
+	if len(events) > 0 {
+		bundle.Anchor = events[0].PrevHash
+	}
+	digest, err := bundle.digest()
+	if err != nil {
+		return nil, err
+	}
+	bundle.Signature = ed25519.Sign(key, digest)
+	return bundle, nil
+}
+
+// Verify checks the bundle signature and the chain inside it against the
+// trusted key. The public key in the bundle is only a hint; trusting it
+// would let anyone who can write a bundle vouch for it.
+func (b *Bundle) Verify(key ed25519.PublicKey) (*Report, error) {
+	if b.Version != BundleVersion {
+		return nil, errors.New("unsupported bundle version")
+	}
+	digest, err := b.digest()
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, digest, b.Signature) {
+		return nil, errors.New("bundle signature does not verify")
+	}
+	verifier := NewVerifier(b.Anchor, b.Seals, key)
+	for i := range b.Events {
+		verifier.Event(&b.Events[i])
+	}
+	return verifier.Finish(), nil
+}
@@ -0,0 +1,328 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hash returns the chain hash of an event: the SHA-256 of its previous hash
+// and its content. The database id is not part of it, a missing event shows
+// up as a broken link instead.
+func Hash(event *models.AuthEvent) string {
+	content, _ := json.Marshal([]string{
+		event.PrevHash,
+		event.Time.UTC().Format(time.RFC3339Nano),
+		event.Action,
+		event.User,
+		event.Site,
+		event.Outcome,
+		event.Reason,
+		event.Method,
+		event.ClientIP,
+		event.UserAgent,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditHeadID is the id of the single audit_heads row.
+const auditHeadID = 1
+
+// Chain links every event to the previous one before passing it on. A chain
+// kept in the database reads and moves its head in the transaction storing
+// the event, so any number of instances can share it. Otherwise the head is
+// kept in memory and there must be a single Chain writing to a given store,
+// or the chain forks.
+type Chain struct {
+	mu   sync.Mutex
+	head string
+	db   *gorm.DB
+	next Sink
+}
+
+// NewChain continues the chain from head, the hash of the last event
+// written, or starts a new one when head is empty.
+func NewChain(next Sink, head string) *Chain {
+	return &Chain{head: head, next: next}
+}
+
+// NewDBChain chains events in the auth_events table and then passes them on
+// to next, which may be nil. The head starts at the newest stored event.
+func NewDBChain(db *gorm.DB, next Sink) (*Chain, error) {
+	head, err := LastHash(db)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.AuditHead{ID: auditHeadID, Hash: head}).Error
+	if err != nil {
+		return nil, err
+	}
+	return &Chain{db: db, next: next}, nil
+}
+
+// Write links the event to the head and stores it. The head only moves once
+// the event has been stored, so a failed write leaves no gap.
+func (c *Chain) Write(ctx context.Context, event *models.AuthEvent) error {
+	// The lock keeps the events of this instance in chain order for the
+	// sinks after the database, and SQLite from running into busy errors.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Databases keep milliseconds at least, the hash must survive the round trip.
+	event.Time = event.Time.UTC().Truncate(time.Millisecond)
+	if c.db == nil {
+		event.PrevHash = c.head
+		event.Hash = Hash(event)
+		if err := c.next.Write(ctx, event); err != nil {
+			return err
+		}
+		c.head = event.Hash
+		return nil
+	}
+	err := c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var head models.AuditHead
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&head, auditHeadID).Error; err != nil {
+			return err
+		}
+		event.PrevHash = head.Hash
+		event.Hash = Hash(event)
+		if err := tx.Create(event).Error; err != nil {
+			return err
+		}
+		return tx.Model(&head).Update("hash", event.Hash).Error
+	})
+	if err != nil || c.next == nil {
+		return err
+	}
+	return c.next.Write(ctx, event)
+}
+
+// LastHash returns the hash of the newest event in the database.
+func LastHash(db *gorm.DB) (string, error) {
+	var hashes []string
+	err := db.Model(&models.AuthEvent{}).Order("id DESC").Limit(1).Pluck("hash", &hashes).Error
+	if err != nil || len(hashes) == 0 {
+		return "", err
+	}
+	return hashes[0], nil
+}
+
+// lastFileHash returns the hash of the last event in a JSON lines file.
+func lastFileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	var last models.AuthEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+				return "", fmt.Errorf("reading %s: %w", path, err)
+			}
+		}
+	}
+	return last.Hash, scanner.Err()
+}
+
+// SigningKeyFromEnv reads the Ed25519 key that signs seals and bundles from
+// AUDIT_SIGNING_KEY, the base64 encoded 32 byte seed. Without it nothing is
+// signed and nil is returned.
+func SigningKeyFromEnv() (ed25519.PrivateKey, error) {
+	encoded, _ := util.GetEnvOrDefault("AUDIT_SIGNING_KEY", "")
+	if encoded == "" {
+		return nil, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("AUDIT_SIGNING_KEY must be a base64 encoded 32 byte seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// sealMessage is what a seal signs.
+func sealMessage(seal *models.AuditSeal) []byte {
+	return []byte("kubevoyage-audit-seal\n" + strconv.FormatUint(uint64(seal.EventID), 10) + "\n" + seal.Hash + "\n" +
+		seal.CreatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// NewSeal signs the chain up to the given event.
+func NewSeal(key ed25519.PrivateKey, event *models.AuthEvent, now time.Time) *models.AuditSeal {
+	seal := &models.AuditSeal{EventID: event.ID, Hash: event.Hash, CreatedAt: now.UTC().Truncate(time.Millisecond)}
+	seal.Signature = ed25519.Sign(key, sealMessage(seal))
+	return seal
+}
+
+// VerifySeal checks the signature of a seal.
+func VerifySeal(key ed25519.PublicKey, seal *models.AuditSeal) bool {
+	return ed25519.Verify(key, sealMessage(seal), seal.Signature)
+}
+
+// Problem is an inconsistency found by a Verifier.
+type Problem struct {
+	EventID uint   `json:"eventID,omitempty"`
+	SealID  uint   `json:"sealID,omitempty"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail"`
+}
+
+// Kinds of problems.
+const (
+	ProblemModified   = "modified"
+	ProblemGap        = "gap"
+	ProblemBadSeal    = "bad_seal"
+	ProblemSealedGone = "sealed_event_missing"
+	ProblemTruncated  = "truncated"
+)
+
+// Report is the result of a verification.
+type Report struct {
+	Valid     bool      `json:"valid"`
+	Events    int       `json:"events"`
+	Unchained int       `json:"unchained"`
+	Seals     int       `json:"seals"`
+	Head      string    `json:"head"`
+	Problems  []Problem `json:"problems"`
+}
+
+// Verifier checks a chain fed to it event by event in id order, together
+// with the seals over it. After a problem it continues from the event it
+// saw, so every break is reported once.
+type Verifier struct {
+	report  Report
+	head    string
+	started bool
+	seals   []models.AuditSeal
+}
+
+// NewVerifier starts verifying at anchor, the previous hash of the first
+// event to come; it is empty for a chain verified from its start. Seals are
+// checked against key and must not be nil when seals are given.
+func NewVerifier(anchor string, seals []models.AuditSeal, key ed25519.PublicKey) *Verifier {
+	seals = append([]models.AuditSeal(nil), seals...)
+	sort.Slice(seals, func(i, j int) bool { return seals[i].EventID < seals[j].EventID })
+	v := &Verifier{head: anchor, seals: seals}
+	v.report.Problems = []Problem{}
+	for i := range v.seals {
+		seal := &v.seals[i]
+		v.report.Seals++
+		if key == nil || !VerifySeal(key, seal) {
+			v.report.Problems = append(v.report.Problems, Problem{SealID: seal.ID, EventID: seal.EventID, Kind: ProblemBadSeal,
+				Detail: "seal signature does not verify"})
+		}
+	}
+	return v
+}
+
+// Event checks the next event of the chain.
+func (v *Verifier) Event(event *models.AuthEvent) {
+	v.report.Events++
+	// Events recorded before chaining was introduced lead the table.
+	if event.Hash == "" && !v.started && v.head == "" {
+		v.report.Unchained++
+		v.skipSeals(event.ID)
+		return
+	}
+	v.started = true
+	if event.PrevHash != v.head {
+		v.problem(event.ID, ProblemGap, "previous hash does not match the event before, events are missing or reordered")
+	}
+	if Hash(event) != event.Hash {
+		v.problem(event.ID, ProblemModified, "content does not match its hash")
+	}
+	v.head = event.Hash
+	for len(v.seals) > 0 && v.seals[0].EventID <= event.ID {
+		seal := v.seals[0]
+		v.seals = v.seals[1:]
+		if seal.EventID < event.ID {
+			v.report.Problems = append(v.report.Problems, Problem{SealID: seal.ID, EventID: seal.EventID, Kind: ProblemSealedGone,
+				Detail: "the sealed event is missing"})
+		} else if seal.Hash != event.Hash {
+			v.report.Problems = append(v.report.Problems, Problem{SealID: seal.ID, EventID: seal.EventID, Kind: ProblemModified,
+				Detail: "the sealed hash differs from the stored event"})
+		}
+	}
+}
+
+func (v *Verifier) skipSeals(eventID uint) {
+	for len(v.seals) > 0 && v.seals[0].EventID <= eventID {
+		v.seals = v.seals[1:]
+	}
+}
+
+func (v *Verifier) problem(eventID uint, kind string, detail string) {
+	v.report.Problems = append(v.report.Problems, Problem{EventID: eventID, Kind: kind, Detail: detail})
+}
+
+// Finish reports seals over events that never came, which means the chain
+// was cut off at the end, and returns the report.
+func (v *Verifier) Finish() *Report {
+	for _, seal := range v.seals {
+		v.report.Problems = append(v.report.Problems, Problem{SealID: seal.ID, EventID: seal.EventID, Kind: ProblemSealedGone,
+			Detail: "the sealed event is missing"})
+	}
+	v.seals = nil
+	v.report.Head = v.head
+	v.report.Valid = len(v.report.Problems) == 0
+	return &v.report
+}
+
+// VerifyDB verifies the whole chain stored in the database. The stored head
+// must be among its events, or the newest events have been removed, which
+// no seal can show when it happened after the last one.
+func VerifyDB(db *gorm.DB, key ed25519.PublicKey) (*Report, error) {
+	// The head is read first, events written meanwhile only come after it.
+	var heads []models.AuditHead
+	if err := db.Where("id = ?", auditHeadID).Find(&heads).Error; err != nil {
+		return nil, err
+	}
+	var seals []models.AuditSeal
+	if err := db.Order("event_id").Find(&seals).Error; err != nil {
+		return nil, err
+	}
+	headFound := len(heads) == 0 || heads[0].Hash == ""
+	verifier := NewVerifier("", seals, key)
+	rows, err := db.Model(&models.AuthEvent{}).Order("id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event models.AuthEvent
+		if err := db.ScanRows(rows, &event); err != nil {
+			return nil, err
+		}
+		verifier.Event(&event)
+		headFound = headFound || event.Hash == heads[0].Hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	report := verifier.Finish()
+	if !headFound {
+		report.Problems = append(report.Problems, Problem{Kind: ProblemTruncated,
+			Detail: "the chain ends before its recorded head, the newest events are missing"})
+		report.Valid = false
+	}
+	return report, nil
+}
@@ -0,0 +1,170 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// memorySink keeps events like the database would, assigning ids.
+type memorySink struct {
+	events []models.AuthEvent
+	fail   bool
+}
+
+func (s *memorySink) Write(_ context.Context, event *models.AuthEvent) error {
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	event.ID = uint(len(s.events) + 1)
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func writeChain(t *testing.T, count int) *memorySink {
+	store := &memorySink{}
+	chain := NewChain(store, "")
+	for i := 0; i < count; i++ {
+		require.NoError(t, chain.Write(context.Background(), &models.AuthEvent{
+			Time: time.Now(), Action: models.AuthActionAuthenticate, User: "alice@example.com", Outcome: models.AuthOutcomeAllow,
+		}))
+	}
+	return store
+}
+
+func verify(events []models.AuthEvent, seals []models.AuditSeal, key ed25519.PublicKey) *Report {
+	verifier := NewVerifier("", seals, key)
+	for i := range events {
+		verifier.Event(&events[i])
+	}
+	return verifier.Finish()
+}
+
+func problemKinds(report *Report) []string {
+	kinds := []string{}
+	for _, problem := range report.Problems {
+		kinds = append(kinds, problem.Kind)
+	}
+	return kinds
+}
+
+func TestVerifierDetectsTampering(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	store := writeChain(t, 5)
+	seals := []models.AuditSeal{*NewSeal(private, &store.events[4], time.Now())}
+	seals[0].ID = 1
+
+	report := verify(store.events, seals, public)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 5, report.Events)
+	assert.Equal(t, store.events[4].Hash, report.Head)
+
+	modified := append([]models.AuthEvent(nil), store.events...)
+	modified[1].Outcome = models.AuthOutcomeDeny
+	assert.Equal(t, []string{ProblemModified}, problemKinds(verify(modified, seals, public)))
+
+	// Rehashing the modified event only moves the break to the next one.
+	modified[1].Hash = Hash(&modified[1])
+	assert.Equal(t, []string{ProblemGap}, problemKinds(verify(modified, seals, public)))
+
+	gap := append(append([]models.AuthEvent(nil), store.events[:2]...), store.events[3:]...)
+	assert.Equal(t, []string{ProblemGap}, problemKinds(verify(gap, seals, public)))
+
+	assert.Equal(t, []string{ProblemSealedGone}, problemKinds(verify(store.events[:4], seals, public)),
+		"cutting off sealed events is detected")
+
+	other, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ProblemBadSeal}, problemKinds(verify(store.events, seals, other)))
+}
+
+func TestBundleVerifiesOffline(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	store := writeChain(t, 4)
+
+	// An excerpt from the middle of the chain verifies on its own.
+	bundle, err := NewBundle(private, store.events[1:], nil, time.Now())
+	require.NoError(t, err)
+	content, err := json.Marshal(bundle)
+	require.NoError(t, err)
+
+	var decoded Bundle
+	require.NoError(t, json.Unmarshal(content, &decoded))
+	report, err := decoded.Verify(public)
+	require.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 3, report.Events)
+
+	decoded.Events[0].User = "mallory@example.com"
+	_, err = decoded.Verify(public)
+	assert.Error(t, err, "changing a signed bundle breaks its signature")
+
+	other, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = bundle.Verify(other)
+	assert.Error(t, err)
+}
+
+func TestChainSkipsFailedWrites(t *testing.T) {
+	store := &memorySink{}
+	chain := NewChain(store, "")
+	write := func() error {
+		return chain.Write(context.Background(), &models.AuthEvent{Time: time.Now(), Action: models.AuthActionLogin})
+	}
+	require.NoError(t, write())
+	store.fail = true
+	assert.Error(t, write())
+	store.fail = false
+	require.NoError(t, write())
+	assert.True(t, verify(store.events, nil, nil).Valid, "a failed write leaves no gap")
+}
+
+func TestDBChainSharedByInstances(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:audit-chain?mode=memory&cache=shared"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.AuthEvent{}, &models.AuditHead{}, &models.AuditSeal{}))
+
+	// Two instances, or one restarted, continue the same chain.
+	first, err := NewDBChain(db, nil)
+	require.NoError(t, err)
+	second, err := NewDBChain(db, nil)
+	require.NoError(t, err)
+	write := func(ctx context.Context, chain *Chain) error {
+		return chain.Write(ctx, &models.AuthEvent{Time: time.Now(), Action: models.AuthActionAuthenticate})
+	}
+	require.NoError(t, write(context.Background(), first))
+	require.NoError(t, write(context.Background(), second))
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, write(cancelled, first))
+	require.NoError(t, write(context.Background(), first))
+	restarted, err := NewDBChain(db, nil)
+	require.NoError(t, err)
+	require.NoError(t, write(context.Background(), restarted))
+
+	report, err := VerifyDB(db, nil)
+	require.NoError(t, err)
+	assert.True(t, report.Valid, report.Problems)
+	assert.Equal(t, 4, report.Events)
+
+	// Removing the newest events leaves an intact chain, but not the head.
+	var newest models.AuthEvent
+	require.NoError(t, db.Order("id DESC").First(&newest).Error)
+	require.NoError(t, db.Delete(&newest).Error)
+	report, err = VerifyDB(db, nil)
+	require.NoError(t, err)
+	assert.False(t, report.Valid)
+	assert.Equal(t, []string{ProblemTruncated}, problemKinds(report))
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ForwardedClientCertHeader is set by Traefik's passTLSClientCert middleware.
+const ForwardedClientCertHeader = "X-Forwarded-Tls-Client-Cert"
+
+// CertificateIdentity is the principal a verified client certificate maps to.
+type CertificateIdentity struct {
+	// Identity is the email of a user, or the name of a service principal.
+	Identity string
+	// User is true when Identity came from an email SAN and names a human
+	// account rather than a service principal.
+	User bool
+}
+
+// ClientCertVerifier verifies client certificate chains against the
+// configured CA bundles.
+type ClientCertVerifier struct {
+	Roots *x509.CertPool
+}
+
+// LoadCertPool reads one or more PEM bundles into a certificate pool.
+func LoadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// Verify checks that chain[0] is a client certificate issued by one of the
+// trusted CAs, using the rest of the chain as intermediates, and maps it to
+// an identity.
+func (v *ClientCertVerifier) Verify(chain []*x509.Certificate) (CertificateIdentity, error) {
+	if len(chain) == 0 {
+		return CertificateIdentity{}, errors.New("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return CertificateIdentity{}, fmt.Errorf("verifying client certificate: %w", err)
+	}
+	return IdentityFromCertificate(chain[0])
+}
+
+// IdentityFromCertificate maps a certificate to a principal. An email SAN
+// names a user; otherwise the first URI SAN (e.g. a SPIFFE ID), DNS SAN or the
+// subject common name names a service principal.
+func IdentityFromCertificate(cert *x509.Certificate) (CertificateIdentity, error) {
+	if len(cert.EmailAddresses) > 0 {
+		return CertificateIdentity{Identity: strings.ToLower(cert.EmailAddresses[0]), User: true}, nil
+	}
+	if len(cert.URIs) > 0 {
+		return CertificateIdentity{Identity: cert.URIs[0].String()}, nil
+	}
+	if len(cert.DNSNames) > 0 {
+		return CertificateIdentity{Identity: cert.DNSNames[0]}, nil
+	}
+	if cert.Subject.CommonName != "" {
+		return CertificateIdentity{Identity: cert.Subject.CommonName}, nil
+	}
+	return CertificateIdentity{}, errors.New("client certificate carries no usable identity")
+}
+
+// ParseForwardedClientCert decodes the value of the X-Forwarded-Tls-Client-Cert
+// header: URL-escaped, comma separated PEM certificates, with or without the
+// BEGIN/END markers, leaf first.
+func ParseForwardedClientCert(value string) ([]*x509.Certificate, error) {
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		return nil, fmt.Errorf("unescaping forwarded certificate: %w", err)
+	}
+	var chain []*x509.Certificate
+	for _, part := range strings.Split(unescaped, ",") {
+		// Markers may arrive with their space form-encoded as "+". Other
+		// "+" characters are base64 and must survive, hence PathUnescape.
+		part = strings.NewReplacer(
+			"-----BEGIN CERTIFICATE-----", "",
+			"-----END CERTIFICATE-----", "",
+			"-----BEGIN+CERTIFICATE-----", "",
+			"-----END+CERTIFICATE-----", "",
+			"\n", "", "\r", "", " ", "",
+		).Replace(part)
+		if part == "" {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("decoding forwarded certificate: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing forwarded certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no forwarded certificate")
+	}
+	return chain, nil
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "KubeVoyage Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCA{cert: cert, key: key}
+}
+
+func (ca testCA) issue(t *testing.T, template *x509.Certificate) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestClientCertVerifier(t *testing.T) {
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	verifier := &ClientCertVerifier{Roots: roots}
+
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/ci/sa/runner")
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+		expected CertificateIdentity
+	}{
+		{"email SAN", &x509.Certificate{Subject: pkix.Name{CommonName: "Alice"}, EmailAddresses: []string{"Alice@Example.com"}},
+			CertificateIdentity{Identity: "alice@example.com", User: true}},
+		{"URI SAN", &x509.Certificate{Subject: pkix.Name{CommonName: "runner"}, URIs: []*url.URL{spiffe}},
+			CertificateIdentity{Identity: "spiffe://cluster.local/ns/ci/sa/runner"}},
+		{"DNS SAN", &x509.Certificate{DNSNames: []string{"backup.internal"}},
+			CertificateIdentity{Identity: "backup.internal"}},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "grafana"}},
+			CertificateIdentity{Identity: "grafana"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := verifier.Verify([]*x509.Certificate{ca.issue(t, tt.template)})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, identity)
+		})
+	}
+
+	other := newTestCA(t)
+	_, err := verifier.Verify([]*x509.Certificate{other.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}})})
+	assert.Error(t, err)
+}
+
+func TestParseForwardedClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "grafana"}})
+	body := base64.StdEncoding.EncodeToString(leaf.Raw)
+
+	// Traefik strips the PEM markers; other proxies forward full PEM blocks.
+	for _, value := range []string{
+		url.QueryEscape(body),
+		url.QueryEscape("-----BEGIN CERTIFICATE-----\n" + body + "\n-----END CERTIFICATE-----\n"),
+		url.QueryEscape(body) + "," + url.QueryEscape(base64.StdEncoding.EncodeToString(ca.cert.Raw)),
+	} {
+		chain, err := ParseForwardedClientCert(value)
+		require.NoError(t, err)
+		assert.Equal(t, leaf.Raw, chain[0].Raw)
+	}
+
+	_, err := ParseForwardedClientCert("not-a-certificate")
+	assert.Error(t, err)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"})
+	require.NoError(t, err)
+
+	assert.True(t, proxies.Contains("10.42.0.7:51234"))
+	assert.True(t, proxies.Contains("192.168.1.5:80"))
+	assert.True(t, proxies.Contains("[fd00::1]:443"))
+	assert.True(t, proxies.Contains("10.1.2.3"))
+	assert.False(t, proxies.Contains("192.168.1.6:80"))
+	assert.False(t, proxies.Contains("203.0.113.9:443"))
+	assert.False(t, TrustedProxies(nil).Contains("10.0.0.1:1"))
+
+	forwarded := []string{"6.6.6.6, 198.51.100.7", "10.0.0.2"}
+	assert.Equal(t, "198.51.100.7", proxies.ClientIP("10.42.0.7:51234", forwarded), "right-most untrusted hop")
+	assert.Equal(t, "203.0.113.9", proxies.ClientIP("203.0.113.9:443", forwarded), "spoofed by an untrusted peer")
+	assert.Equal(t, "10.0.0.3", proxies.ClientIP("10.42.0.7:51234", []string{"10.0.0.3, 10.0.0.2"}))
+	assert.Equal(t, "10.42.0.7", proxies.ClientIP("10.42.0.7:51234", nil))
+
+	_, err = ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
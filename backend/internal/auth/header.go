@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSignatureHeader carries the HMAC of the identity header as
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<value>">". When a groups
+// header is configured, "\n<groups>" is appended to the signed message.
+const DefaultSignatureHeader = "X-Auth-Signature"
+
+// ErrUntrustedHeader is returned when an identity header is present but
+// neither comes from a trusted proxy nor carries a valid signature.
+var ErrUntrustedHeader = errors.New("identity header from untrusted source")
+
+// UpstreamIdentity is what a trusted upstream proxy asserted about a request.
+type UpstreamIdentity struct {
+	Email string
+	// Groups is nil when no groups header is configured, so callers can tell
+	// "no claims available" from "member of no groups".
+	Groups []string
+}
+
+// HeaderAuthenticator accepts an identity asserted by an upstream proxy such
+// as oauth2-proxy in a request header.
+type HeaderAuthenticator struct {
+	// Header holds the identity, e.g. X-Forwarded-Email.
+	Header string
+	// GroupsHeader optionally holds the comma separated group claims of the
+	// user, e.g. X-Forwarded-Groups.
+	GroupsHeader string
+	// TrustedProxies may set Header without a signature.
+	TrustedProxies TrustedProxies
+	// Secret, when set, lets any peer assert an identity that is signed with it.
+	Secret          []byte
+	SignatureHeader string
+	// MaxSkew bounds the age of a signature. Defaults to five minutes.
+	MaxSkew time.Duration
+}
+
+// Identity returns the identity asserted for the request. Its Email is empty
+// when the header is absent.
+func (a *HeaderAuthenticator) Identity(r *http.Request) (UpstreamIdentity, error) {
+	value := strings.TrimSpace(r.Header.Get(a.Header))
+	if value == "" {
+		return UpstreamIdentity{}, nil
+	}
+	signed := []string{value}
+	var groups []string
+	if a.GroupsHeader != "" {
+		rawGroups := r.Header.Get(a.GroupsHeader)
+		signed = append(signed, rawGroups)
+		groups = []string{}
+		for _, group := range strings.Split(rawGroups, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	identity := UpstreamIdentity{Email: strings.ToLower(value), Groups: groups}
+
+	if a.TrustedProxies.Contains(r.RemoteAddr) {
+		return identity, nil
+	}
+	if len(a.Secret) == 0 {
+		return UpstreamIdentity{}, ErrUntrustedHeader
+	}
+	if err := a.verifySignature(signed, r.Header.Get(a.signatureHeader()), time.Now()); err != nil {
+		return UpstreamIdentity{}, fmt.Errorf("%w: %v", ErrUntrustedHeader, err)
+	}
+	return identity, nil
+}
+
+func (a *HeaderAuthenticator) signatureHeader() string {
+	if a.SignatureHeader != "" {
+		return a.SignatureHeader
+	}
+	return DefaultSignatureHeader
+}
+
+func (a *HeaderAuthenticator) verifySignature(values []string, signature string, now time.Time) error {
+	var timestamp, mac string
+	for _, field := range strings.Split(signature, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "t":
+			timestamp = val
+		case "v1":
+			mac = val
+		}
+	}
+	if timestamp == "" || mac == "" {
+		return errors.New("missing signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	maxSkew := a.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = 5 * time.Minute
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > maxSkew || age < -maxSkew {
+		return errors.New("signature expired")
+	}
+	expected, err := hex.DecodeString(mac)
+	if err != nil || !hmac.Equal(expected, signatureMAC(a.Secret, timestamp, values)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// SignHeader computes the signature header value an upstream proxy sends
+// along with the identity header. values are the identity followed by the
+// groups header value when one is configured.
+func SignHeader(secret []byte, at time.Time, values ...string) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(signatureMAC(secret, timestamp, values))
+}
+
+// signatureMAC joins the values with newlines, which cannot occur in header
+// values, so no two different sets of headers share a message.
+func signatureMAC(secret []byte, timestamp string, values []string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + strings.Join(values, "\n")))
+	return mac.Sum(nil)
+}
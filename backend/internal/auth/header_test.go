@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func identify(authenticator *HeaderAuthenticator, remote string, headers map[string]string) (UpstreamIdentity, error) {
+	r := httptest.NewRequest("GET", "/api/authenticate", nil)
+	r.RemoteAddr = remote
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	return authenticator.Identity(r)
+}
+
+func TestHeaderAuthenticator(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	secret := []byte("shared-secret")
+	authenticator := &HeaderAuthenticator{Header: "X-Forwarded-Email", TrustedProxies: proxies, Secret: secret}
+
+	request := func(remote string, headers map[string]string) (string, error) {
+		identity, err := identify(authenticator, remote, headers)
+		return identity.Email, err
+	}
+
+	identity, err := request("10.1.2.3:4000", map[string]string{"X-Forwarded-Email": "Alice@Example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", identity)
+
+	identity, err = request("203.0.113.7:4000", nil)
+	require.NoError(t, err)
+	assert.Empty(t, identity)
+
+	_, err = request("203.0.113.7:4000", map[string]string{"X-Forwarded-Email": "alice@example.com"})
+	assert.ErrorIs(t, err, ErrUntrustedHeader)
+
+	identity, err = request("203.0.113.7:4000", map[string]string{
+		"X-Forwarded-Email": "alice@example.com",
+		"X-Auth-Signature":  SignHeader(secret, time.Now(), "alice@example.com"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", identity)
+
+	for name, signature := range map[string]string{
+		"other identity": SignHeader(secret, time.Now(), "bob@example.com"),
+		"wrong secret":   SignHeader([]byte("guess"), time.Now(), "alice@example.com"),
+		"expired":        SignHeader(secret, time.Now().Add(-time.Hour), "alice@example.com"),
+		"malformed":      "v1=deadbeef",
+	} {
+		_, err := request("203.0.113.7:4000", map[string]string{
+			"X-Forwarded-Email": "alice@example.com",
+			"X-Auth-Signature":  signature,
+		})
+		assert.ErrorIs(t, err, ErrUntrustedHeader, name)
+	}
+}
+
+func TestHeaderAuthenticatorGroups(t *testing.T) {
+	secret := []byte("shared-secret")
+	authenticator := &HeaderAuthenticator{Header: "X-Forwarded-Email", GroupsHeader: "X-Forwarded-Groups", Secret: secret}
+
+	identity, err := identify(authenticator, "203.0.113.7:4000", map[string]string{
+		"X-Forwarded-Email":  "alice@example.com",
+		"X-Forwarded-Groups": "oncall, platform",
+		"X-Auth-Signature":   SignHeader(secret, time.Now(), "alice@example.com", "oncall, platform"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"oncall", "platform"}, identity.Groups)
+
+	_, err = identify(authenticator, "203.0.113.7:4000", map[string]string{
+		"X-Forwarded-Email":  "alice@example.com",
+		"X-Forwarded-Groups": "admins",
+		"X-Auth-Signature":   SignHeader(secret, time.Now(), "alice@example.com", "oncall, platform"),
+	})
+	assert.ErrorIs(t, err, ErrUntrustedHeader, "groups must be covered by the signature")
+
+	identity, err = identify(authenticator, "203.0.113.7:4000", map[string]string{
+		"X-Forwarded-Email": "alice@example.com",
+		"X-Auth-Signature":  SignHeader(secret, time.Now(), "alice@example.com", ""),
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, identity.Groups)
+	assert.Empty(t, identity.Groups)
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies is the set of networks whose forwarded headers are believed.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses CIDRs or single addresses.
+func ParseTrustedProxies(values []string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// Contains reports whether the remote address of a request (host:port or a
+// bare IP) belongs to a trusted proxy.
+func (p TrustedProxies) Contains(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent a request arriving
+// from remoteAddr with the given X-Forwarded-For headers. The headers are only
+// believed when the peer is a trusted proxy, and then only up to the
+// right-most hop that is not a trusted proxy itself: everything left of it
+// was written by the client.
+func (p TrustedProxies) ClientIP(remoteAddr string, forwardedFor []string) string {
+	client, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		client = remoteAddr
+	}
+	if !p.Contains(remoteAddr) {
+		return client
+	}
+	var hops []string
+	for _, value := range forwardedFor {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		client = hop
+		if !p.Contains(hop) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,344 @@
+// Package auth contains the identity sources KubeVoyage accepts besides its
+// own login session: Kubernetes ServiceAccount tokens, client certificates
+// and identities asserted by a trusted upstream proxy.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceAccountPrefix is the prefix of every Kubernetes ServiceAccount
+// username, followed by "<namespace>:<name>".
+const ServiceAccountPrefix = "system:serviceaccount:"
+
+// ErrNotServiceAccountToken is returned for bearer tokens that are not
+// ServiceAccount tokens at all, so callers can fall back to other methods.
+var ErrNotServiceAccountToken = errors.New("not a service account token")
+
+// ServiceAccount is the identity carried by a validated token.
+type ServiceAccount struct {
+	Namespace string
+	Name      string
+}
+
+// Username returns the Kubernetes username system:serviceaccount:<ns>:<name>.
+func (sa ServiceAccount) Username() string {
+	return ServiceAccountPrefix + sa.Namespace + ":" + sa.Name
+}
+
+// ParseServiceAccountUsername splits a system:serviceaccount:<ns>:<name>
+// username into its parts.
+func ParseServiceAccountUsername(username string) (ServiceAccount, error) {
+	rest, ok := strings.CutPrefix(username, ServiceAccountPrefix)
+	if !ok {
+		return ServiceAccount{}, fmt.Errorf("%q is not a service account username", username)
+	}
+	namespace, name, ok := strings.Cut(rest, ":")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, ":") {
+		return ServiceAccount{}, fmt.Errorf("malformed service account username %q", username)
+	}
+	return ServiceAccount{Namespace: namespace, Name: name}, nil
+}
+
+// TokenValidator validates a ServiceAccount bearer token.
+type TokenValidator interface {
+	Validate(ctx context.Context, token string) (ServiceAccount, error)
+}
+
+// looksLikeServiceAccountToken cheaply checks the unverified subject of a JWT
+// before any network round trip is made for it.
+func looksLikeServiceAccountToken(token string) bool {
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return false
+	}
+	return strings.HasPrefix(claims.Subject, ServiceAccountPrefix)
+}
+
+// TokenReviewer validates tokens by asking the Kubernetes API server through
+// the TokenReview API.
+type TokenReviewer struct {
+	// APIServer is the base URL of the API server, e.g. https://kubernetes.default.svc.
+	APIServer string
+	// CredentialsFile holds the bearer token KubeVoyage itself uses to call
+	// the API server. It is re-read on every call because projected tokens rotate.
+	CredentialsFile string
+	// Audiences, when set, are required to be among the token's audiences.
+	Audiences []string
+	Client    *http.Client
+	// CacheTTL controls how long a successful review is reused.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedReview
+}
+
+type cachedReview struct {
+	account ServiceAccount
+	expires time.Time
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status,omitempty"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          userInfo `json:"user"`
+	Audiences     []string `json:"audiences,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type userInfo struct {
+	Username string `json:"username"`
+}
+
+func (t *TokenReviewer) Validate(ctx context.Context, token string) (ServiceAccount, error) {
+	if !looksLikeServiceAccountToken(token) {
+		return ServiceAccount{}, ErrNotServiceAccountToken
+	}
+	key := cacheKey(token)
+	if account, ok := t.cached(key); ok {
+		return account, nil
+	}
+
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: t.Audiences},
+	})
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(t.APIServer, "/")+"/apis/authentication.k8s.io/v1/tokenreviews", bytes.NewReader(body))
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.CredentialsFile != "" {
+		credentials, err := os.ReadFile(t.CredentialsFile)
+		if err != nil {
+			return ServiceAccount{}, fmt.Errorf("reading API server credentials: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(credentials)))
+	}
+
+	resp, err := httpClient(t.Client).Do(req)
+	if err != nil {
+		return ServiceAccount{}, fmt.Errorf("calling TokenReview API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return ServiceAccount{}, fmt.Errorf("TokenReview API returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	var review tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		return ServiceAccount{}, fmt.Errorf("decoding TokenReview response: %w", err)
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return ServiceAccount{}, fmt.Errorf("token rejected: %s", review.Status.Error)
+		}
+		return ServiceAccount{}, errors.New("token rejected")
+	}
+	if len(t.Audiences) > 0 && !containsAny(review.Status.Audiences, t.Audiences) {
+		return ServiceAccount{}, errors.New("token audience not accepted")
+	}
+	account, err := ParseServiceAccountUsername(review.Status.User.Username)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+	t.store(key, account)
+	return account, nil
+}
+
+func (t *TokenReviewer) cached(key string) (ServiceAccount, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(t.cache, key)
+		return ServiceAccount{}, false
+	}
+	return entry.account, true
+}
+
+func (t *TokenReviewer) store(key string, account ServiceAccount) {
+	if t.CacheTTL <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cache == nil {
+		t.cache = make(map[string]cachedReview)
+	}
+	now := time.Now()
+	for k, entry := range t.cache {
+		if now.After(entry.expires) {
+			delete(t.cache, k)
+		}
+	}
+	t.cache[key] = cachedReview{account: account, expires: now.Add(t.CacheTTL)}
+}
+
+// JWKSValidator validates tokens offline against the signing keys published
+// by the cluster's ServiceAccount issuer.
+type JWKSValidator struct {
+	// Issuer must match the iss claim of the token. It is also used for
+	// OIDC discovery when JWKSURL is empty.
+	Issuer  string
+	JWKSURL string
+	// CredentialsFile is sent as bearer token on discovery requests, which
+	// most clusters only allow to authenticated service accounts.
+	CredentialsFile string
+	Audiences       []string
+	Client          *http.Client
+	// RefreshInterval bounds how long fetched keys are trusted.
+	RefreshInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+type serviceAccountClaims struct {
+	jwt.RegisteredClaims
+}
+
+func (v *JWKSValidator) Validate(ctx context.Context, token string) (ServiceAccount, error) {
+	if !looksLikeServiceAccountToken(token) {
+		return ServiceAccount{}, ErrNotServiceAccountToken
+	}
+	claims := serviceAccountClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(v.Issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return ServiceAccount{}, fmt.Errorf("invalid service account token: %w", err)
+	}
+	if len(v.Audiences) > 0 && !containsAny(claims.Audience, v.Audiences) {
+		return ServiceAccount{}, errors.New("token audience not accepted")
+	}
+	return ParseServiceAccountUsername(claims.Subject)
+}
+
+// key returns the verification key for kid, refreshing the key set when the
+// kid is unknown or the cached set is stale.
+func (v *JWKSValidator) key(ctx context.Context, kid string) (any, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	refresh := v.RefreshInterval
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	if key, ok := v.keys[kid]; ok && time.Since(v.fetchedAt) < refresh {
+		return key, nil
+	}
+	// Avoid hammering the issuer with unknown kids.
+	if v.keys != nil && time.Since(v.fetchedAt) < 10*time.Second {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (v *JWKSValidator) fetchKeys(ctx context.Context) (map[string]any, error) {
+	jwksURL := v.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, strings.TrimSuffix(v.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OIDC discovery: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("OIDC discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var set jsonWebKeySet
+	if err := v.getJSON(ctx, jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	return set.publicKeys()
+}
+
+func (v *JWKSValidator) getJSON(ctx context.Context, url string, target any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if v.CredentialsFile != "" {
+		if credentials, err := os.ReadFile(v.CredentialsFile); err == nil {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(credentials)))
+		}
+	}
+	resp, err := httpClient(v.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+func httpClient(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, value := range values {
+		if slices.Contains(wanted, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-key"
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func saClaims(issuer string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": issuer,
+		"sub": "system:serviceaccount:monitoring:prometheus",
+		"aud": []string{"kubevoyage"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestParseServiceAccountUsername(t *testing.T) {
+	sa, err := ParseServiceAccountUsername("system:serviceaccount:monitoring:prometheus")
+	require.NoError(t, err)
+	assert.Equal(t, ServiceAccount{Namespace: "monitoring", Name: "prometheus"}, sa)
+	assert.Equal(t, "system:serviceaccount:monitoring:prometheus", sa.Username())
+
+	for _, invalid := range []string{"alice@example.com", "system:serviceaccount:monitoring", "system:serviceaccount::x"} {
+		_, err := ParseServiceAccountUsername(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTokenReviewer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	valid := signToken(t, key, saClaims("https://kubernetes.default.svc"))
+
+	var calls atomic.Int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, "/apis/authentication.k8s.io/v1/tokenreviews", r.URL.Path)
+		assert.Equal(t, "Bearer kubevoyage-token", r.Header.Get("Authorization"))
+		var review tokenReview
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&review))
+		assert.Equal(t, []string{"kubevoyage"}, review.Spec.Audiences)
+		if review.Spec.Token == valid {
+			review.Status = tokenReviewStatus{
+				Authenticated: true,
+				User:          userInfo{Username: "system:serviceaccount:monitoring:prometheus"},
+				Audiences:     []string{"kubevoyage"},
+			}
+		} else {
+			review.Status = tokenReviewStatus{Error: "invalid bearer token"}
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer apiServer.Close()
+
+	credentials := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(credentials, []byte("kubevoyage-token\n"), 0o600))
+	reviewer := &TokenReviewer{
+		APIServer:       apiServer.URL,
+		CredentialsFile: credentials,
+		Audiences:       []string{"kubevoyage"},
+		CacheTTL:        time.Minute,
+	}
+
+	sa, err := reviewer.Validate(context.Background(), valid)
+	require.NoError(t, err)
+	assert.Equal(t, "system:serviceaccount:monitoring:prometheus", sa.Username())
+
+	_, err = reviewer.Validate(context.Background(), valid)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.Load(), "second validation should be served from cache")
+
+	forged := signToken(t, key, jwt.MapClaims{"sub": "system:serviceaccount:kube-system:admin"})
+	_, err = reviewer.Validate(context.Background(), forged)
+	assert.ErrorContains(t, err, "invalid bearer token")
+
+	_, err = reviewer.Validate(context.Background(), "opaque-app-token")
+	assert.ErrorIs(t, err, ErrNotServiceAccountToken)
+}
+
+func TestJWKSValidator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var issuer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/openid/v1/jwks"})
+		case "/openid/v1/jwks":
+			json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+				Kid: "test-key",
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	issuer = server.URL
+
+	validator := &JWKSValidator{Issuer: issuer, Audiences: []string{"kubevoyage"}}
+
+	sa, err := validator.Validate(context.Background(), signToken(t, key, saClaims(issuer)))
+	require.NoError(t, err)
+	assert.Equal(t, ServiceAccount{Namespace: "monitoring", Name: "prometheus"}, sa)
+
+	_, err = validator.Validate(context.Background(), signToken(t, key, saClaims("https://other-issuer")))
+	assert.Error(t, err)
+
+	wrongAudience := saClaims(issuer)
+	wrongAudience["aud"] = []string{"vault"}
+	_, err = validator.Validate(context.Background(), signToken(t, key, wrongAudience))
+	assert.Error(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = validator.Validate(context.Background(), signToken(t, otherKey, saClaims(issuer)))
+	assert.Error(t, err)
+}
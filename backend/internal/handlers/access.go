@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Access sources reported by the access queries. Group grants are reported
+// as "group:<name>".
+const (
+	accessSourceRole   = "role"
+	accessSourceDirect = "direct"
+	accessSourcePolicy = "policy"
+)
+
+// accessEntry says that a user can reach a site and why. Conditional is set
+// for sites with policies, whose answer also depends on the request.
+type accessEntry struct {
+	User        string   `json:"user"`
+	Site        string   `json:"site"`
+	Sources     []string `json:"sources"`
+	Conditional bool     `json:"conditional"`
+}
+
+type accessMatrix struct {
+	Sites []string          `json:"sites"`
+	Rows  []accessMatrixRow `json:"rows"`
+}
+
+type accessMatrixRow struct {
+	User   string                      `json:"user"`
+	Access map[string]accessMatrixCell `json:"access"`
+}
+
+type accessMatrixCell struct {
+	Sources     []string `json:"sources"`
+	Conditional bool     `json:"conditional"`
+}
+
+// accessFilter narrows computeAccess to one user or one site.
+type accessFilter struct {
+	UserID uint
+	SiteID uint
+}
+
+// computeAccess works out every user/site pair with access from all grant
+// sources at once: role bypass, active direct grants, group grants and allow
+// policies. Site policies depend on the request and are not evaluated: every
+// user may get through the allow policies of a site, and all entries for
+// sites with policies are marked conditional.
+func (h *Handler) computeAccess(filter accessFilter) ([]accessEntry, error) {
+	var users []models.User
+	var sites []models.Site
+	userQuery := h.db.Order("email")
+	siteQuery := h.db.Order("url")
+	if filter.UserID != 0 {
+		userQuery = userQuery.Where("id = ?", filter.UserID)
+	}
+	if filter.SiteID != 0 {
+		siteQuery = siteQuery.Where("id = ?", filter.SiteID)
+	}
+	if err := userQuery.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if err := siteQuery.Find(&sites).Error; err != nil {
+		return nil, err
+	}
+
+	type pair struct{ userID, siteID uint }
+	sources := map[pair][]string{}
+
+	var userSites []models.UserSite
+	grantQuery := h.db.Where("state = ?", models.Authorized)
+	if filter.UserID != 0 {
+		grantQuery = grantQuery.Where("user_id = ?", filter.UserID)
+	}
+	if filter.SiteID != 0 {
+		grantQuery = grantQuery.Where("site_id = ?", filter.SiteID)
+	}
+	if err := grantQuery.Find(&userSites).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, userSite := range userSites {
+		if userSite.Active(now) {
+			key := pair{userSite.UserID, userSite.SiteID}
+			sources[key] = append(sources[key], accessSourceDirect)
+		}
+	}
+
+	type groupGrant struct {
+		UserID  uint
+		SiteID  uint
+		GroupID uint
+	}
+	var groupGrants []groupGrant
+	groupQuery := h.db.Table("group_sites").
+		Select("group_members.user_id as user_id, group_sites.site_id as site_id, group_sites.group_id as group_id").
+		Joins("JOIN group_members ON group_members.group_id = group_sites.group_id")
+	if filter.UserID != 0 {
+		groupQuery = groupQuery.Where("group_members.user_id = ?", filter.UserID)
+	}
+	if filter.SiteID != 0 {
+		groupQuery = groupQuery.Where("group_sites.site_id = ?", filter.SiteID)
+	}
+	if err := groupQuery.Scan(&groupGrants).Error; err != nil {
+		return nil, err
+	}
+	var groups []models.Group
+	if err := h.db.Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	groupNames := make(map[uint]string, len(groups))
+	for _, group := range groups {
+		groupNames[group.ID] = group.Name
+	}
+	for _, grant := range groupGrants {
+		key := pair{grant.UserID, grant.SiteID}
+		sources[key] = append(sources[key], "group:"+groupNames[grant.GroupID])
+	}
+
+	var policies []models.SitePolicy
+	if err := h.db.Select("site_id", "effect").Find(&policies).Error; err != nil {
+		return nil, err
+	}
+	conditional := make(map[uint]bool, len(policies))
+	allowed := make(map[uint]bool, len(policies))
+	for _, sitePolicy := range policies {
+		conditional[sitePolicy.SiteID] = true
+		if sitePolicy.Effect == models.PolicyAllow {
+			allowed[sitePolicy.SiteID] = true
+		}
+	}
+
+	entries := []accessEntry{}
+	for _, user := range users {
+		bypass := user.Role.Can(models.PermAccessAllSites)
+		for _, site := range sites {
+			entry := accessEntry{
+				User:        user.Email,
+				Site:        site.URL,
+				Sources:     sources[pair{user.ID, site.ID}],
+				Conditional: conditional[site.ID],
+			}
+			if bypass {
+				entry.Sources = append([]string{accessSourceRole}, entry.Sources...)
+			}
+			groupsFrom := 0
+			for groupsFrom < len(entry.Sources) && !strings.HasPrefix(entry.Sources[groupsFrom], "group:") {
+				groupsFrom++
+			}
+			sort.Strings(entry.Sources[groupsFrom:])
+			if allowed[site.ID] {
+				entry.Sources = append(entry.Sources, accessSourcePolicy)
+			}
+			if len(entry.Sources) == 0 {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// HandleSiteAccess answers "who can reach this site" (GET ?site=).
+// Requires the audit:view permission.
+func (h *Handler) HandleSiteAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	site, ok := h.siteFromRequest(w, r.URL.Query().Get("site"))
+	if !ok {
+		return
+	}
+	h.sendAccess(w, accessFilter{SiteID: site.ID})
+}
+
+// HandleUserAccess answers "what can this user reach" (GET ?user=).
+// Requires the audit:view permission.
+func (h *Handler) HandleUserAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	var user models.User
+	if err := h.db.Where("email = ?", r.URL.Query().Get("user")).First(&user).Error; err != nil {
+		sendJSONError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	h.sendAccess(w, accessFilter{UserID: user.ID})
+}
+
+func (h *Handler) sendAccess(w http.ResponseWriter, filter accessFilter) {
+	entries, err := h.computeAccess(filter)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, entries, http.StatusOK)
+}
+
+// HandleAccessMatrix exports the full user-by-site access matrix as JSON or,
+// with ?format=csv, as CSV with one row per user and one column per site.
+// Cells list the access sources separated by semicolons, conditional access
+// is suffixed with "?". Requires the audit:view permission.
+func (h *Handler) HandleAccessMatrix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		sendJSONError(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := h.computeAccess(accessFilter{})
+	var users []string
+	var sites []string
+	if err == nil {
+		err = h.db.Model(&models.User{}).Order("email").Pluck("email", &users).Error
+	}
+	if err == nil {
+		err = h.db.Model(&models.Site{}).Order("url").Pluck("url", &sites).Error
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	cells := make(map[string]map[string]accessEntry, len(users))
+	for _, entry := range entries {
+		if cells[entry.User] == nil {
+			cells[entry.User] = map[string]accessEntry{}
+		}
+		cells[entry.User][entry.Site] = entry
+	}
+
+	if format != "csv" {
+		matrix := accessMatrix{Sites: append([]string{}, sites...), Rows: make([]accessMatrixRow, 0, len(users))}
+		for _, user := range users {
+			row := accessMatrixRow{User: user, Access: map[string]accessMatrixCell{}}
+			for site, entry := range cells[user] {
+				row.Access[site] = accessMatrixCell{Sources: entry.Sources, Conditional: entry.Conditional}
+			}
+			matrix.Rows = append(matrix.Rows, row)
+		}
+		sendJSONResponse(w, matrix, http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="access-matrix.csv"`)
+	writer := csv.NewWriter(w)
+	writer.Write(append([]string{"user"}, sites...))
+	for _, user := range users {
+		record := make([]string, 0, len(sites)+1)
+		record = append(record, user)
+		for _, site := range sites {
+			entry, ok := cells[user][site]
+			cell := ""
+			if ok {
+				cell = strings.Join(entry.Sources, ";")
+				if entry.Conditional {
+					cell += "?"
+				}
+			}
+			record = append(record, cell)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Writing access matrix failed: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessQueries(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	auditor := models.User{Email: "auditor@example.com", Role: models.RoleAuditor}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	bob := models.User{Email: "bob@example.com", Role: models.RoleUser}
+	for _, user := range []*models.User{&auditor, &alice, &bob} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	wiki := models.Site{URL: "https://wiki.example.com"}
+	grafana := models.Site{URL: "https://grafana.example.com"}
+	require.NoError(t, db.Create(&wiki).Error)
+	require.NoError(t, db.Create(&grafana).Error)
+
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, db.Create(&models.UserSite{UserID: alice.ID, SiteID: wiki.ID, State: models.Authorized}).Error)
+	require.NoError(t, db.Create(&models.UserSite{UserID: bob.ID, SiteID: wiki.ID, State: models.Authorized, ExpiresAt: &past}).Error)
+	group := models.Group{Name: "platform"}
+	require.NoError(t, db.Create(&group).Error)
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: group.ID, UserID: alice.ID}).Error)
+	require.NoError(t, db.Create(&models.GroupSite{GroupID: group.ID, SiteID: wiki.ID}).Error)
+	require.NoError(t, db.Create(&models.GroupSite{GroupID: group.ID, SiteID: grafana.ID}).Error)
+	require.NoError(t, db.Create(&models.SitePolicy{SiteID: grafana.ID, Name: "office", Effect: models.PolicyDeny,
+		Expression: `request.ip != "10.0.0.1"`}).Error)
+
+	query := func(caller, target string, handler http.HandlerFunc) (*httptest.ResponseRecorder, []accessEntry) {
+		rr := httptest.NewRecorder()
+		handler(rr, requestAs(caller, http.MethodGet, target, ""))
+		var entries []accessEntry
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&entries))
+		}
+		return rr, entries
+	}
+
+	rr, _ := query(alice.Email, "/api/access/site?site=https://wiki.example.com", h.HandleSiteAccess)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	_, entries := query(auditor.Email, "/api/access/site?site=https://wiki.example.com", h.HandleSiteAccess)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "admin@admin.de", entries[0].User)
+	assert.Equal(t, []string{"role"}, entries[0].Sources)
+	assert.Equal(t, alice.Email, entries[1].User)
+	assert.Equal(t, []string{"direct", "group:platform"}, entries[1].Sources)
+
+	_, entries = query(auditor.Email, "/api/access/user?user=alice@example.com", h.HandleUserAccess)
+	require.Len(t, entries, 2)
+	assert.Equal(t, grafana.URL, entries[0].Site)
+	assert.True(t, entries[0].Conditional)
+	assert.False(t, entries[1].Conditional)
+
+	_, entries = query(auditor.Email, "/api/access/user?user=bob@example.com", h.HandleUserAccess)
+	assert.Empty(t, entries, "expired grants give no access")
+
+	// Anyone may get through an allow policy.
+	require.NoError(t, db.Create(&models.SitePolicy{SiteID: grafana.ID, Name: "oncall", Effect: models.PolicyAllow,
+		Expression: `user.groups.exists(g, g == "oncall")`}).Error)
+	_, entries = query(auditor.Email, "/api/access/site?site=https://grafana.example.com", h.HandleSiteAccess)
+	require.Len(t, entries, 4)
+	assert.Equal(t, []string{"role", "policy"}, entries[0].Sources)
+	assert.True(t, entries[0].Conditional, "deny policies apply to every role")
+	assert.Equal(t, alice.Email, entries[1].User)
+	assert.Equal(t, []string{"group:platform", "policy"}, entries[1].Sources)
+	assert.Equal(t, auditor.Email, entries[2].User)
+	assert.Equal(t, []string{"policy"}, entries[2].Sources)
+	assert.True(t, entries[2].Conditional)
+
+	rr = httptest.NewRecorder()
+	h.HandleAccessMatrix(rr, requestAs(auditor.Email, http.MethodGet, "/api/access/matrix?format=csv", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user", grafana.URL, wiki.URL}, records[0])
+	for _, record := range records[1:] {
+		if record[0] == alice.Email {
+			assert.Equal(t, []string{alice.Email, "group:platform;policy?", "direct;group:platform"}, record)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	h.HandleAccessMatrix(rr, requestAs(auditor.Email, http.MethodGet, "/api/access/matrix", ""))
+	var matrix accessMatrix
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&matrix))
+	assert.Equal(t, []string{grafana.URL, wiki.URL}, matrix.Sites)
+	assert.Len(t, matrix.Rows, 4)
+}
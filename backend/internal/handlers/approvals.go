@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+)
+
+// approvalProgress is returned while a request still waits for approvers.
+type approvalProgress struct {
+	State             models.State `json:"state"`
+	Approvals         []string     `json:"approvals"`
+	RequiredApprovals int          `json:"requiredApprovals"`
+}
+
+// needsSeveralApprovals reports whether a site uses multi-party approval.
+func needsSeveralApprovals(site models.Site) bool {
+	return site.RequiredApprovals > 1
+}
+
+// approvalGroupIDs returns the groups whose members' approvals count for the
+// site. An empty result means every approver counts.
+func (h *Handler) approvalGroupIDs(siteID uint) ([]uint, error) {
+	var groupIDs []uint
+	err := h.db.Model(&models.SiteApprovalGroup{}).Where("site_id = ?", siteID).Pluck("group_id", &groupIDs).Error
+	return groupIDs, err
+}
+
+// approvalGroupNames returns the names of the approval groups of a site.
+func (h *Handler) approvalGroupNames(siteID uint) ([]string, error) {
+	names := []string{}
+	err := h.db.Model(&models.Group{}).
+		Where("id IN (?)", h.db.Model(&models.SiteApprovalGroup{}).Select("group_id").Where("site_id = ?", siteID)).
+		Order("name").
+		Pluck("name", &names).Error
+	return names, err
+}
+
+// setApprovalGroups replaces the approval groups of a site. It returns
+// gorm.ErrRecordNotFound when a group does not exist.
+func (h *Handler) setApprovalGroups(siteID uint, names []string) error {
+	var groups []models.Group
+	if len(names) > 0 {
+		if err := h.db.Where("name IN ?", names).Find(&groups).Error; err != nil {
+			return err
+		}
+	}
+	if len(groups) != len(names) {
+		return gorm.ErrRecordNotFound
+	}
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("site_id = ?", siteID).Delete(&models.SiteApprovalGroup{}).Error; err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if err := tx.Create(&models.SiteApprovalGroup{SiteID: siteID, GroupID: group.ID}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// countsAsApprover reports whether an approval by the user counts towards
+// the required approvals of the site.
+func (h *Handler) countsAsApprover(userID uint, siteID uint) (bool, error) {
+	groupIDs, err := h.approvalGroupIDs(siteID)
+	if err != nil || len(groupIDs) == 0 {
+		return err == nil, err
+	}
+	var memberships int64
+	err = h.db.Model(&models.GroupMember{}).Where("user_id = ? AND group_id IN ?", userID, groupIDs).Count(&memberships).Error
+	return memberships > 0, err
+}
+
+// recordApproval adds the approver to a pending request and returns who has
+// approved it so far.
+func (h *Handler) recordApproval(userID uint, siteID uint, approverID uint) ([]string, error) {
+	approval := models.RequestApproval{UserID: userID, SiteID: siteID, ApproverID: approverID}
+	if err := h.db.Where(&approval).FirstOrCreate(&approval).Error; err != nil {
+		return nil, err
+	}
+	return h.requestApprovals(userID, siteID)
+}
+
+// requestApprovals lists the emails of the approvers of a request in the
+// order they approved.
+func (h *Handler) requestApprovals(userID uint, siteID uint) ([]string, error) {
+	approvals := []string{}
+	err := h.db.Model(&models.RequestApproval{}).
+		Joins("JOIN users ON users.id = request_approvals.approver_id").
+		Where("request_approvals.user_id = ? AND request_approvals.site_id = ?", userID, siteID).
+		Order("request_approvals.created_at").
+		Pluck("users.email", &approvals).Error
+	return approvals, err
+}
+
+// clearApprovals forgets the partial approvals of a request and the
+// approvers a rule routed it to once it has been decided, withdrawn or
+// asked for again.
+func (h *Handler) clearApprovals(userID uint, siteID uint) error {
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND site_id = ?", userID, siteID).Delete(&models.RequestApproval{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ? AND site_id = ?", userID, siteID).Delete(&models.RequestApprover{}).Error
+	})
+}
+
+// attachApprovals fills in the approvers of every listed request.
+func (h *Handler) attachApprovals(results []models.UserSiteResponse) error {
+	type approvalRow struct {
+		User     string
+		Site     string
+		Approver string
+	}
+	var rows []approvalRow
+	err := h.db.Table("request_approvals").
+		Select("requesters.email as user, sites.url as site, approvers.email as approver").
+		Joins("JOIN users requesters ON requesters.id = request_approvals.user_id").
+		Joins("JOIN users approvers ON approvers.id = request_approvals.approver_id").
+		Joins("JOIN sites ON sites.id = request_approvals.site_id").
+		Order("request_approvals.created_at").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	approvals := map[[2]string][]string{}
+	for _, row := range rows {
+		key := [2]string{row.User, row.Site}
+		approvals[key] = append(approvals[key], row.Approver)
+	}
+	for i := range results {
+		results[i].Approvals = approvals[[2]string{results[i].User, results[i].Site}]
+		if results[i].Approvals == nil {
+			results[i].Approvals = []string{}
+		}
+	}
+	return nil
+}
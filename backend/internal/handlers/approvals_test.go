@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiPartyApproval(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	users := map[string]*models.User{}
+	for _, email := range []string{"alice@example.com", "carol@example.com", "dave@example.com", "erin@example.com"} {
+		user := &models.User{Email: email, Role: models.RoleApprover}
+		require.NoError(t, db.Create(user).Error)
+		users[email] = user
+	}
+	site := models.Site{URL: "https://vault.example.com", RequiredApprovals: 2}
+	require.NoError(t, db.Create(&site).Error)
+	security := models.Group{Name: "security"}
+	require.NoError(t, db.Create(&security).Error)
+	require.NoError(t, db.Create(&models.SiteApprovalGroup{SiteID: site.ID, GroupID: security.ID}).Error)
+	for _, email := range []string{"alice@example.com", "carol@example.com", "dave@example.com"} {
+		require.NoError(t, db.Create(&models.GroupMember{GroupID: security.ID, UserID: users[email].ID, Source: models.GroupSourceManual}).Error)
+	}
+	require.NoError(t, db.Create(&models.UserSite{UserID: users["alice@example.com"].ID, SiteID: site.ID, State: models.Requested}).Error)
+
+	approve := func(approver string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.HandleUpdateSiteState(rr, requestAs(approver, http.MethodPost, "/api/requests/update",
+			`{"userEmail": "alice@example.com", "siteURL": "https://vault.example.com", "newState": "authorized"}`))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusForbidden, approve("alice@example.com").Code, "requesters cannot approve themselves")
+	assert.Equal(t, http.StatusForbidden, approve("erin@example.com").Code, "approvals from outside the approval groups do not count")
+
+	events := h.events.subscribe()
+	defer h.events.unsubscribe(events)
+	rr := approve("carol@example.com")
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	var progress approvalProgress
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&progress))
+	assert.Equal(t, approvalProgress{State: models.PendingSecondApproval, Approvals: []string{"carol@example.com"}, RequiredApprovals: 2}, progress)
+
+	// Approving twice does not count twice.
+	assert.Equal(t, http.StatusAccepted, approve("carol@example.com").Code)
+	// Each approval is published like any other change to the request.
+	for i := 0; i < 2; i++ {
+		entry := <-events
+		assert.Equal(t, models.PendingSecondApproval, entry.ToState)
+		assert.Equal(t, "carol@example.com", entry.Actor)
+	}
+	decision, err := h.authorize(nil, "alice@example.com", site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessDenied, decision)
+
+	rr = httptest.NewRecorder()
+	h.HandleRequests(rr, requestAs("dave@example.com", http.MethodGet, "/api/requests", ""))
+	var results []models.UserSiteResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&results))
+	require.Len(t, results, 1)
+	assert.Equal(t, []string{"carol@example.com"}, results[0].Approvals)
+	assert.Equal(t, 2, results[0].RequiredApprovals)
+
+	assert.Equal(t, http.StatusOK, approve("dave@example.com").Code)
+	decision, err = h.authorize(nil, "alice@example.com", site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessGranted, decision)
+}
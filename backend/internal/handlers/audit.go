@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/audit"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Methods by which a forward-auth or login caller was identified.
+const (
+	authMethodSession        = "session"
+	authMethodPassword       = "password"
+	authMethodBasic          = "basic"
+	authMethodServiceAccount = "service_account"
+	authMethodClientCert     = "client_cert"
+	authMethodHeader         = "header"
+	authMethodMagicLink      = "magic_link"
+	authMethodLoginCode      = "login_code"
+)
+
+// auditBundleLimit is the most events a bundle holds. Bundles are signed as
+// a whole, so they are built in memory.
+const auditBundleLimit = 10000
+
+// auditWriter remembers the status of a response along with what the
+// handlers learned about the caller, so a single audit event can be written
+// once the response is decided.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	event  models.AuthEvent
+	// allowed marks a success answered with something other than 200.
+	allowed bool
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditIdentity notes who the caller is and how they were identified.
+func auditIdentity(w http.ResponseWriter, user string, method string) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.event.User = user
+		aw.event.Method = method
+	}
+}
+
+// auditReason notes why the request was allowed or denied.
+func auditReason(w http.ResponseWriter, reason string) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.event.Reason = reason
+	}
+}
+
+// auditAllowed notes that the request succeeded, for handlers that answer a
+// success with a redirect.
+func auditAllowed(w http.ResponseWriter) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.allowed = true
+	}
+}
+
+// finishAuditEvent derives the outcome from the response status and hands
+// the event to the audit sink. Handlers that write nothing answer 200.
+func (h *Handler) finishAuditEvent(r *http.Request, w *auditWriter, action string) {
+	switch {
+	case w.allowed || w.status == http.StatusOK || w.status == 0:
+		w.event.Outcome = models.AuthOutcomeAllow
+	case w.status >= http.StatusInternalServerError:
+		w.event.Outcome = models.AuthOutcomeError
+	default:
+		w.event.Outcome = models.AuthOutcomeDeny
+	}
+	w.event.Action = action
+	h.recordAuthEvent(r, &w.event)
+}
+
+// recordAuthEvent fills in the client details and writes the event. Audit
+// failures are logged but never fail the request.
+func (h *Handler) recordAuthEvent(r *http.Request, event *models.AuthEvent) {
+	if h.audit == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.ClientIP = h.clientIP(r)
+	event.UserAgent = r.UserAgent()
+	if err := h.audit.Write(r.Context(), event); err != nil {
+		slog.Error("Writing audit event failed", "action", event.Action, "error", err)
+	}
+}
+
+// auditQuery selects auth events matching ?action=, ?user=, ?site=,
+// ?outcome= and the RFC 3339 times ?since= and ?until=.
+func (h *Handler) auditQuery(r *http.Request) (*gorm.DB, bool) {
+	query := h.db.Model(&models.AuthEvent{})
+	for _, column := range []string{"action", "user", "site", "outcome"} {
+		if value := r.URL.Query().Get(column); value != "" {
+			query = query.Where(map[string]interface{}{column: value})
+		}
+	}
+	if value := r.URL.Query().Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, false
+		}
+		query = query.Where("time >= ?", since)
+	}
+	if value := r.URL.Query().Get("until"); value != "" {
+		until, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, false
+		}
+		query = query.Where("time < ?", until)
+	}
+	return query, true
+}
+
+// HandleAuditEvents lists auth events newest first, 100 at a time
+// (GET [?action=][&user=][&site=][&outcome=][&since=][&until=][&before=][&limit=]).
+// Requires the audit:view permission.
+func (h *Handler) HandleAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	query, ok := h.auditQuery(r)
+	if ok {
+		query, ok = paginate(r, query, "id")
+	}
+	if !ok {
+		sendJSONError(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	events := []models.AuthEvent{}
+	if err := query.Find(&events).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, events, http.StatusOK)
+}
+
+// HandleAuditExport streams every matching auth event, oldest first, as JSON
+// lines or, with ?format=csv, as CSV. It takes the filters of HandleAuditEvents and reads
+// the events row by row, so exports of any size run in constant memory.
+// Requires the audit:view permission.
+func (h *Handler) HandleAuditExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	query, ok := h.auditQuery(r)
+	if !ok || (format != "jsonl" && format != "csv") {
+		sendJSONError(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	rows, err := query.Order("id").Rows()
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var write func(event *models.AuthEvent) error
+	var flush func()
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"id", "time", "action", "user", "site", "outcome", "reason", "method", "client_ip", "user_agent"})
+		write = func(event *models.AuthEvent) error {
+			return writer.Write([]string{strconv.FormatUint(uint64(event.ID), 10), event.Time.UTC().Format(time.RFC3339Nano),
+				event.Action, event.User, event.Site, event.Outcome, event.Reason, event.Method, event.ClientIP, event.UserAgent})
+		}
+		flush = writer.Flush
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		write = func(event *models.AuthEvent) error { return encoder.Encode(event) }
+		flush = func() {}
+	}
+	flusher, _ := w.(http.Flusher)
+	for count := 1; rows.Next(); count++ {
+		var event models.AuthEvent
+		if err := h.db.ScanRows(rows, &event); err != nil {
+			log.Printf("Database error: %v", err)
+			return
+		}
+		if err := write(&event); err != nil {
+			slog.Info("Audit export aborted", "error", err)
+			return
+		}
+		if count%500 == 0 {
+			flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	flush()
+}
+
+// SealAudit signs the head of the audit chain if events were added since the
+// last seal. It reports whether a seal was written.
+func (h *Handler) SealAudit(now time.Time) (bool, error) {
+	if h.auditKey == nil {
+		return false, nil
+	}
+	var events []models.AuthEvent
+	if err := h.db.Where("hash <> ''").Order("id DESC").Limit(1).Find(&events).Error; err != nil || len(events) == 0 {
+		return false, err
+	}
+	var sealed []uint
+	if err := h.db.Model(&models.AuditSeal{}).Order("event_id DESC").Limit(1).Pluck("event_id", &sealed).Error; err != nil {
+		return false, err
+	}
+	if len(sealed) > 0 && sealed[0] >= events[0].ID {
+		return false, nil
+	}
+	return true, h.db.Create(audit.NewSeal(h.auditKey, &events[0], now)).Error
+}
+
+// RunAuditSealer calls SealAudit every interval until ctx is done.
+func (h *Handler) RunAuditSealer(ctx context.Context, interval time.Duration) {
+	if h.auditKey == nil {
+		slog.Warn("AUDIT_SIGNING_KEY is not set, the audit log is not sealed")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := h.SealAudit(now); err != nil {
+				slog.Error("Sealing the audit log failed", "error", err)
+			}
+		}
+	}
+}
+
+// auditPublicKey returns the key seals are verified with, nil if unsigned.
+func (h *Handler) auditPublicKey() ed25519.PublicKey {
+	if h.auditKey == nil {
+		return nil
+	}
+	return h.auditKey.Public().(ed25519.PublicKey)
+}
+
+// HandleAuditVerify checks the whole audit chain and its seals (GET).
+// Requires the audit:view permission.
+func (h *Handler) HandleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	report, err := audit.VerifyDB(h.db, h.auditPublicKey())
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, report, http.StatusOK)
+}
+
+// HandleAuditBundle exports the events between the RFC 3339 times ?since=
+// and ?until= with the seals over them as a signed bundle that
+// kubevoyage-audit verifies offline. Ranges of more than auditBundleLimit
+// events are refused. Requires the audit:view permission.
+func (h *Handler) HandleAuditBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	if h.auditKey == nil {
+		sendJSONError(w, "Audit signing is not configured", http.StatusNotFound)
+		return
+	}
+	query := h.db.Model(&models.AuthEvent{})
+	for param, condition := range map[string]string{"since": "time >= ?", "until": "time < ?"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				sendJSONError(w, "Invalid query", http.StatusBadRequest)
+				return
+			}
+			query = query.Where(condition, at)
+		}
+	}
+	events := []models.AuthEvent{}
+	seals := []models.AuditSeal{}
+	err := query.Order("id").Limit(auditBundleLimit + 1).Find(&events).Error
+	if err == nil && len(events) > auditBundleLimit {
+		sendJSONError(w, fmt.Sprintf("More than %d events, narrow since and until", auditBundleLimit), http.StatusBadRequest)
+		return
+	}
+	if err == nil && len(events) > 0 {
+		err = h.db.Where("event_id BETWEEN ? AND ?", events[0].ID, events[len(events)-1].ID).Order("event_id").Find(&seals).Error
+	}
+	var bundle *audit.Bundle
+	if err == nil {
+		bundle, err = audit.NewBundle(h.auditKey, events, seals, time.Now())
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-bundle.json"`)
+	sendJSONResponse(w, bundle, http.StatusOK)
+}
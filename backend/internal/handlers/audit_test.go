@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/audit"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticateAuditEvents(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	chain, err := audit.NewDBChain(db, nil)
+	require.NoError(t, err)
+	h.audit = chain
+
+	auditor := models.User{Email: "auditor@example.com", Role: models.RoleAuditor}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	require.NoError(t, db.Create(&auditor).Error)
+	require.NoError(t, db.Create(&alice).Error)
+	site := models.Site{URL: "https://wiki.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.UserSite{UserID: alice.ID, SiteID: site.ID, State: models.Authorized}).Error)
+
+	authenticate := func(email string, target string) {
+		req := requestAs(email, http.MethodGet, "/api/authenticate?redirect="+target, "")
+		req.Header.Set("X-Forwarded-For", "198.51.100.7, 192.0.2.10")
+		req.Header.Set("User-Agent", "curl/8.0")
+		h.HandleAuthenticate(httptest.NewRecorder(), req)
+	}
+	authenticate(alice.Email, site.URL)
+	authenticate(alice.Email, "https://grafana.example.com")
+	authenticate("", site.URL)
+
+	rr := httptest.NewRecorder()
+	h.HandleAuditEvents(rr, requestAs(alice.Email, http.MethodGet, "/api/audit/events", ""))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.HandleAuditEvents(rr, requestAs(auditor.Email, http.MethodGet, "/api/audit/events?user=alice@example.com", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var events []models.AuthEvent
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&events))
+	require.Len(t, events, 2)
+	assert.Equal(t, "https://grafana.example.com", events[0].Site)
+	assert.Equal(t, models.AuthOutcomeDeny, events[0].Outcome)
+	assert.Equal(t, "not_requested", events[0].Reason)
+	granted := events[1]
+	assert.Equal(t, models.AuthActionAuthenticate, granted.Action)
+	assert.Equal(t, models.AuthOutcomeAllow, granted.Outcome)
+	assert.Equal(t, "granted", granted.Reason)
+	assert.Equal(t, authMethodHeader, granted.Method)
+	assert.Equal(t, "198.51.100.7", granted.ClientIP)
+	assert.Equal(t, "curl/8.0", granted.UserAgent)
+
+	rr = httptest.NewRecorder()
+	h.HandleAuditEvents(rr, requestAs(auditor.Email, http.MethodGet, "/api/audit/events?outcome=deny&site=https://wiki.example.com", ""))
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&events))
+	require.Len(t, events, 1)
+	assert.Equal(t, "unauthenticated", events[0].Reason)
+
+	rr = httptest.NewRecorder()
+	h.HandleAuditEvents(rr, requestAs(auditor.Email, http.MethodGet, "/api/audit/events?since=yesterday", ""))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.HandleAuditExport(rr, requestAs(auditor.Email, http.MethodGet, "/api/audit/export", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	scanner := bufio.NewScanner(rr.Body)
+	var lines []models.AuthEvent
+	for scanner.Scan() {
+		var event models.AuthEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		lines = append(lines, event)
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "granted", lines[0].Reason, "exports run oldest first")
+
+	rr = httptest.NewRecorder()
+	h.HandleAuditExport(rr, requestAs(auditor.Email, http.MethodGet, "/api/audit/export?format=csv&outcome=allow", ""))
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "alice@example.com", records[1][3])
+}
+
+func TestAuditSealAndVerify(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	chain, err := audit.NewDBChain(db, nil)
+	require.NoError(t, err)
+	h.audit = chain
+	h.auditKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	auditor := models.User{Email: "auditor@example.com", Role: models.RoleAuditor}
+	require.NoError(t, db.Create(&auditor).Error)
+
+	for i := 0; i < 3; i++ {
+		h.HandleAuthenticate(httptest.NewRecorder(), requestAs("", http.MethodGet, "/api/authenticate?redirect=https://wiki.example.com", ""))
+	}
+	sealed, err := h.SealAudit(time.Now())
+	require.NoError(t, err)
+	assert.True(t, sealed)
+	sealed, err = h.SealAudit(time.Now())
+	require.NoError(t, err)
+	assert.False(t, sealed, "nothing new to seal")
+
+	verify := func() audit.Report {
+		rr := httptest.NewRecorder()
+		h.HandleAuditVerify(rr, requestAs(auditor.Email, http.MethodGet, "/api/audit/verify", ""))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var report audit.Report
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+		return report
+	}
+	report := verify()
+	assert.True(t, report.Valid)
+	assert.Equal(t, 3, report.Events)
+	assert.Equal(t, 1, report.Seals)
+
+	rr := httptest.NewRecorder()
+	h.HandleAuditBundle(rr, requestAs(auditor.Email, http.MethodGet, "/api/audit/bundle", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var bundle audit.Bundle
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&bundle))
+	bundleReport, err := bundle.Verify(h.auditPublicKey())
+	require.NoError(t, err)
+	assert.True(t, bundleReport.Valid)
+	assert.Len(t, bundle.Events, 3)
+
+	require.NoError(t, db.Delete(&models.AuthEvent{}, 3).Error)
+	report = verify()
+	assert.False(t, report.Valid)
+	require.Len(t, report.Problems, 2)
+	assert.Equal(t, audit.ProblemSealedGone, report.Problems[0].Kind)
+	assert.Equal(t, audit.ProblemTruncated, report.Problems[1].Kind)
+}
@@ -1,13 +1,16 @@
 package handlers
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/audit"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"github.com/B-Urb/KubeVoyage/internal/mail"
 	"github.com/B-Urb/KubeVoyage/internal/models"
 	"github.com/B-Urb/KubeVoyage/internal/util"
 	"github.com/golang-jwt/jwt/v5"
@@ -18,6 +21,7 @@ import (
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,6 +29,22 @@ type Handler struct {
 	db      *gorm.DB
 	JWTKey  []byte
 	BaseURL string
+
+	serviceAccounts auth.TokenValidator
+	clientCerts     *auth.ClientCertVerifier
+	trustedProxies  auth.TrustedProxies
+	upstream        *auth.HeaderAuthenticator
+	mailer          mail.Mailer
+	expiryReminder  time.Duration
+	audit           audit.Sink
+	auditKey        ed25519.PrivateKey
+	chatSecret      []byte
+	chatToken       []byte
+	events          *eventHub
+	// siteUses holds when each "email\nsite" use was last recorded.
+	siteUses sync.Map
+	// claimSyncs holds the claimSync last done for each user id.
+	claimSyncs sync.Map
 }
 
 type TokenInfo struct {
@@ -46,7 +66,63 @@ func NewHandler(db *gorm.DB) *Handler {
 	if err != nil {
 		log.Fatalf("Error reading BASE_URL: %v", err)
 	}
-	return &Handler{db: db, JWTKey: []byte(jwtKey), BaseURL: baseURL}
+	serviceAccounts, err := newServiceAccountValidator()
+	if err != nil {
+		log.Fatalf("Error configuring service account authentication: %v", err)
+	}
+	clientCerts, err := newClientCertVerifier()
+	if err != nil {
+		log.Fatalf("Error configuring client certificate authentication: %v", err)
+	}
+	trustedProxies, err := auth.ParseTrustedProxies(util.GetEnvList("TRUSTED_PROXY_CIDRS"))
+	if err != nil {
+		log.Fatalf("Error reading TRUSTED_PROXY_CIDRS: %v", err)
+	}
+	upstream, err := newHeaderAuthenticator(trustedProxies)
+	if err != nil {
+		log.Fatalf("Error configuring header authentication: %v", err)
+	}
+	mailer, err := mail.NewMailerFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring mail delivery: %v", err)
+	}
+	reminder, _ := util.GetEnvOrDefault("EXPIRY_REMINDER_BEFORE", "72h")
+	expiryReminder, err := time.ParseDuration(reminder)
+	if err != nil {
+		log.Fatalf("Error reading EXPIRY_REMINDER_BEFORE: %v", err)
+	}
+	auditSink, err := audit.NewSinkFromEnv(db)
+	if err != nil {
+		log.Fatalf("Error configuring the audit log: %v", err)
+	}
+	auditKey, err := audit.SigningKeyFromEnv()
+	if err != nil {
+		log.Fatalf("Error reading the audit signing key: %v", err)
+	}
+	var chatSecret []byte
+	if value, _ := util.GetEnvOrDefault("CHAT_SIGNING_SECRET", ""); value != "" {
+		chatSecret = []byte(value)
+	}
+	var chatToken []byte
+	if value, _ := util.GetEnvOrDefault("CHAT_MATTERMOST_TOKEN", ""); value != "" {
+		chatToken = []byte(value)
+	}
+	return &Handler{
+		db:              db,
+		JWTKey:          []byte(jwtKey),
+		BaseURL:         baseURL,
+		serviceAccounts: serviceAccounts,
+		clientCerts:     clientCerts,
+		trustedProxies:  trustedProxies,
+		upstream:        upstream,
+		mailer:          mailer,
+		expiryReminder:  expiryReminder,
+		audit:           auditSink,
+		auditKey:        auditKey,
+		chatSecret:      chatSecret,
+		chatToken:       chatToken,
+		events:          newEventHub(),
+	}
 }
 
 type LoginResponse struct {
@@ -60,37 +136,73 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	var inputUser models.User
 	var dbUser models.User
 
+	aw := &auditWriter{ResponseWriter: w}
+	defer h.finishAuditEvent(r, aw, models.AuthActionLogin)
+	w = aw
+
+	if h.upstream != nil {
+		auditReason(w, "upstream_login")
+		sendJSONError(w, "Login is handled by the upstream gateway", http.StatusNotFound)
+		return
+	}
+
 	// Parse the request body
 	err := json.NewDecoder(r.Body).Decode(&inputUser)
 	if err != nil {
+		auditReason(w, "invalid_request")
 		sendJSONError(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	auditIdentity(w, inputUser.Email, authMethodPassword)
 
 	// Fetch the user from the database
 	result := h.db.Where("email = ?", inputUser.Email).First(&dbUser)
 	if result.Error != nil {
+		auditReason(w, "user_not_found")
 		sendJSONError(w, "User not found", http.StatusNotFound)
 		return
 	}
 
 	// Compare the password hash
-	storedHash, err := base64.StdEncoding.DecodeString(dbUser.Password)
+	if !verifyPassword(dbUser.Password, inputUser.Password) {
+		auditReason(w, "invalid_credentials")
+		sendJSONError(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	siteURL, siteUrlErr := h.getRedirectUrl(r)
+	aw.event.Site = siteURL
+	if siteUrlErr != nil {
+		log.Println("Site URl could not be determined: " + siteURL)
+	}
+	oneTimeToken := r.URL.Query().Get("token")
+	redirect, err := h.startSession(w, r, inputUser.Email, siteURL, oneTimeToken)
 	if err != nil {
-		sendJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+		h.logError(w, "Internal Server Error", err, http.StatusInternalServerError)
 		return
 	}
-	inputHash, err := scrypt.Key([]byte(inputUser.Password), nil, 16384, 8, 1, 32)
-	if err != nil || !bytes.Equal(storedHash, inputHash) {
-		sendJSONError(w, "Invalid credentials", http.StatusUnauthorized)
+
+	auditReason(w, "login_successful")
+	response := LoginResponse{
+		Success:  true,
+		Message:  "Login successful",
+		Redirect: redirect,
+	}
+	if oneTimeToken == "" {
 		return
 	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
 
+// startSession logs email in on this browser and hands the login back to
+// the forward-auth flow that sent the user here: siteURL is remembered for
+// /api/redirect and the one-time token from /api/authenticate is marked as
+// authenticated. It reports whether the user should be sent on to the site.
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, email string, siteURL string, oneTimeToken string) (bool, error) {
 	session, _ := store.Get(r, "session-cook")
 	tld, err := extractMainDomain(r.Host)
 	if err != nil {
-		sendJSONError(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return false, err
 	}
 	session.Options = &sessions.Options{
 		Path:     "/",                   // Available across the entire domain
@@ -101,53 +213,31 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		Domain:   tld,
 	}
 	session.Values["authenticated"] = true
-	session.Values["user"] = inputUser.Email
+	session.Values["user"] = email
 	if err := session.Save(r, w); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return false, err
 	}
 
-	var domain string
-	siteURL, siteUrlErr := h.getRedirectUrl(r)
-	if siteUrlErr != nil {
-		// If there was an error getting the redirect URL, use the request's host as the domain
-		log.Println("Site URl could not be determined: " + siteURL)
-		domain = r.Host
-	} else {
-		// If the redirect URL was obtained successfully, extract the main domain
-		err := h.setRedirectCookie(siteURL, r, w)
-		if err != nil {
+	redirect := siteURL != "" && siteURL != "null"
+	if redirect {
+		if err := h.setRedirectCookie(siteURL, r, w); err != nil {
 			slog.Error("Failed to set redirect cookie", "error", err)
 		}
-
-		domain, err = extractMainDomain(r.Host)
-		if err != nil {
-			sendJSONError(w, "Invalid Redirect URL", http.StatusBadRequest)
-			return
-		}
-	}
-	if err != nil {
-		slog.Error("could not extract Main Domain", "error", err)
-		return
-	}
-	slog.Info("Domain: ", "value", domain)
-
-	response := LoginResponse{
-		Success:  true,
-		Message:  "Login successful",
-		Redirect: siteURL != "" && siteUrlErr == nil,
 	}
-	oneTimeToken := r.URL.Query().Get("token")
-	if oneTimeToken == "" {
-		return
+	if oneTimeToken != "" {
+		oneTimeStore[oneTimeToken] = TokenInfo{true, email}
 	}
-	oneTimeStore[oneTimeToken] = TokenInfo{true, inputUser.Email}
-	sendJSONResponse(w, response, http.StatusOK)
+	return redirect, nil
 }
 
 func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	var user models.User
 
+	if h.upstream != nil {
+		sendJSONError(w, "Registration is handled by the upstream gateway", http.StatusNotFound)
+		return
+	}
+
 	// Parse the request body
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
@@ -155,6 +245,13 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Those names are reserved for the workloads that authenticate with
+	// ServiceAccount tokens.
+	if strings.HasPrefix(user.Email, auth.ServiceAccountPrefix) {
+		sendJSONError(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+
 	// Hash the password using scrypt
 	salt := make([]byte, 8)
 	_, err = rand.Read(salt)
@@ -169,6 +266,11 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user.Password = base64.StdEncoding.EncodeToString(hash)
+	// Roles are only handed out through the users API.
+	user.ID = 0
+	user.Role = models.RoleUser
+	user.Kind = models.KindUser
+	user.EmailVerified = false
 	var existingUser models.User
 	if err := h.db.Where("email = ?", user.Email).First(&existingUser).Error; err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -201,6 +303,10 @@ func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 
 }
 func (h *Handler) HandleAuthenticate(w http.ResponseWriter, r *http.Request) {
+	aw := &auditWriter{ResponseWriter: w}
+	defer h.finishAuditEvent(r, aw, models.AuthActionAuthenticate)
+	w = aw
+
 	// 1. Extract the user's email from the session or JWT token.
 	siteURL, err := h.getRedirectUrl(r)
 	if err != nil {
@@ -212,6 +318,50 @@ func (h *Handler) HandleAuthenticate(w http.ResponseWriter, r *http.Request) {
 			slog.Error("Error retrieving redirect url", "error", err)
 		}
 	}
+	aw.event.Site = siteURL
+	site, err := h.findSite(siteURL)
+	if err != nil {
+		h.logError(w, "Database error while fetching site", err, http.StatusInternalServerError)
+		return
+	}
+	// Basic credentials are only honoured for sites that opted in, otherwise
+	// the header may belong to the protected application itself.
+	if email, secret, hasBasic := r.BasicAuth(); hasBasic && site != nil && site.AllowBasicAuth {
+		h.handleBasicAuth(w, r, siteURL, email, secret)
+		return
+	}
+	if token, hasBearer := bearerToken(r); hasBearer && h.serviceAccounts != nil {
+		if h.handleServiceAccountAuth(w, r, siteURL, token) {
+			return
+		}
+	}
+	certUser, err := h.clientCertificateUser(r)
+	if err != nil {
+		h.logError(w, "Database error while fetching certificate user", err, http.StatusInternalServerError)
+		return
+	}
+	if certUser != "" {
+		auditIdentity(w, certUser, authMethodClientCert)
+		h.respondAuthorization(w, r, certUser, siteURL)
+		return
+	}
+	if h.upstream != nil {
+		headerUser, err := h.headerUser(r)
+		if err != nil {
+			h.logError(w, "Database error while fetching upstream user", err, http.StatusInternalServerError)
+			return
+		}
+		if headerUser == "" {
+			// Without a trusted identity there is no login page to send the
+			// client to; the gateway in front is expected to handle it.
+			auditReason(w, "unauthenticated")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		auditIdentity(w, headerUser, authMethodHeader)
+		h.respondAuthorization(w, r, headerUser, siteURL)
+		return
+	}
 	tld, err := extractMainDomain(siteURL)
 	session, err := store.Get(r, "session-cook")
 	// Check if "authenticated" is set and true in the session
@@ -221,6 +371,10 @@ func (h *Handler) HandleAuthenticate(w http.ResponseWriter, r *http.Request) {
 	tokenUser := oneTimeStore[token].user
 
 	if !ok || (!auth && !tokenAuthenticated) {
+		if !isBrowserRequest(r) {
+			h.handleUnauthenticatedClient(w, site)
+			return
+		}
 		session.Options = &sessions.Options{
 			Path:     "/",                   // Available across the entire domain
 			MaxAge:   3600,                  // Expires after 1 hour
@@ -243,6 +397,7 @@ func (h *Handler) HandleAuthenticate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		auditReason(w, "login_required")
 		// If the user cannot be read from the cookie, redirect to /login with the site URL as a parameter
 		err = h.setRedirectCookie(siteURL, r, w) //Fixme: improve domain handling
 		if err != nil {
@@ -267,47 +422,50 @@ func (h *Handler) HandleAuthenticate(w http.ResponseWriter, r *http.Request) {
 	}
 	if sessionUser == "" {
 		h.logError(w, "error while fetching user details from session", err, http.StatusInternalServerError)
-	}
-
-	// Check if the user has the role "admin"
-	var user models.User
-	err = h.db.Where("email = ?", sessionUser).First(&user).Error
-	if err != nil {
-		h.logError(w, "Database error while fetching user details", err, http.StatusInternalServerError)
-		return
-	}
-	if user.Role == "admin" {
-		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	// 3. Query the database to check if the user has an "authorized" state for the given site.
-	var userSite models.UserSite
-	err = h.db.Joins("JOIN users ON users.id = user_sites.user_id").
-		Joins("JOIN sites ON sites.id = user_sites.site_id").
-		Where("users.email = ? AND sites.url = ?", sessionUser, siteURL).
-		First(&userSite).Error
+	auditIdentity(w, sessionUser, authMethodSession)
+	h.respondAuthorization(w, r, sessionUser, siteURL)
+}
 
+// respondAuthorization answers the forward-auth request for an authenticated
+// user. Browsers without a request for the site are sent to the request page.
+func (h *Handler) respondAuthorization(w http.ResponseWriter, r *http.Request, email string, siteURL string) {
+	decision, err := h.authorize(r, email, siteURL)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			// Return 401 if the user is not authorized for the requested siteURL
-			http.Redirect(w, r, "/request?redirect="+siteURL, http.StatusSeeOther)
-			return
-		}
 		h.logError(w, "Database error while checking user authorization", err, http.StatusInternalServerError)
 		return
 	}
-	if userSite.State == models.Requested || userSite.State == models.Declined {
+	auditReason(w, decision.String())
+	switch decision {
+	case accessGranted:
+		w.WriteHeader(http.StatusOK)
+		h.recordSiteUse(email, siteURL, time.Now())
+	case accessNotRequested:
+		if !isBrowserRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.Redirect(w, r, "/request?redirect="+siteURL, http.StatusSeeOther)
+	default:
 		w.WriteHeader(http.StatusUnauthorized)
 	}
-	w.WriteHeader(http.StatusOK)
 }
 func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	aw := &auditWriter{ResponseWriter: w}
+	defer h.finishAuditEvent(r, aw, models.AuthActionLogout)
+	w = aw
+
 	session, err := store.Get(r, "session-cook")
 	if err != nil {
+		auditReason(w, "invalid_session")
 		sendJSONError(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if user, ok := session.Values["user"].(string); ok {
+		auditIdentity(w, user, authMethodSession)
+	}
 
 	// Clear session values
 	session.Values["authenticated"] = false
@@ -324,6 +482,7 @@ func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	auditReason(w, "logout_successful")
 	response := map[string]interface{}{
 		"success": true,
 		"message": "Logout successful",
@@ -332,20 +491,31 @@ func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) HandleValidateSession(w http.ResponseWriter, r *http.Request) {
-	session, err := store.Get(r, "session-cook")
-	if err != nil {
-		sendJSONError(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
+	var user string
+	if h.upstream != nil {
+		// The upstream gateway owns the session in header mode.
+		headerUser, err := h.getRequestUser(r)
+		if err != nil {
+			sendJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		user = headerUser
+	} else {
+		session, err := store.Get(r, "session-cook")
+		if err != nil {
+			sendJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
 
-	authenticated, ok := session.Values["authenticated"].(bool)
-	if !ok || !authenticated {
-		sendJSONError(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+		authenticated, ok := session.Values["authenticated"].(bool)
+		if !ok || !authenticated {
+			sendJSONError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 
-	user, ok := session.Values["user"].(string)
-	if !ok || user == "" {
+		user, _ = session.Values["user"].(string)
+	}
+	if user == "" {
 		sendJSONError(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -372,9 +542,27 @@ func (h *Handler) logError(w http.ResponseWriter, message string, err error, sta
 		logMessage = fmt.Sprintf("%s: %v", message, err)
 	}
 	log.Println(logMessage)
+	auditReason(w, message)
 	http.Error(w, message, statusCode)
 }
 
+// getRequestUser returns the caller of an API request, identified by a
+// verified client certificate, the trusted upstream header in header mode, or
+// else the login session.
+func (h *Handler) getRequestUser(r *http.Request) (string, error) {
+	certUser, err := h.clientCertificateUser(r)
+	if err != nil {
+		return "", err
+	}
+	if certUser != "" {
+		return certUser, nil
+	}
+	if h.upstream != nil {
+		return h.headerUser(r)
+	}
+	return h.getUserFromSession(r)
+}
+
 func (h *Handler) getUserFromSession(r *http.Request) (string, error) {
 	session, err := store.Get(r, "session-cook")
 	if err != nil {
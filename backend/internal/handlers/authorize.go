@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/policy"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// accessDecision is the outcome of checking a known user against a site.
+type accessDecision int
+
+const (
+	accessGranted accessDecision = iota
+	// accessNotRequested means the user has never asked for the site.
+	accessNotRequested
+	// accessDenied means a request exists but is not authorized, or its
+	// grant has expired.
+	accessDenied
+)
+
+func (d accessDecision) String() string {
+	switch d {
+	case accessGranted:
+		return "granted"
+	case accessNotRequested:
+		return "not_requested"
+	default:
+		return "denied"
+	}
+}
+
+// authorize decides whether the user identified by email may reach siteURL.
+// It is shared by every way of authenticating against the forward-auth
+// endpoint, so session, Basic and token callers get the same answer. r is
+// the forwarded request that site policies are evaluated against; it may be
+// nil outside of forward auth.
+func (h *Handler) authorize(r *http.Request, email string, siteURL string) (accessDecision, error) {
+	return h.decide(r, email, siteURL, nil)
+}
+
+// decide implements authorize and records each step in trace unless it is
+// nil.
+func (h *Handler) decide(r *http.Request, email string, siteURL string, trace *accessTrace) (accessDecision, error) {
+	var user models.User
+	if err := h.db.Where("email = ?", email).First(&user).Error; err != nil {
+		return trace.decide(accessDenied), err
+	}
+	trace.user(&user)
+
+	site, err := h.findSite(siteURL)
+	if err != nil {
+		return trace.decide(accessDenied), err
+	}
+	trace.site(site)
+	var policies []models.SitePolicy
+	if site != nil {
+		if err := h.db.Where("site_id = ?", site.ID).Order("name").Find(&policies).Error; err != nil {
+			return trace.decide(accessDenied), err
+		}
+	}
+	var input *policy.Input
+	if len(policies) > 0 {
+		if input, err = h.policyInput(r, &user); err != nil {
+			return trace.decide(accessDenied), err
+		}
+		trace.input(input)
+	}
+
+	var userSite models.UserSite
+	requested := false
+	if site != nil {
+		err = h.db.Where(&models.UserSite{UserID: user.ID, SiteID: site.ID}).First(&userSite).Error
+		if err == nil {
+			requested = true
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return trace.decide(accessDenied), err
+		}
+	}
+	now := time.Now()
+	if requested {
+		trace.grant(userSite, now)
+	}
+
+	// Deny policies win over every kind of grant, the role bypass included.
+	for _, sitePolicy := range policies {
+		if sitePolicy.Effect == models.PolicyDeny && trace.policy(sitePolicy, input, true) {
+			return trace.decide(accessDenied), nil
+		}
+	}
+	if user.Role.Can(models.PermAccessAllSites) {
+		trace.roleBypass()
+		return trace.decide(accessGranted), nil
+	}
+	if requested && userSite.Active(now) {
+		return trace.decide(accessGranted), nil
+	}
+
+	// Access is the union of direct and group grants and allow policies.
+	var groupIDs []uint
+	if site != nil {
+		err = h.db.Model(&models.GroupSite{}).
+			Joins("JOIN group_members ON group_members.group_id = group_sites.group_id").
+			Where("group_members.user_id = ? AND group_sites.site_id = ?", user.ID, site.ID).
+			Pluck("group_sites.group_id", &groupIDs).Error
+		if err != nil {
+			return trace.decide(accessDenied), err
+		}
+	}
+	if len(groupIDs) > 0 {
+		if trace != nil {
+			h.db.Model(&models.Group{}).Where("id IN ?", groupIDs).Order("name").Pluck("name", &trace.GroupGrants)
+		}
+		return trace.decide(accessGranted), nil
+	}
+	for _, sitePolicy := range policies {
+		if sitePolicy.Effect == models.PolicyAllow && trace.policy(sitePolicy, input, false) {
+			return trace.decide(accessGranted), nil
+		}
+	}
+	if !requested {
+		return trace.decide(accessNotRequested), nil
+	}
+	return trace.decide(accessDenied), nil
+}
+
+// findSite looks up a site by its exact URL. It returns nil without an error
+// when the site is unknown.
+func (h *Handler) findSite(siteURL string) (*models.Site, error) {
+	var site models.Site
+	err := h.db.Where("url = ?", siteURL).First(&site).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
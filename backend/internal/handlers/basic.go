@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	appTokenPrefix = "kv_"
+	basicRealm     = `Basic realm="KubeVoyage", charset="UTF-8"`
+)
+
+// isBrowserRequest reports whether the original request came from a browser
+// that can follow the login redirect. Traefik copies the client headers onto
+// the forward-auth request, so the Accept header of the client is visible here.
+func isBrowserRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// handleBasicAuth answers a forward-auth request that carries HTTP Basic
+// credentials for a site that opted in to them. It never redirects.
+func (h *Handler) handleBasicAuth(w http.ResponseWriter, r *http.Request, siteURL string, email string, secret string) {
+	auditIdentity(w, email, authMethodBasic)
+	valid, err := h.checkBasicCredentials(email, secret)
+	if err != nil {
+		h.logError(w, "Database error while checking credentials", err, http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		auditReason(w, "invalid_credentials")
+		w.Header().Set("WWW-Authenticate", basicRealm)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	decision, err := h.authorize(r, email, siteURL)
+	if err != nil {
+		h.logError(w, "Database error while checking user authorization", err, http.StatusInternalServerError)
+		return
+	}
+	auditReason(w, decision.String())
+	if decision != accessGranted {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUnauthenticatedClient answers a client that has no session and cannot
+// follow a redirect to the login page.
+func (h *Handler) handleUnauthenticatedClient(w http.ResponseWriter, site *models.Site) {
+	if site != nil && site.AllowBasicAuth {
+		w.Header().Set("WWW-Authenticate", basicRealm)
+	}
+	auditReason(w, "unauthenticated")
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// checkBasicCredentials accepts either the account password or one of the
+// user's app tokens as the Basic password.
+func (h *Handler) checkBasicCredentials(email string, secret string) (bool, error) {
+	var user models.User
+	err := h.db.Where("email = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(secret, appTokenPrefix) {
+		var token models.AppToken
+		err := h.db.Where("user_id = ? AND token_hash = ?", user.ID, hashAppToken(secret)).First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := h.db.Model(&token).Update("last_used_at", time.Now()).Error; err != nil {
+			slog.Error("Failed to record app token usage", "error", err)
+		}
+		return true, nil
+	}
+
+	return verifyPassword(user.Password, secret), nil
+}
+
+func hashAppToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+const basicTestSite = "https://metrics.example.com"
+
+func setupBasicAuthTest(t *testing.T, allowBasic bool) (*Handler, *gorm.DB) {
+	db := setupTestDatabase()
+	password, err := hashTestPassword("secret")
+	require.NoError(t, err)
+	user := models.User{Email: "scraper@example.com", Password: password, Role: "user"}
+	require.NoError(t, db.Create(&user).Error)
+	site := models.Site{URL: basicTestSite, AllowBasicAuth: allowBasic}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.UserSite{UserID: user.ID, SiteID: site.ID, State: models.Authorized}).Error)
+	require.NoError(t, db.Create(&models.AppToken{UserID: user.ID, Name: "prometheus", TokenHash: hashAppToken("kv_token")}).Error)
+	return &Handler{db: db}, db
+}
+
+func authenticateRequest(h *Handler, configure func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/authenticate?redirect="+basicTestSite, nil)
+	configure(req)
+	rr := httptest.NewRecorder()
+	h.HandleAuthenticate(rr, req)
+	return rr
+}
+
+func TestHandleAuthenticateBasic(t *testing.T) {
+	h, _ := setupBasicAuthTest(t, true)
+
+	tests := []struct {
+		name     string
+		user     string
+		secret   string
+		expected int
+	}{
+		{"password", "scraper@example.com", "secret", http.StatusOK},
+		{"app token", "scraper@example.com", "kv_token", http.StatusOK},
+		{"wrong password", "scraper@example.com", "nope", http.StatusUnauthorized},
+		{"wrong token", "scraper@example.com", "kv_other", http.StatusUnauthorized},
+		{"unknown user", "nobody@example.com", "secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := authenticateRequest(h, func(r *http.Request) { r.SetBasicAuth(tt.user, tt.secret) })
+			assert.Equal(t, tt.expected, rr.Code)
+			if tt.expected == http.StatusUnauthorized {
+				assert.Equal(t, basicRealm, rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestHandleAuthenticateBasicNotGranted(t *testing.T) {
+	h, db := setupBasicAuthTest(t, true)
+	require.NoError(t, db.Model(&models.UserSite{}).Where("1 = 1").Update("state", models.Declined).Error)
+
+	rr := authenticateRequest(h, func(r *http.Request) { r.SetBasicAuth("scraper@example.com", "kv_token") })
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestHandleAuthenticateNonBrowserNeverRedirects(t *testing.T) {
+	for _, allowBasic := range []bool{true, false} {
+		h, _ := setupBasicAuthTest(t, allowBasic)
+		rr := authenticateRequest(h, func(r *http.Request) { r.Header.Set("Accept", "*/*") })
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Empty(t, rr.Header().Get("Location"))
+		if allowBasic {
+			assert.Equal(t, basicRealm, rr.Header().Get("WWW-Authenticate"))
+		} else {
+			assert.Empty(t, rr.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestHandleAuthenticateBasicIgnoredWithoutOptIn(t *testing.T) {
+	h, _ := setupBasicAuthTest(t, false)
+
+	rr := authenticateRequest(h, func(r *http.Request) {
+		r.SetBasicAuth("scraper@example.com", "secret")
+		r.Header.Set("Accept", "text/html")
+	})
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	assert.Contains(t, rr.Header().Get("Location"), "/login")
+}
@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	chatBodyLimit       = 1 << 20
+	chatSignatureMaxAge = 5 * time.Minute
+)
+
+// chatPost is a message for Slack and Mattermost incoming webhooks. The
+// buttons carry what both need: Slack posts the value to the interaction URL
+// of its app, Mattermost posts the context to the integration URL.
+type chatPost struct {
+	Text        string           `json:"text"`
+	Attachments []chatAttachment `json:"attachments,omitempty"`
+}
+
+type chatAttachment struct {
+	Fallback   string       `json:"fallback"`
+	Text       string       `json:"text,omitempty"`
+	CallbackID string       `json:"callback_id,omitempty"`
+	Actions    []chatButton `json:"actions,omitempty"`
+}
+
+type chatButton struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Text        string          `json:"text"`
+	Type        string          `json:"type"`
+	Style       string          `json:"style"`
+	Value       string          `json:"value"`
+	Integration chatIntegration `json:"integration"`
+}
+
+type chatIntegration struct {
+	URL     string            `json:"url"`
+	Context map[string]string `json:"context"`
+}
+
+// chatAction is the decision a button stands for. Buttons are signed, so
+// only KubeVoyage can make them, and die with the request like decision
+// links do.
+type chatAction struct {
+	UserID    uint         `json:"u"`
+	SiteID    uint         `json:"s"`
+	State     models.State `json:"a"`
+	EntryID   uint         `json:"e"`
+	ExpiresAt int64        `json:"x"`
+}
+
+func (h *Handler) signChatAction(action chatAction) string {
+	content, _ := json.Marshal(action)
+	encoded := base64.RawURLEncoding.EncodeToString(content)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(h.chatActionMAC(encoded))
+}
+
+func (h *Handler) chatActionMAC(encoded string) []byte {
+	mac := hmac.New(sha256.New, h.JWTKey)
+	mac.Write([]byte("chat-action." + encoded))
+	return mac.Sum(nil)
+}
+
+func (h *Handler) parseChatAction(token string, now time.Time) (*chatAction, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if !ok || err != nil || !hmac.Equal(mac, h.chatActionMAC(encoded)) {
+		return nil, errors.New("invalid button")
+	}
+	content, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var action chatAction
+	if err := json.Unmarshal(content, &action); err != nil {
+		return nil, err
+	}
+	if now.Unix() >= action.ExpiresAt {
+		return nil, errors.New("expired button")
+	}
+	return &action, nil
+}
+
+// chatMessage describes a transition for chat webhooks. New requests get
+// approve and decline buttons.
+func (h *Handler) chatMessage(event string, entry *models.RequestHistory, request historyResponse) chatPost {
+	if event != eventRequestCreated {
+		text := fmt.Sprintf("%s moved the request of %s for %s from %s to %s.", request.Actor, request.User, request.Site,
+			displayState(request.FromState), request.ToState)
+		if request.Reason != "" {
+			text += " Reason: " + request.Reason
+		}
+		return chatPost{Text: text}
+	}
+
+	text := fmt.Sprintf("%s asked for access to %s.", request.User, request.Site)
+	attachment := chatAttachment{Fallback: text, CallbackID: "kubevoyage"}
+	if request.Reason != "" {
+		attachment.Text = "Justification: " + request.Reason
+	}
+	callback := h.link("/api/chat/interaction")
+	// Mattermost keeps the integration context on the server, so the token
+	// proves the interaction comes from it.
+	shared := map[string]string{}
+	if h.chatToken != nil {
+		shared["auth"] = string(h.chatToken)
+	}
+	for _, button := range []struct {
+		state models.State
+		label string
+		style string
+	}{{models.Authorized, "Approve", "primary"}, {models.Declined, "Decline", "danger"}} {
+		token := h.signChatAction(chatAction{UserID: entry.UserID, SiteID: entry.SiteID, State: button.state, EntryID: entry.ID,
+			ExpiresAt: entry.CreatedAt.Add(decisionLinkTTL).Unix()})
+		attachment.Actions = append(attachment.Actions, chatButton{
+			ID:          strings.ToLower(button.label),
+			Name:        button.label,
+			Text:        button.label,
+			Type:        "button",
+			Style:       button.style,
+			Value:       token,
+			Integration: chatIntegration{URL: callback, Context: withToken(shared, token)},
+		})
+	}
+	return chatPost{Text: text, Attachments: []chatAttachment{attachment}}
+}
+
+func withToken(shared map[string]string, token string) map[string]string {
+	result := map[string]string{"token": token}
+	for key, value := range shared {
+		result[key] = value
+	}
+	return result
+}
+
+// chatReply answers an interaction. Slack reads text, response_type and
+// replace_original, Mattermost ephemeral_text and update.
+type chatReply struct {
+	Text            string           `json:"text,omitempty"`
+	ResponseType    string           `json:"response_type,omitempty"`
+	ReplaceOriginal bool             `json:"replace_original"`
+	EphemeralText   string           `json:"ephemeral_text,omitempty"`
+	Update          *chatReplyUpdate `json:"update,omitempty"`
+}
+
+type chatReplyUpdate struct {
+	Message string `json:"message"`
+}
+
+// replyEphemeral shows the text only to the user who clicked. Chat systems
+// show errors in their own way, so refusals are still answered with 200.
+func replyEphemeral(w http.ResponseWriter, text string) {
+	sendJSONResponse(w, chatReply{Text: text, ResponseType: "ephemeral", EphemeralText: text}, http.StatusOK)
+}
+
+// replyUpdate replaces the message with the outcome for everybody.
+func replyUpdate(w http.ResponseWriter, text string) {
+	sendJSONResponse(w, chatReply{Text: text, ReplaceOriginal: true, Update: &chatReplyUpdate{Message: text}}, http.StatusOK)
+}
+
+// verifyChatSignature checks a Slack request signature: v0=<hex
+// HMAC-SHA256 of "v0:<timestamp>:<body>"> keyed with CHAT_SIGNING_SECRET.
+func (h *Handler) verifyChatSignature(r *http.Request, body []byte, now time.Time) bool {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > chatSignatureMaxAge || age < -chatSignatureMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.chatSecret)
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// isSlackInteraction tells Slack interactions (form encoded payload) from
+// Mattermost ones (JSON).
+func isSlackInteraction(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
+
+// verifyChatInteraction authenticates an interaction: Slack ones by their
+// signature, Mattermost ones by the token in the integration context. Chat
+// systems without a configured secret are refused.
+func (h *Handler) verifyChatInteraction(r *http.Request, body []byte, now time.Time) bool {
+	if isSlackInteraction(r) {
+		return h.chatSecret != nil && h.verifyChatSignature(r, body, now)
+	}
+	var payload struct {
+		Context map[string]string `json:"context"`
+	}
+	if h.chatToken == nil || json.Unmarshal(body, &payload) != nil {
+		return false
+	}
+	return hmac.Equal([]byte(payload.Context["auth"]), h.chatToken)
+}
+
+// parseChatInteraction returns the chat user and button token of a Slack
+// or Mattermost interaction.
+func parseChatInteraction(r *http.Request, body []byte) (chatUser string, token string, err error) {
+	if isSlackInteraction(r) {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", "", err
+		}
+		var payload struct {
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+			Actions []struct {
+				Value string `json:"value"`
+			} `json:"actions"`
+		}
+		if err := json.Unmarshal([]byte(values.Get("payload")), &payload); err != nil {
+			return "", "", err
+		}
+		if len(payload.Actions) == 0 {
+			return "", "", errors.New("no action")
+		}
+		return payload.User.ID, payload.Actions[0].Value, nil
+	}
+	var payload struct {
+		UserID  string            `json:"user_id"`
+		Context map[string]string `json:"context"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", "", err
+	}
+	return payload.UserID, payload.Context["token"], nil
+}
+
+// HandleChatInteraction applies the decision of a button in a chat message
+// (POST). The chat user must be linked to a KubeVoyage user through
+// /api/chat/users, who then needs the same rights and passes the same checks
+// as with /api/requests/update. Slack interactions must carry a valid
+// request signature (CHAT_SIGNING_SECRET), Mattermost ones the
+// CHAT_MATTERMOST_TOKEN; without either, interactions are disabled.
+func (h *Handler) HandleChatInteraction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, chatBodyLimit))
+	if err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if h.chatSecret == nil && h.chatToken == nil {
+		sendJSONError(w, "Chat interactions are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	now := time.Now()
+	if !h.verifyChatInteraction(r, body, now) {
+		sendJSONError(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	chatUser, token, err := parseChatInteraction(r, body)
+	if err != nil || chatUser == "" {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	action, err := h.parseChatAction(token, now)
+	if err != nil {
+		replyEphemeral(w, "This button has expired. Decide the request in KubeVoyage instead.")
+		return
+	}
+
+	var identity models.ChatIdentity
+	var approver, requester models.User
+	var site models.Site
+	err = h.db.Where("chat_user_id = ?", chatUser).Limit(1).Find(&identity).Error
+	if err == nil && identity.ID == 0 {
+		replyEphemeral(w, "Your chat account is not linked to a KubeVoyage user.")
+		return
+	}
+	if err == nil {
+		err = h.db.First(&approver, identity.UserID).Error
+	}
+	if err == nil {
+		err = h.db.First(&requester, action.UserID).Error
+	}
+	if err == nil {
+		err = h.db.First(&site, action.SiteID).Error
+	}
+	var entryID uint
+	if err == nil {
+		entryID, err = h.requestEntryID(action.UserID, action.SiteID)
+	}
+	var userSite *models.UserSite
+	if err == nil {
+		userSite, err = h.findUserSite(action.UserID, action.SiteID)
+	}
+	allowed := false
+	if err == nil {
+		allowed, err = h.canApproveRequest(&approver, &site, requester.Email)
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Buttons stay in the channel, so they only act on the request they were
+	// posted for while it is pending.
+	if entryID != action.EntryID || !userSite.State.Pending() {
+		replyEphemeral(w, "The request has changed since this message was posted. Decide it in KubeVoyage instead.")
+		return
+	}
+	if !allowed {
+		replyEphemeral(w, "You may not decide this request.")
+		return
+	}
+
+	progress, err := h.decideRequest(&approver, requester.ID, &site, action.State, nil, "")
+	var decisionErr *decisionError
+	if errors.As(err, &decisionErr) {
+		replyEphemeral(w, decisionErr.message)
+		return
+	}
+	if progress != nil {
+		replyEphemeral(w, fmt.Sprintf("Your approval was recorded: %d of %d required approvals.",
+			len(progress.Approvals), progress.RequiredApprovals))
+		return
+	}
+	replyUpdate(w, fmt.Sprintf("%s %s the request of %s for %s.", approver.Email, action.State, requester.Email, site.URL))
+}
+
+type chatUserBody struct {
+	ChatUser string `json:"chatUser"`
+	Email    string `json:"email"`
+}
+
+// HandleChatUsers lists (GET), links (POST {"chatUser", "email"}) and
+// unlinks (DELETE ?chatUser=) chat user ids and KubeVoyage users. Requires
+// the users:manage permission.
+func (h *Handler) HandleChatUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requirePermission(w, r, models.PermManageUsers); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		results := []chatUserBody{}
+		err := h.db.Table("chat_identities").
+			Select("chat_identities.chat_user_id as chat_user, users.email as email").
+			Joins("JOIN users ON users.id = chat_identities.user_id").
+			Order("chat_identities.chat_user_id").
+			Scan(&results).Error
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, results, http.StatusOK)
+	case http.MethodPost:
+		var body chatUserBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.ChatUser) == "" {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var user models.User
+		if err := h.db.Where("email = ?", body.Email).Limit(1).Find(&user).Error; err != nil || user.ID == 0 {
+			sendJSONError(w, "User not found", http.StatusNotFound)
+			return
+		}
+		identity := models.ChatIdentity{ChatUserID: strings.TrimSpace(body.ChatUser)}
+		err := h.db.Where(&identity).Assign(models.ChatIdentity{UserID: user.ID}).FirstOrCreate(&identity).Error
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, chatUserBody{ChatUser: identity.ChatUserID, Email: user.Email}, http.StatusOK)
+	case http.MethodDelete:
+		result := h.db.Where("chat_user_id = ?", r.URL.Query().Get("chatUser")).Delete(&models.ChatIdentity{})
+		if result.Error != nil {
+			log.Printf("Database error: %v", result.Error)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			sendJSONError(w, "Chat user not found", http.StatusNotFound)
+			return
+		}
+		sendJSONSuccess(w, "Chat user unlinked", http.StatusOK)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChatOps(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	h.JWTKey, h.BaseURL, h.chatSecret = []byte("test"), "https://auth.example.com", []byte("chat-secret")
+
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin}
+	owner := models.User{Email: "owner@example.com", Role: models.RoleUser}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	bob := models.User{Email: "bob@example.com", Role: models.RoleUser}
+	for _, user := range []*models.User{&admin, &owner, &alice, &bob} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	site := models.Site{URL: "https://wiki.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.SiteOwner{SiteID: site.ID, UserID: owner.ID}).Error)
+
+	// The stand-in for the incoming webhook of the chat system.
+	var mu sync.Mutex
+	var posted []chatPost
+	chat := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message chatPost
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, message)
+	}))
+	defer chat.Close()
+	rr := httptest.NewRecorder()
+	h.HandleWebhooks(rr, requestAs(admin.Email, http.MethodPost, "/api/webhooks",
+		`{"name": "chat", "url": "`+chat.URL+`", "events": ["request.created", "request.state_changed"], "format": "chat"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// buttons asks for access and returns the approve and decline tokens of
+	// the message posted to the chat.
+	buttons := func(requester string) (string, string) {
+		rr := httptest.NewRecorder()
+		h.HandleRequestSite(rr, requestAs(requester, http.MethodPost, "/api/request",
+			`{"redirect": "https://wiki.example.com", "justification": "on call"}`))
+		require.Equal(t, http.StatusOK, rr.Code)
+		_, err := h.DeliverWebhooks(context.Background(), time.Now())
+		require.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		message := posted[len(posted)-1]
+		assert.Equal(t, requester+" asked for access to https://wiki.example.com.", message.Text)
+		require.Len(t, message.Attachments, 1)
+		assert.Equal(t, "Justification: on call", message.Attachments[0].Text)
+		actions := message.Attachments[0].Actions
+		require.Len(t, actions, 2)
+		assert.Equal(t, "https://auth.example.com/api/chat/interaction", actions[0].Integration.URL)
+		assert.Equal(t, actions[0].Value, actions[0].Integration.Context["token"])
+		return actions[0].Value, actions[1].Value
+	}
+	slack := func(chatUser string, token string, secret string) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(map[string]any{
+			"user":    map[string]string{"id": chatUser},
+			"actions": []map[string]string{{"value": token}},
+		})
+		body := url.Values{"payload": {string(payload)}}.Encode()
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + timestamp + ":" + body))
+		req := httptest.NewRequest(http.MethodPost, "/api/chat/interaction", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		rr := httptest.NewRecorder()
+		h.HandleChatInteraction(rr, req)
+		return rr
+	}
+	reply := func(rr *httptest.ResponseRecorder) chatReply {
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var reply chatReply
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&reply))
+		return reply
+	}
+
+	approve, _ := buttons(alice.Email)
+	assert.Equal(t, http.StatusUnauthorized, slack("U1", approve, "wrong").Code)
+	answer := reply(slack("U1", approve, "chat-secret"))
+	assert.Equal(t, "ephemeral", answer.ResponseType)
+	assert.Contains(t, answer.Text, "not linked")
+	forged := reply(slack("U1", approve[:len(approve)-2]+"xx", "chat-secret"))
+	assert.Contains(t, forged.Text, "expired")
+
+	rr = httptest.NewRecorder()
+	h.HandleChatUsers(rr, requestAs(alice.Email, http.MethodPost, "/api/chat/users", `{"chatUser": "U2", "email": "alice@example.com"}`))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	for _, link := range []string{`{"chatUser": "U1", "email": "owner@example.com"}`, `{"chatUser": "U2", "email": "alice@example.com"}`} {
+		rr = httptest.NewRecorder()
+		h.HandleChatUsers(rr, requestAs(admin.Email, http.MethodPost, "/api/chat/users", link))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	answer = reply(slack("U2", approve, "chat-secret"))
+	assert.Contains(t, answer.Text, "may not decide", "requesters cannot approve themselves")
+	answer = reply(slack("U1", approve, "chat-secret"))
+	assert.True(t, answer.ReplaceOriginal)
+	assert.Equal(t, "owner@example.com authorized the request of alice@example.com for https://wiki.example.com.", answer.Update.Message)
+	userSite, err := h.findUserSite(alice.ID, site.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Authorized, userSite.State)
+	assert.Equal(t, "ephemeral", reply(slack("U1", approve, "chat-secret")).ResponseType, "buttons work once")
+
+	_, err = h.DeliverWebhooks(context.Background(), time.Now())
+	require.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, "owner@example.com moved the request of alice@example.com for https://wiki.example.com from requested to authorized.",
+		posted[len(posted)-1].Text)
+	mu.Unlock()
+
+	// Mattermost does not sign its requests; it sends back the integration
+	// context, which carries the configured token and is never shown to users.
+	h.chatToken = []byte("mm-token")
+	_, decline := buttons(bob.Email)
+	mu.Lock()
+	integration := posted[len(posted)-1].Attachments[0].Actions[1].Integration.Context
+	mu.Unlock()
+	assert.Equal(t, map[string]string{"token": decline, "auth": "mm-token"}, integration)
+	mattermost := func(context map[string]string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"user_id": "U1", "context": context})
+		rr := httptest.NewRecorder()
+		h.HandleChatInteraction(rr, httptest.NewRequest(http.MethodPost, "/api/chat/interaction", strings.NewReader(string(body))))
+		return rr
+	}
+	assert.Equal(t, http.StatusUnauthorized, mattermost(map[string]string{"token": decline}).Code, "unsigned")
+	assert.Equal(t, http.StatusUnauthorized, mattermost(map[string]string{"token": decline, "auth": "guess"}).Code)
+	answer = reply(mattermost(integration))
+	assert.Contains(t, answer.Update.Message, "declined the request of bob@example.com")
+	userSite, err = h.findUserSite(bob.ID, site.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Declined, userSite.State)
+
+	// Without any secret nobody can be authenticated.
+	h.chatSecret, h.chatToken = nil, nil
+	assert.Equal(t, http.StatusServiceUnavailable, mattermost(integration).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, slack("U1", approve, "").Code)
+
+	rr = httptest.NewRecorder()
+	h.HandleChatUsers(rr, requestAs(admin.Email, http.MethodGet, "/api/chat/users", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var links []chatUserBody
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&links))
+	assert.Equal(t, []chatUserBody{{ChatUser: "U1", Email: "owner@example.com"}, {ChatUser: "U2", Email: "alice@example.com"}}, links)
+	rr = httptest.NewRecorder()
+	h.HandleChatUsers(rr, requestAs(admin.Email, http.MethodDelete, "/api/chat/users?chatUser=U2", ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/util"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+)
+
+// newClientCertVerifier enables client certificate authentication when
+// CLIENT_CA_FILES lists at least one PEM bundle.
+func newClientCertVerifier() (*auth.ClientCertVerifier, error) {
+	files := util.GetEnvList("CLIENT_CA_FILES")
+	if len(files) == 0 {
+		return nil, nil
+	}
+	pool, err := auth.LoadCertPool(files)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.ClientCertVerifier{Roots: pool}, nil
+}
+
+// clientCertificateUser returns the principal of a verified client
+// certificate, presented either directly over TLS or forwarded by a trusted
+// proxy in the X-Forwarded-Tls-Client-Cert header. It returns an empty string
+// when the request carries no usable certificate.
+func (h *Handler) clientCertificateUser(r *http.Request) (string, error) {
+	if h.clientCerts == nil {
+		return "", nil
+	}
+
+	var chain []*x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		chain = r.TLS.PeerCertificates
+	} else if header := r.Header.Get(auth.ForwardedClientCertHeader); header != "" {
+		// Anyone can copy a public certificate into a header, so it only
+		// proves possession of the key when a trusted proxy set it.
+		if !h.trustedProxies.Contains(r.RemoteAddr) {
+			slog.Warn("Ignoring forwarded client certificate from untrusted peer", "remote", r.RemoteAddr)
+			return "", nil
+		}
+		var err error
+		chain, err = auth.ParseForwardedClientCert(header)
+		if err != nil {
+			slog.Info("Ignoring malformed forwarded client certificate", "error", err)
+			return "", nil
+		}
+	}
+	if len(chain) == 0 {
+		return "", nil
+	}
+
+	identity, err := h.clientCerts.Verify(chain)
+	if err != nil {
+		slog.Info("Rejected client certificate", "error", err)
+		return "", nil
+	}
+	if identity.User {
+		var user models.User
+		err := h.db.Where("email = ? AND kind = ?", identity.Identity, models.KindUser).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			slog.Info("Client certificate names an unknown user", "email", identity.Identity)
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !user.EmailVerified {
+			if err := h.markEmailVerified(user.Email); err != nil {
+				return "", err
+			}
+		}
+		return user.Email, nil
+	}
+	principal, err := h.ensurePrincipal(identity.Identity, models.KindService)
+	if errors.Is(err, errPrincipalKind) {
+		slog.Warn("Client certificate names a principal of another kind", "identity", identity.Identity)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return principal.Email, nil
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertificateUser(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	var admin models.User
+	require.NoError(t, db.Where("email = ?", "admin@admin.de").First(&admin).Error)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	issue := func(template *x509.Certificate, parent *x509.Certificate) *x509.Certificate {
+		template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+		if parent == nil {
+			parent = template
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, key)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return cert
+	}
+	ca := issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	h.clientCerts = &auth.ClientCertVerifier{Roots: roots}
+	login := func(commonName string) string {
+		cert := issue(&x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: commonName},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+		req := httptest.NewRequest(http.MethodGet, "/api/authenticate", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		email, err := h.clientCertificateUser(req)
+		require.NoError(t, err)
+		return email
+	}
+
+	assert.Equal(t, "billing.internal", login("billing.internal"))
+	var service models.User
+	require.NoError(t, db.Where("email = ?", "billing.internal").First(&service).Error)
+	assert.Equal(t, models.KindService, service.Kind)
+	assert.Empty(t, login(admin.Email), "a common name never logs in as a human")
+}
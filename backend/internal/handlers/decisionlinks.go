@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const decisionLinkTTL = 72 * time.Hour
+
+var decisionPage = template.Must(template.New("decision").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>KubeVoyage</title>
+</head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 3em auto; padding: 0 1em;">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{with .Justification}}<p>Justification: {{.}}</p>{{end}}
+{{if .Token}}
+<form method="post" action="/api/decide">
+<input type="hidden" name="token" value="{{.Token}}">
+<p><label>Reason (optional)<br><textarea name="reason" rows="3" cols="50"></textarea></label></p>
+<p><button type="submit">{{.Action}}</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type decisionPageData struct {
+	Title         string
+	Message       string
+	Justification string
+	Token         string
+	Action        string
+}
+
+func renderDecisionPage(w http.ResponseWriter, status int, data decisionPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := decisionPage.Execute(w, data); err != nil {
+		log.Printf("Rendering decision page failed: %v", err)
+	}
+}
+
+// requestEntryID returns the history entry that created the current request
+// of the user for the site, 0 if there is none.
+func (h *Handler) requestEntryID(userID uint, siteID uint) (uint, error) {
+	var ids []uint
+	err := h.db.Model(&models.RequestHistory{}).
+		Where("user_id = ? AND site_id = ? AND to_state = ? AND from_state NOT IN ?",
+			userID, siteID, models.Requested, []models.State{models.Requested, models.PendingSecondApproval}).
+		Order("id DESC").Limit(1).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// newDecisionLinks issues the approve and decline links of a pending request
+// for one approver.
+func (h *Handler) newDecisionLinks(approver *models.User, userID uint, siteID uint, now time.Time) (approve string, decline string, err error) {
+	entryID, err := h.requestEntryID(userID, siteID)
+	if err != nil {
+		return "", "", err
+	}
+	links := make([]string, 0, 2)
+	for _, state := range []models.State{models.Authorized, models.Declined} {
+		token := generateSessionID()
+		link := models.DecisionLink{
+			TokenHash:      h.hashLoginSecret(token),
+			UserID:         userID,
+			SiteID:         siteID,
+			ApproverID:     approver.ID,
+			RequestEntryID: entryID,
+			State:          state,
+			ExpiresAt:      now.Add(decisionLinkTTL),
+		}
+		if err := h.db.Create(&link).Error; err != nil {
+			return "", "", err
+		}
+		links = append(links, h.link("/api/decide?token="+url.QueryEscape(token)))
+	}
+	return links[0], links[1], nil
+}
+
+// HandleDecisionLink serves the approve and decline links of notifications.
+// GET shows a confirmation page, so link scanners in mail systems cannot
+// decide anything; posting it uses up the link and decides the request with
+// the same checks as /api/requests/update. Links only work while the request
+// they were sent for is pending. The link stands in for the approver's login,
+// but a session of somebody else is refused.
+func (h *Handler) HandleDecisionLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Keep the token out of caches and the Referer of anything linked.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	token := r.FormValue("token")
+	now := time.Now()
+	var link models.DecisionLink
+	err := h.db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", h.hashLoginSecret(token), now).Limit(1).Find(&link).Error
+	if err == nil && (token == "" || link.ID == 0) {
+		renderDecisionPage(w, http.StatusGone, decisionPageData{Title: "Link expired",
+			Message: "This link is invalid, was already used or has expired. Decide the request in KubeVoyage instead."})
+		return
+	}
+	var approver, requester models.User
+	var site models.Site
+	if err == nil {
+		err = h.db.First(&approver, link.ApproverID).Error
+	}
+	if err == nil {
+		err = h.db.First(&requester, link.UserID).Error
+	}
+	if err == nil {
+		err = h.db.First(&site, link.SiteID).Error
+	}
+	var entryID uint
+	if err == nil {
+		entryID, err = h.requestEntryID(link.UserID, link.SiteID)
+	}
+	userSite := &models.UserSite{}
+	if err == nil {
+		userSite, err = h.findUserSite(link.UserID, link.SiteID)
+	}
+	allowed := false
+	if err == nil {
+		allowed, err = h.canApproveRequest(&approver, &site, requester.Email)
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		renderDecisionPage(w, http.StatusInternalServerError, decisionPageData{Title: "Something went wrong",
+			Message: "The request could not be loaded, please try again later."})
+		return
+	}
+	if current, _ := h.getRequestUser(r); current != "" && current != approver.Email {
+		renderDecisionPage(w, http.StatusForbidden, decisionPageData{Title: "Wrong approver",
+			Message: fmt.Sprintf("This link was sent to %s, but you are logged in as %s.", approver.Email, current)})
+		return
+	}
+	// Mails stay around, so links only act on the request they were sent for
+	// while it is pending.
+	if entryID != link.RequestEntryID || !userSite.State.Pending() {
+		renderDecisionPage(w, http.StatusGone, decisionPageData{Title: "Request changed",
+			Message: "The request has changed since this link was sent. Decide it in KubeVoyage instead."})
+		return
+	}
+	if !allowed {
+		renderDecisionPage(w, http.StatusForbidden, decisionPageData{Title: "Not allowed",
+			Message: "You may no longer decide this request."})
+		return
+	}
+
+	action := "Approve"
+	if link.State == models.Declined {
+		action = "Decline"
+	}
+	if r.Method == http.MethodGet {
+		renderDecisionPage(w, http.StatusOK, decisionPageData{
+			Title:         action + " access?",
+			Message:       fmt.Sprintf("%s asked for access to %s.", requester.Email, site.URL),
+			Justification: userSite.Justification,
+			Token:         token,
+			Action:        action,
+		})
+		return
+	}
+
+	// Posting one of the approve and decline links uses up both.
+	result := h.db.Model(&models.DecisionLink{}).
+		Where("user_id = ? AND site_id = ? AND approver_id = ? AND request_entry_id = ? AND used_at IS NULL AND expires_at > ?",
+			link.UserID, link.SiteID, link.ApproverID, link.RequestEntryID, now).
+		Update("used_at", now)
+	if result.Error != nil || result.RowsAffected == 0 {
+		renderDecisionPage(w, http.StatusGone, decisionPageData{Title: "Link expired",
+			Message: "This link is invalid, was already used or has expired. Decide the request in KubeVoyage instead."})
+		return
+	}
+	progress, err := h.decideRequest(&approver, requester.ID, &site, link.State, nil, r.FormValue("reason"))
+	var decisionErr *decisionError
+	if errors.As(err, &decisionErr) {
+		renderDecisionPage(w, decisionErr.status, decisionPageData{Title: "Not decided", Message: decisionErr.message})
+		return
+	}
+	if progress != nil {
+		renderDecisionPage(w, http.StatusAccepted, decisionPageData{Title: "Approval recorded",
+			Message: fmt.Sprintf("Your approval was recorded: %d of %d required approvals (%s).",
+				len(progress.Approvals), progress.RequiredApprovals, strings.Join(progress.Approvals, ", "))})
+		return
+	}
+	message := fmt.Sprintf("%s now has access to %s.", requester.Email, site.URL)
+	if link.State == models.Declined {
+		message = fmt.Sprintf("The request of %s for %s was declined.", requester.Email, site.URL)
+	}
+	renderDecisionPage(w, http.StatusOK, decisionPageData{Title: "Done", Message: message})
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecisionLinks(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	mailer := &recordingMailer{}
+	h.mailer, h.JWTKey, h.BaseURL = mailer, []byte("test"), "https://auth.example.com"
+
+	owner := models.User{Email: "owner@example.com", Role: models.RoleUser}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin}
+	for _, user := range []*models.User{&owner, &alice, &admin} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	site := models.Site{URL: "https://wiki.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.SiteOwner{SiteID: site.ID, UserID: owner.ID}).Error)
+	require.NoError(t, h.SendNotifications(context.Background(), time.Now()))
+
+	// links asks for access and returns the approve and decline tokens mailed
+	// to the owner.
+	links := func() (string, string) {
+		rr := httptest.NewRecorder()
+		h.HandleRequestSite(rr, requestAs(alice.Email, http.MethodPost, "/api/request",
+			`{"redirect": "https://wiki.example.com", "justification": "on call"}`))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NoError(t, h.SendNotifications(context.Background(), time.Now()))
+		body := mailer.sent[len(mailer.sent)-1].Body
+		tokens := []string{}
+		for _, label := range []string{"Approve", "Decline"} {
+			link, err := url.Parse(regexp.MustCompile(label + `: (\S+)`).FindStringSubmatch(body)[1])
+			require.NoError(t, err)
+			assert.Equal(t, "/api/decide", link.Path)
+			tokens = append(tokens, link.Query().Get("token"))
+		}
+		return tokens[0], tokens[1]
+	}
+	follow := func(as string, method string, token string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		var req *http.Request
+		if method == http.MethodGet {
+			req = requestAs(as, method, "/api/decide?token="+url.QueryEscape(token), "")
+		} else {
+			req = requestAs(as, method, "/api/decide", url.Values{"token": {token}, "reason": {"ok"}}.Encode())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		h.HandleDecisionLink(rr, req)
+		return rr
+	}
+	state := func() models.State {
+		userSite, err := h.findUserSite(alice.ID, site.ID)
+		require.NoError(t, err)
+		return userSite.State
+	}
+
+	approve, decline := links()
+	rr := follow("", http.MethodGet, approve)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "alice@example.com asked for access to https://wiki.example.com.")
+	assert.Contains(t, rr.Body.String(), "Justification: on call")
+	assert.Equal(t, models.Requested, state(), "showing the confirmation page decides nothing")
+
+	assert.Equal(t, http.StatusForbidden, follow(alice.Email, http.MethodPost, approve).Code, "a session of somebody else is refused")
+	assert.Equal(t, http.StatusGone, follow("", http.MethodPost, approve+"x").Code)
+
+	// Asking again after withdrawing is a new request, old links die with the old one.
+	rr = httptest.NewRecorder()
+	h.HandleWithdrawRequest(rr, requestAs(alice.Email, http.MethodPost, "/api/request/withdraw", `{"site": "https://wiki.example.com"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	stale := approve
+	approve, decline = links()
+	rr = follow("", http.MethodPost, stale)
+	assert.Equal(t, http.StatusGone, rr.Code)
+	assert.Contains(t, rr.Body.String(), "The request has changed")
+
+	rr = follow(owner.Email, http.MethodPost, approve)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "alice@example.com now has access")
+	assert.Equal(t, models.Authorized, state())
+	var entry models.RequestHistory
+	require.NoError(t, db.Order("id DESC").First(&entry).Error)
+	assert.Equal(t, owner.Email, entry.Actor)
+	assert.Equal(t, "ok", entry.Reason)
+
+	assert.Equal(t, http.StatusGone, follow("", http.MethodPost, approve).Code, "links are single-use")
+	assert.Equal(t, http.StatusGone, follow("", http.MethodPost, decline).Code, "approving used up the decline link")
+	assert.Equal(t, models.Authorized, state())
+
+	// A link from an old mail cannot undo a decision made elsewhere.
+	decide := func(state models.State) {
+		rr := httptest.NewRecorder()
+		h.HandleUpdateSiteState(rr, requestAs(admin.Email, http.MethodPost, "/api/requests/update",
+			`{"userEmail": "alice@example.com", "siteURL": "https://wiki.example.com", "newState": "`+string(state)+`"}`))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	decide(models.Revoked)
+	approve, decline = links()
+	decide(models.Authorized)
+	decide(models.Revoked)
+	rr = follow(owner.Email, http.MethodPost, approve)
+	assert.Equal(t, http.StatusGone, rr.Code)
+	assert.Contains(t, rr.Body.String(), "The request has changed")
+	assert.Equal(t, http.StatusGone, follow(owner.Email, http.MethodGet, decline).Code)
+	assert.Equal(t, models.Revoked, state())
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventHeartbeat   = 15 * time.Second
+	eventRetry       = 3 * time.Second
+	eventBuffer      = 64
+	eventReplayBatch = 100
+)
+
+// eventHub fans the request history out to the open event streams of this
+// instance.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan *models.RequestHistory]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[chan *models.RequestHistory]struct{}{}}
+}
+
+func (hub *eventHub) subscribe() chan *models.RequestHistory {
+	events := make(chan *models.RequestHistory, eventBuffer)
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.subscribers[events] = struct{}{}
+	return events
+}
+
+func (hub *eventHub) unsubscribe(events chan *models.RequestHistory) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if _, ok := hub.subscribers[events]; ok {
+		delete(hub.subscribers, events)
+		close(events)
+	}
+}
+
+// publish hands the entry to every subscriber without waiting. Subscribers
+// that fell behind are dropped; their clients reconnect and catch up from
+// the history. Without a hub nobody listens.
+func (hub *eventHub) publish(entry *models.RequestHistory) {
+	if hub == nil {
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for events := range hub.subscribers {
+		select {
+		case events <- entry:
+		default:
+			delete(hub.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// canSeeRequest reports whether the user may follow the request of the user
+// with userID for the site: their own requests, and the requests they see in
+// /api/requests.
+func (h *Handler) canSeeRequest(user *models.User, userID uint, siteID uint) (bool, error) {
+	if user.ID == userID || user.Role.Can(models.PermViewRequests) {
+		return true, nil
+	}
+	siteIDs, all, err := h.approvableSites(user)
+	if err != nil || all || slices.Contains(siteIDs, siteID) {
+		return err == nil, err
+	}
+	var routed int64
+	err = h.db.Model(&models.RequestApprover{}).
+		Where("user_id = ? AND site_id = ? AND approver_id = ?", userID, siteID, user.ID).
+		Count(&routed).Error
+	return routed > 0, err
+}
+
+// HandleRequestEvents streams request.created, request.state_changed and
+// grant.expired events of the requests the caller may see as Server-Sent
+// Events (GET). Each event carries its history entry as data and the entry's
+// id as event id, so a reconnecting client sending Last-Event-ID (or
+// ?lastEventId=) gets what it missed from the history first.
+func (h *Handler) HandleRequestEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	var last uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	if lastEventID != "" {
+		var err error
+		if last, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			sendJSONError(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before replaying, so nothing falls between the two.
+	events := h.events.subscribe()
+	defer h.events.unsubscribe(events)
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	if err := controller.Flush(); err != nil {
+		log.Printf("Streaming events failed: %v", err)
+		return
+	}
+
+	send := func(entry *models.RequestHistory) error {
+		visible, err := h.canSeeRequest(user, entry.UserID, entry.SiteID)
+		if err != nil || !visible {
+			return err
+		}
+		request, err := newHistoryResponse(h.db, entry)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", entry.ID, requestEventType(entry.FromState, entry.ToState), data)
+		return controller.Flush()
+	}
+
+	// Transactions may commit out of id order, so the live events are checked
+	// against what was replayed rather than the last id.
+	replayed := map[uint]bool{}
+	if lastEventID != "" {
+		for {
+			var entries []models.RequestHistory
+			err := h.db.Where("id > ?", last).Order("id").Limit(eventReplayBatch).Find(&entries).Error
+			for i := 0; err == nil && i < len(entries); i++ {
+				replayed[entries[i].ID] = true
+				last = uint64(entries[i].ID)
+				err = send(&entries[i])
+			}
+			if err != nil {
+				log.Printf("Replaying events failed: %v", err)
+				return
+			}
+			if len(entries) < eventReplayBatch {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		case entry, ok := <-events:
+			if !ok {
+				return
+			}
+			if replayed[entry.ID] {
+				continue
+			}
+			if err := send(entry); err != nil {
+				log.Printf("Streaming events failed: %v", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type streamedEvent struct {
+	id      string
+	event   string
+	request historyResponse
+}
+
+func TestRequestEvents(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	owner := models.User{Email: "owner@example.com", Role: models.RoleUser}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	bob := models.User{Email: "bob@example.com", Role: models.RoleUser}
+	for _, user := range []*models.User{&owner, &alice, &bob} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	site := models.Site{URL: "https://wiki.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.SiteOwner{SiteID: site.ID, UserID: owner.ID}).Error)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Come from the trusted proxy of newTestHandler.
+		r.RemoteAddr = "192.0.2.1:1234"
+		h.HandleRequestEvents(w, r)
+	}))
+	t.Cleanup(server.Close)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	// stream opens the event stream of the user and returns its events as
+	// they arrive.
+	stream := func(email string, lastEventID string) <-chan streamedEvent {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-Email", email)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		t.Cleanup(func() { resp.Body.Close() })
+
+		events := make(chan streamedEvent)
+		go func() {
+			defer close(events)
+			var current streamedEvent
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				field, value, _ := strings.Cut(scanner.Text(), ": ")
+				switch field {
+				case "id":
+					current.id = value
+				case "event":
+					current.event = value
+				case "data":
+					assert.NoError(t, json.Unmarshal([]byte(value), &current.request))
+				case "":
+					if current.id != "" {
+						events <- current
+					}
+					current = streamedEvent{}
+				}
+			}
+		}()
+		return events
+	}
+	next := func(events <-chan streamedEvent) streamedEvent {
+		select {
+		case event, ok := <-events:
+			require.True(t, ok, "stream ended")
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return streamedEvent{}
+		}
+	}
+	request := func(email string) {
+		rr := httptest.NewRecorder()
+		h.HandleRequestSite(rr, requestAs(email, http.MethodPost, "/api/request", `{"redirect": "https://wiki.example.com"}`))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	// The handler subscribes before sending the retry interval, so the streams
+	// are live once their response arrived.
+	ownerEvents := stream(owner.Email, "")
+	bobEvents := stream(bob.Email, "")
+
+	request(alice.Email)
+	created := next(ownerEvents)
+	assert.Equal(t, eventRequestCreated, created.event)
+	assert.Equal(t, alice.Email, created.request.User)
+	assert.Equal(t, strconv.FormatUint(uint64(created.request.ID), 10), created.id)
+
+	request(bob.Email)
+	own := next(bobEvents)
+	assert.Equal(t, bob.Email, own.request.User, "requests of others are not streamed to bob")
+	assert.Equal(t, bob.Email, next(ownerEvents).request.User)
+
+	rr := httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(owner.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://wiki.example.com", "newState": "authorized"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	authorized := next(ownerEvents)
+	assert.Equal(t, eventRequestStateChanged, authorized.event)
+	assert.Equal(t, models.Authorized, authorized.request.ToState)
+
+	// A reconnecting client gets what it missed from the history.
+	replayed := stream(owner.Email, created.id)
+	assert.Equal(t, own.id, next(replayed).id)
+	assert.Equal(t, authorized.id, next(replayed).id)
+
+	req := requestAs(owner.Email, http.MethodGet, "/api/requests/events", "")
+	req.Header.Set("Last-Event-ID", "bogus")
+	rr = httptest.NewRecorder()
+	h.HandleRequestEvents(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// grantExpiry picks the end of a new grant: the approver's choice if given,
+// otherwise the default of the site. A nil result never expires.
+func grantExpiry(site models.Site, requested *time.Time, now time.Time) (*time.Time, error) {
+	if requested != nil {
+		if !requested.After(now) {
+			return nil, errors.New("expiresAt must be in the future")
+		}
+		return requested, nil
+	}
+	if site.DefaultGrantDays > 0 {
+		expiresAt := now.AddDate(0, 0, site.DefaultGrantDays)
+		return &expiresAt, nil
+	}
+	return nil, nil
+}
+
+// ExpireGrants moves authorized grants whose expiry has passed to the expired
+// state. authorize already ignores them, this keeps the stored state honest.
+func (h *Handler) ExpireGrants(now time.Time) (int64, error) {
+	var userSites []models.UserSite
+	if err := h.db.Where("state = ? AND expires_at <= ?", models.Authorized, now).Find(&userSites).Error; err != nil {
+		return 0, err
+	}
+	var expired int64
+	for i := range userSites {
+		err := h.transition(&userSites[i], models.Expired, actorSystem, nil)
+		if errors.Is(err, errIllegalTransition) {
+			// Extended or revoked since it was loaded.
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// RunGrantExpiry calls ExpireGrants every interval until ctx is done.
+func (h *Handler) RunGrantExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired, err := h.ExpireGrants(now)
+			if err != nil {
+				slog.Error("Expiring grants failed", "error", err)
+			} else if expired > 0 {
+				slog.Info("Expired grants", "count", expired)
+			}
+		}
+	}
+}
+
+// HandleRequestExtension lets a user ask for an expiring grant to be
+// extended (POST {"site"}). The ask is recorded as a transition of the grant
+// to itself by its holder, so it reaches the history, webhooks, event
+// streams and approver emails. Approvers see the flag in /api/requests and
+// extend the grant by authorizing it again with a new expiry.
+func (h *Handler) HandleRequestExtension(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Site string `json:"site"`
+	}
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	var body RequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	site, ok := h.siteFromRequest(w, body.Site)
+	if !ok {
+		return
+	}
+
+	var userSite models.UserSite
+	err := h.db.Where(&models.UserSite{UserID: user.ID, SiteID: site.ID}).First(&userSite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		sendJSONError(w, "No access to extend", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if userSite.ExpiresAt == nil || !userSite.Active(now) {
+		sendJSONError(w, "Only active, expiring access can be extended", http.StatusConflict)
+		return
+	}
+	// Asking is no new grant, the reminder already sent stands.
+	err = h.transition(&userSite, models.Authorized, user.Email, map[string]interface{}{
+		"extension_requested_at": now, "expiry_reminded_at": userSite.ExpiryRemindedAt,
+	})
+	if errors.Is(err, errIllegalTransition) {
+		sendJSONError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONSuccess(w, "Extension requested", http.StatusOK)
+}
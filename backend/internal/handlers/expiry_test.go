@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrantExpiry(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	admin := models.User{Email: "admin@example.com", Role: models.RoleSuperAdmin}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	require.NoError(t, db.Create(&admin).Error)
+	require.NoError(t, db.Create(&alice).Error)
+	prod := models.Site{URL: "https://prod.example.com", DefaultGrantDays: 30}
+	require.NoError(t, db.Create(&prod).Error)
+
+	rr := httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(admin.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://prod.example.com", "newState": "authorized"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var userSite models.UserSite
+	require.NoError(t, db.Where(&models.UserSite{UserID: alice.ID, SiteID: prod.ID}).First(&userSite).Error)
+	require.NotNil(t, userSite.ExpiresAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), *userSite.ExpiresAt, time.Minute)
+
+	rr = httptest.NewRecorder()
+	h.HandleRequestExtension(rr, requestAs(alice.Email, http.MethodPost, "/api/request/extend", `{"site": "https://prod.example.com"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.HandleRequests(rr, requestAs(admin.Email, http.MethodGet, "/api/requests", ""))
+	var results []models.UserSiteResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&results))
+	require.Len(t, results, 1)
+	assert.True(t, results[0].ExtensionRequested)
+	assert.NotNil(t, results[0].ExpiresAt)
+
+	// Once the expiry passes, access ends before the background job runs.
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, db.Model(&userSite).Update("expires_at", past).Error)
+	decision, err := h.authorize(nil, alice.Email, prod.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessDenied, decision)
+
+	expired, err := h.ExpireGrants(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), expired)
+	require.NoError(t, db.Where(&models.UserSite{UserID: alice.ID, SiteID: prod.ID}).First(&userSite).Error)
+	assert.Equal(t, models.Expired, userSite.State)
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/policy"
+	"gorm.io/gorm"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// accessTrace records how authorize reached its decision. All methods are
+// no-ops on a nil trace, so the forward-auth path pays nothing for it.
+type accessTrace struct {
+	User        string        `json:"user"`
+	UserFound   bool          `json:"userFound"`
+	Role        models.Role   `json:"role,omitempty"`
+	RoleBypass  bool          `json:"roleBypass"`
+	Site        string        `json:"site"`
+	SiteFound   bool          `json:"siteFound"`
+	Grant       *grantTrace   `json:"grant,omitempty"`
+	GroupGrants []string      `json:"groupGrants"`
+	Policies    []policyTrace `json:"policies"`
+	Decision    string        `json:"decision"`
+
+	// clientIP stands in for the client address of a dry run, whose
+	// synthetic request has no peer to take it from.
+	clientIP string
+}
+
+type grantTrace struct {
+	State         models.State `json:"state"`
+	ExpiresAt     *time.Time   `json:"expiresAt,omitempty"`
+	Active        bool         `json:"active"`
+	DecidedByRule string       `json:"decidedByRule,omitempty"`
+}
+
+type policyTrace struct {
+	Name       string              `json:"name"`
+	Effect     models.PolicyEffect `json:"effect"`
+	Expression string              `json:"expression"`
+	Matched    bool                `json:"matched"`
+	Error      string              `json:"error,omitempty"`
+}
+
+func (t *accessTrace) user(user *models.User) {
+	if t != nil {
+		t.UserFound = true
+		t.Role = user.Role
+	}
+}
+
+func (t *accessTrace) input(input *policy.Input) {
+	if t != nil && t.clientIP != "" {
+		input.Request.IP = t.clientIP
+	}
+}
+
+func (t *accessTrace) roleBypass() {
+	if t != nil {
+		t.RoleBypass = true
+	}
+}
+
+func (t *accessTrace) site(site *models.Site) {
+	if t != nil {
+		t.SiteFound = site != nil
+	}
+}
+
+func (t *accessTrace) grant(userSite models.UserSite, now time.Time) {
+	if t != nil {
+		t.Grant = &grantTrace{
+			State:         userSite.State,
+			ExpiresAt:     userSite.ExpiresAt,
+			Active:        userSite.Active(now),
+			DecidedByRule: userSite.DecidedByRule,
+		}
+	}
+}
+
+// policy evaluates a site policy and records the outcome. Broken policies
+// are logged and count as onError, so a broken deny policy blocks access and
+// a broken allow policy grants none.
+func (t *accessTrace) policy(sitePolicy models.SitePolicy, input *policy.Input, onError bool) bool {
+	matched, err := evaluatePolicy(sitePolicy, input)
+	if err != nil {
+		slog.Warn("Evaluating site policy failed", "policy", sitePolicy.Name, "error", err)
+		matched = onError
+	}
+	if t != nil {
+		entry := policyTrace{Name: sitePolicy.Name, Effect: sitePolicy.Effect, Expression: sitePolicy.Expression, Matched: matched}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		t.Policies = append(t.Policies, entry)
+	}
+	return matched
+}
+
+func (t *accessTrace) decide(decision accessDecision) accessDecision {
+	if t != nil {
+		t.Decision = decision.String()
+	}
+	return decision
+}
+
+// HandleExplain dry-runs forward auth for a user and URL and returns the
+// full decision trace (POST {"user", "url", "method", "ip", "headers"}).
+// The URL is either a site URL or a URL below a site, whose path is then
+// what site policies see. Requires the audit:view permission.
+func (h *Handler) HandleExplain(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		User    string            `json:"user"`
+		URL     string            `json:"url"`
+		Method  string            `json:"method"`
+		IP      string            `json:"ip"`
+		Headers map[string]string `json:"headers"`
+	}
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	var body RequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.User == "" || body.URL == "" {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	siteURL, forwarded, err := h.explainRequest(body.URL)
+	if err != nil {
+		sendJSONError(w, "Invalid url", http.StatusBadRequest)
+		return
+	}
+	if body.Method != "" {
+		forwarded.Header.Set("X-Forwarded-Method", body.Method)
+	}
+	for name, value := range body.Headers {
+		forwarded.Header.Set(name, value)
+	}
+
+	trace := &accessTrace{User: body.User, Site: siteURL, GroupGrants: []string{}, Policies: []policyTrace{}, clientIP: body.IP}
+	if _, err := h.decide(forwarded, body.User, siteURL, trace); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, trace, http.StatusOK)
+}
+
+// explainRequest finds the site a URL belongs to and builds the forwarded
+// request Traefik would send for it.
+func (h *Handler) explainRequest(rawURL string) (string, *http.Request, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return "", nil, errors.New("invalid url")
+	}
+	siteURL := rawURL
+	site, err := h.findSite(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	if site == nil {
+		siteURL = parsed.Scheme + "://" + parsed.Host
+	}
+	forwarded := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/api/authenticate"},
+		Host:   parsed.Host,
+		Header: http.Header{},
+	}
+	forwarded.Header.Set("X-Forwarded-Method", http.MethodGet)
+	forwarded.Header.Set("X-Forwarded-Host", parsed.Host)
+	forwarded.Header.Set("X-Forwarded-Uri", parsed.RequestURI())
+	return siteURL, forwarded, nil
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleExplain(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	auditor := models.User{Email: "auditor@example.com", Role: models.RoleAuditor}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	require.NoError(t, db.Create(&auditor).Error)
+	require.NoError(t, db.Create(&alice).Error)
+	site := models.Site{URL: "https://grafana.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.UserSite{UserID: alice.ID, SiteID: site.ID, State: models.Authorized}).Error)
+	require.NoError(t, db.Create(&models.SitePolicy{SiteID: site.ID, Name: "no-admin-ui", Effect: models.PolicyDeny,
+		Expression: `request.path.startsWith("/admin")`}).Error)
+
+	explain := func(caller string, body string) (*httptest.ResponseRecorder, accessTrace) {
+		rr := httptest.NewRecorder()
+		h.HandleExplain(rr, requestAs(caller, http.MethodPost, "/api/explain", body))
+		var trace accessTrace
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&trace))
+		}
+		return rr, trace
+	}
+
+	rr, _ := explain(alice.Email, `{"user": "alice@example.com", "url": "https://grafana.example.com"}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	_, trace := explain(auditor.Email, `{"user": "alice@example.com", "url": "https://grafana.example.com/d/overview"}`)
+	assert.Equal(t, "granted", trace.Decision)
+	assert.Equal(t, site.URL, trace.Site)
+	assert.True(t, trace.SiteFound)
+	require.NotNil(t, trace.Grant)
+	assert.Equal(t, models.Authorized, trace.Grant.State)
+	require.Len(t, trace.Policies, 1)
+	assert.False(t, trace.Policies[0].Matched)
+
+	_, trace = explain(auditor.Email, `{"user": "alice@example.com", "url": "https://grafana.example.com/admin/users"}`)
+	assert.Equal(t, "denied", trace.Decision)
+	require.Len(t, trace.Policies, 1)
+	assert.True(t, trace.Policies[0].Matched)
+	require.NotNil(t, trace.Grant)
+	assert.True(t, trace.Grant.Active, "the grant is still shown when a deny policy wins")
+
+	_, trace = explain(auditor.Email, `{"user": "nobody@example.com", "url": "https://grafana.example.com"}`)
+	assert.False(t, trace.UserFound)
+	assert.Equal(t, "denied", trace.Decision)
+
+	office := models.Site{URL: "https://wiki.example.com"}
+	require.NoError(t, db.Create(&office).Error)
+	require.NoError(t, db.Create(&models.SitePolicy{SiteID: office.ID, Name: "office-network", Effect: models.PolicyAllow,
+		Expression: `request.ip == "10.1.2.3"`}).Error)
+
+	_, trace = explain(auditor.Email, `{"user": "alice@example.com", "url": "https://wiki.example.com", "ip": "10.1.2.3"}`)
+	assert.Equal(t, "granted", trace.Decision)
+	require.Len(t, trace.Policies, 1)
+	assert.True(t, trace.Policies[0].Matched)
+
+	_, trace = explain(auditor.Email, `{"user": "alice@example.com", "url": "https://wiki.example.com"}`)
+	assert.Equal(t, "not_requested", trace.Decision)
+}
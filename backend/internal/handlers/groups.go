@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// claimSyncInterval is how often unchanged group claims of a user are synced
+// again per instance, picking up groups created in the meantime. Forward
+// auth runs on every request to a site.
+const claimSyncInterval = time.Minute
+
+// claimSync is the last group claim sync of a user.
+type claimSync struct {
+	claims string
+	at     time.Time
+}
+
+type groupResponse struct {
+	ID          uint     `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`
+	Sites       []string `json:"sites"`
+}
+
+// HandleGroups lists (GET), creates (POST) and deletes (DELETE ?name=)
+// groups. Requires the groups:manage permission.
+func (h *Handler) HandleGroups(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requirePermission(w, r, models.PermManageGroups); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var groups []models.Group
+		if err := h.db.Order("name").Find(&groups).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		results := make([]groupResponse, 0, len(groups))
+		for _, group := range groups {
+			result := groupResponse{ID: group.ID, Name: group.Name, Description: group.Description, Members: []string{}, Sites: []string{}}
+			err := h.db.Model(&models.User{}).
+				Joins("JOIN group_members ON group_members.user_id = users.id").
+				Where("group_members.group_id = ?", group.ID).
+				Order("users.email").
+				Pluck("users.email", &result.Members).Error
+			if err == nil {
+				err = h.db.Model(&models.Site{}).
+					Joins("JOIN group_sites ON group_sites.site_id = sites.id").
+					Where("group_sites.group_id = ?", group.ID).
+					Order("sites.url").
+					Pluck("sites.url", &result.Sites).Error
+			}
+			if err != nil {
+				log.Printf("Database error: %v", err)
+				sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			results = append(results, result)
+		}
+		sendJSONResponse(w, results, http.StatusOK)
+	case http.MethodPost:
+		var group models.Group
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil || strings.TrimSpace(group.Name) == "" {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		group.ID = 0
+		group.Name = strings.TrimSpace(group.Name)
+		if existing, _ := h.findGroup(group.Name); existing != nil {
+			sendJSONError(w, "Group already exists", http.StatusConflict)
+			return
+		}
+		if err := h.db.Create(&group).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, group, http.StatusCreated)
+	case http.MethodDelete:
+		group, ok := h.groupFromRequest(w, r.URL.Query().Get("name"))
+		if !ok {
+			return
+		}
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("group_id = ?", group.ID).Delete(&models.GroupMember{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("group_id = ?", group.ID).Delete(&models.GroupSite{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("group_id = ?", group.ID).Delete(&models.SiteApproverGroup{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("group_id = ?", group.ID).Delete(&models.SiteApprovalGroup{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(group).Error
+		})
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONSuccess(w, "Group deleted", http.StatusOK)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleGroupMembers adds (POST {"group", "email"}) and removes
+// (DELETE ?group=&email=) group members. Requires the groups:manage permission.
+func (h *Handler) HandleGroupMembers(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Group string `json:"group"`
+		Email string `json:"email"`
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageGroups); !ok {
+		return
+	}
+	var body RequestBody
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		body = RequestBody{Group: r.URL.Query().Get("group"), Email: r.URL.Query().Get("email")}
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	group, ok := h.groupFromRequest(w, body.Group)
+	if !ok {
+		return
+	}
+	var user models.User
+	if err := h.db.Where("email = ?", body.Email).First(&user).Error; err != nil {
+		sendJSONError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	member := models.GroupMember{GroupID: group.ID, UserID: user.ID}
+	var err error
+	if r.Method == http.MethodPost {
+		// A manual membership takes over one that was synced from SSO, so it
+		// survives the next sync.
+		err = h.db.Where(&member).Assign(models.GroupMember{Source: models.GroupSourceManual}).FirstOrCreate(&member).Error
+	} else {
+		err = h.db.Where(&member).Delete(&models.GroupMember{}).Error
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONSuccess(w, "Group members updated", http.StatusOK)
+}
+
+// HandleGroupSites grants (POST {"group", "siteURL"}) and revokes
+// (DELETE ?group=&site=) sites for all members of a group. Requires the groups:manage
+// permission.
+func (h *Handler) HandleGroupSites(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Group   string `json:"group"`
+		SiteURL string `json:"siteURL"`
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageGroups); !ok {
+		return
+	}
+	var body RequestBody
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.SiteURL == "" {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		body = RequestBody{Group: r.URL.Query().Get("group"), SiteURL: r.URL.Query().Get("site")}
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	group, ok := h.groupFromRequest(w, body.Group)
+	if !ok {
+		return
+	}
+	var err error
+	if r.Method == http.MethodPost {
+		var site models.Site
+		if err = h.db.Where(models.Site{URL: body.SiteURL}).FirstOrCreate(&site).Error; err == nil {
+			grant := models.GroupSite{GroupID: group.ID, SiteID: site.ID}
+			err = h.db.Where(&grant).FirstOrCreate(&grant).Error
+		}
+	} else {
+		site, findErr := h.findSite(body.SiteURL)
+		if findErr != nil || site == nil {
+			sendJSONError(w, "Site not found", http.StatusNotFound)
+			return
+		}
+		err = h.db.Where("group_id = ? AND site_id = ?", group.ID, site.ID).Delete(&models.GroupSite{}).Error
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONSuccess(w, "Group sites updated", http.StatusOK)
+}
+
+// syncClaimGroupsThrottled syncs the group claims of a user unless this
+// instance synced the same claims within claimSyncInterval.
+func (h *Handler) syncClaimGroupsThrottled(userID uint, claims []string, now time.Time) error {
+	sorted := slices.Clone(claims)
+	slices.Sort(sorted)
+	key := strings.Join(sorted, "\n")
+	if last, ok := h.claimSyncs.Load(userID); ok {
+		if last := last.(claimSync); last.claims == key && now.Sub(last.at) < claimSyncInterval {
+			return nil
+		}
+	}
+	if err := h.syncClaimGroups(userID, claims); err != nil {
+		return err
+	}
+	h.claimSyncs.Store(userID, claimSync{claims: key, at: now})
+	return nil
+}
+
+// syncClaimGroups makes the SSO memberships of a user match the group claims
+// of the upstream identity. Claims naming unknown groups are ignored and
+// memberships managed through the API are left alone.
+func (h *Handler) syncClaimGroups(userID uint, claims []string) error {
+	var groups []models.Group
+	if len(claims) > 0 {
+		if err := h.db.Where("name IN ?", claims).Find(&groups).Error; err != nil {
+			return err
+		}
+	}
+	var memberships []models.GroupMember
+	if err := h.db.Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		return err
+	}
+
+	wanted := make(map[uint]bool, len(groups))
+	for _, group := range groups {
+		wanted[group.ID] = true
+	}
+	current := make(map[uint]models.GroupMember, len(memberships))
+	var removed []uint
+	for _, membership := range memberships {
+		current[membership.GroupID] = membership
+		if membership.Source == models.GroupSourceSSO && !wanted[membership.GroupID] {
+			removed = append(removed, membership.GroupID)
+		}
+	}
+	var added []uint
+	for groupID := range wanted {
+		if _, ok := current[groupID]; !ok {
+			added = append(added, groupID)
+		}
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		for _, groupID := range removed {
+			if err := tx.Where(&models.GroupMember{GroupID: groupID, UserID: userID}).Delete(&models.GroupMember{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, groupID := range added {
+			if err := tx.Create(&models.GroupMember{GroupID: groupID, UserID: userID, Source: models.GroupSourceSSO}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (h *Handler) findGroup(name string) (*models.Group, error) {
+	var group models.Group
+	err := h.db.Where("name = ?", name).First(&group).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// groupFromRequest resolves a group named in a request and answers with an
+// error when it does not exist.
+func (h *Handler) groupFromRequest(w http.ResponseWriter, name string) (*models.Group, bool) {
+	group, err := h.findGroup(name)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if group == nil {
+		sendJSONError(w, "Group not found", http.StatusNotFound)
+		return nil, false
+	}
+	return group, true
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizeGroupGrants(t *testing.T) {
+	db := setupTestDatabase()
+	h := &Handler{db: db}
+
+	user := models.User{Email: "alice@example.com", Role: "user"}
+	require.NoError(t, db.Create(&user).Error)
+	wiki := models.Site{URL: "https://wiki.example.com"}
+	grafana := models.Site{URL: "https://grafana.example.com"}
+	require.NoError(t, db.Create(&wiki).Error)
+	require.NoError(t, db.Create(&grafana).Error)
+	group := models.Group{Name: "platform"}
+	require.NoError(t, db.Create(&group).Error)
+	require.NoError(t, db.Create(&models.GroupSite{GroupID: group.ID, SiteID: wiki.ID}).Error)
+	require.NoError(t, db.Create(&models.UserSite{UserID: user.ID, SiteID: grafana.ID, State: models.Declined}).Error)
+
+	decision, err := h.authorize(nil, user.Email, wiki.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessNotRequested, decision)
+
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: group.ID, UserID: user.ID, Source: models.GroupSourceManual}).Error)
+	decision, err = h.authorize(nil, user.Email, wiki.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessGranted, decision)
+
+	decision, err = h.authorize(nil, user.Email, grafana.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessDenied, decision)
+}
+
+func TestSyncClaimGroups(t *testing.T) {
+	db := setupTestDatabase()
+	h := &Handler{db: db}
+
+	user := models.User{Email: "alice@example.com", Role: "user"}
+	require.NoError(t, db.Create(&user).Error)
+	groups := map[string]*models.Group{}
+	for _, name := range []string{"oncall", "platform", "manual"} {
+		group := &models.Group{Name: name}
+		require.NoError(t, db.Create(group).Error)
+		groups[name] = group
+	}
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: groups["manual"].ID, UserID: user.ID, Source: models.GroupSourceManual}).Error)
+
+	memberOf := func() map[string]string {
+		var members []models.GroupMember
+		require.NoError(t, db.Where("user_id = ?", user.ID).Find(&members).Error)
+		result := map[string]string{}
+		for _, member := range members {
+			for name, group := range groups {
+				if group.ID == member.GroupID {
+					result[name] = member.Source
+				}
+			}
+		}
+		return result
+	}
+
+	require.NoError(t, h.syncClaimGroups(user.ID, []string{"oncall", "platform", "unknown"}))
+	assert.Equal(t, map[string]string{"oncall": "sso", "platform": "sso", "manual": "manual"}, memberOf())
+
+	require.NoError(t, h.syncClaimGroups(user.ID, []string{"platform"}))
+	assert.Equal(t, map[string]string{"platform": "sso", "manual": "manual"}, memberOf())
+
+	require.NoError(t, h.syncClaimGroups(user.ID, []string{}))
+	assert.Equal(t, map[string]string{"manual": "manual"}, memberOf())
+
+	// Forward auth only syncs again when the claims change or a while passed.
+	now := time.Now()
+	require.NoError(t, h.syncClaimGroupsThrottled(user.ID, []string{"platform", "oncall"}, now))
+	require.NoError(t, db.Where("user_id = ? AND source = ?", user.ID, models.GroupSourceSSO).Delete(&models.GroupMember{}).Error)
+	require.NoError(t, h.syncClaimGroupsThrottled(user.ID, []string{"oncall", "platform"}, now.Add(time.Second)))
+	assert.Equal(t, map[string]string{"manual": "manual"}, memberOf())
+	require.NoError(t, h.syncClaimGroupsThrottled(user.ID, []string{"oncall"}, now.Add(time.Second)))
+	assert.Equal(t, map[string]string{"oncall": "sso", "manual": "manual"}, memberOf())
+	require.NoError(t, h.syncClaimGroupsThrottled(user.ID, []string{"oncall", "platform"}, now.Add(2*claimSyncInterval)))
+	assert.Equal(t, map[string]string{"oncall": "sso", "platform": "sso", "manual": "manual"}, memberOf())
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/util"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// newHeaderAuthenticator enables the trusted upstream header mode when
+// AUTH_MODE is "header". In this mode an SSO gateway in front of Traefik
+// authenticates users and KubeVoyage only decides per-site access.
+func newHeaderAuthenticator(trustedProxies auth.TrustedProxies) (*auth.HeaderAuthenticator, error) {
+	mode, _ := util.GetEnvOrDefault("AUTH_MODE", "session")
+	switch mode {
+	case "session":
+		return nil, nil
+	case "header":
+	default:
+		return nil, fmt.Errorf("unsupported AUTH_MODE: %s", mode)
+	}
+
+	header, _ := util.GetEnvOrDefault("TRUSTED_HEADER", "X-Forwarded-Email")
+	groupsHeader, _ := util.GetEnvOrDefault("TRUSTED_GROUPS_HEADER", "")
+	secret, _ := util.GetEnvOrDefault("TRUSTED_HEADER_SECRET", "")
+	signatureHeader, _ := util.GetEnvOrDefault("TRUSTED_HEADER_SIGNATURE", auth.DefaultSignatureHeader)
+	if len(trustedProxies) == 0 && secret == "" {
+		return nil, errors.New("AUTH_MODE=header requires TRUSTED_PROXY_CIDRS or TRUSTED_HEADER_SECRET")
+	}
+	return &auth.HeaderAuthenticator{
+		Header:          header,
+		GroupsHeader:    groupsHeader,
+		TrustedProxies:  trustedProxies,
+		Secret:          []byte(secret),
+		SignatureHeader: signatureHeader,
+	}, nil
+}
+
+// headerUser returns the user asserted by the trusted upstream, creating a
+// password-less account on first sight and syncing its group claims. It
+// returns an empty string when the request carries no trustworthy identity.
+func (h *Handler) headerUser(r *http.Request) (string, error) {
+	identity, err := h.upstream.Identity(r)
+	if err != nil {
+		slog.Warn("Ignoring identity header", "remote", r.RemoteAddr, "error", err)
+		return "", nil
+	}
+	if identity.Email == "" {
+		return "", nil
+	}
+	user, err := h.ensurePrincipal(identity.Email, models.KindUser)
+	if errors.Is(err, errPrincipalKind) {
+		slog.Warn("Ignoring identity header naming a non-user principal", "email", identity.Email)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !user.EmailVerified {
+		if err := h.markEmailVerified(user.Email); err != nil {
+			return "", err
+		}
+	}
+	if identity.Groups != nil {
+		if err := h.syncClaimGroupsThrottled(user.ID, identity.Groups, time.Now()); err != nil {
+			return "", err
+		}
+	}
+	return user.Email, nil
+}
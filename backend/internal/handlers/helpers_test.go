@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+
+	application "github.com/B-Urb/KubeVoyage/internal/app"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"golang.org/x/crypto/scrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var testDatabaseCounter atomic.Int64
+
+// setupTestDatabase returns a fresh, fully migrated in-memory database.
+func setupTestDatabase() *gorm.DB {
+	dsn := fmt.Sprintf("file:kubevoyage-test-%d?mode=memory&cache=shared", testDatabaseCounter.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		panic(err)
+	}
+	if err := (&application.App{DB: db}).Init(); err != nil {
+		panic(err)
+	}
+	return db
+}
+
+func hashTestPassword(password string) (string, error) {
+	hash, err := scrypt.Key([]byte(password), nil, 16384, 8, 1, 32)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash), nil
+}
+
+// newTestHandler returns a handler that trusts the X-Forwarded-Email header
+// of httptest requests, so tests can act as any user without a session.
+func newTestHandler(db *gorm.DB) *Handler {
+	proxies, err := auth.ParseTrustedProxies([]string{"192.0.2.0/24"})
+	if err != nil {
+		panic(err)
+	}
+	return &Handler{db: db, upstream: &auth.HeaderAuthenticator{Header: "X-Forwarded-Email", TrustedProxies: proxies},
+		trustedProxies: proxies, events: newEventHub()}
+}
+
+// requestAs builds a request made by the given user for a newTestHandler.
+func requestAs(email string, method string, target string, body string) *http.Request {
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+	}
+	req.Header.Set("X-Forwarded-Email", email)
+	return req
+}
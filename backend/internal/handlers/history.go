@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+type historyResponse struct {
+	ID        uint         `json:"id"`
+	User      string       `json:"user"`
+	Site      string       `json:"site"`
+	Actor     string       `json:"actor"`
+	FromState models.State `json:"from"`
+	ToState   models.State `json:"to"`
+	Reason    string       `json:"reason,omitempty"`
+	Rule      string       `json:"rule,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// newHistoryResponse describes a single history entry.
+func newHistoryResponse(db *gorm.DB, entry *models.RequestHistory) (historyResponse, error) {
+	var user models.User
+	var site models.Site
+	if err := db.Select("email").First(&user, entry.UserID).Error; err != nil {
+		return historyResponse{}, err
+	}
+	if err := db.Select("url").First(&site, entry.SiteID).Error; err != nil {
+		return historyResponse{}, err
+	}
+	return historyResponse{
+		ID:        entry.ID,
+		User:      user.Email,
+		Site:      site.URL,
+		Actor:     entry.Actor,
+		FromState: entry.FromState,
+		ToState:   entry.ToState,
+		Reason:    entry.Reason,
+		Rule:      entry.Rule,
+		CreatedAt: entry.CreatedAt,
+	}, nil
+}
+
+// paginate orders a query newest first by its id column. ?before= pages
+// through older entries by id and ?limit= caps the page size.
+func paginate(r *http.Request, query *gorm.DB, idColumn string) (*gorm.DB, bool) {
+	limit := defaultHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return nil, false
+		}
+		limit = min(parsed, maxHistoryLimit)
+	}
+	query = query.Order(idColumn + " DESC").Limit(limit)
+	if value := r.URL.Query().Get("before"); value != "" {
+		before, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		query = query.Where(idColumn+" < ?", before)
+	}
+	return query, true
+}
+
+// historyQuery selects a page of history entries, joined with the emails and
+// URLs they refer to.
+func (h *Handler) historyQuery(r *http.Request) (*gorm.DB, bool) {
+	query := h.db.Table("request_histories").
+		Select("request_histories.id as id, users.email as user, sites.url as site, request_histories.actor as actor, " +
+			"request_histories.from_state as from_state, request_histories.to_state as to_state, request_histories.reason as reason, " +
+			"request_histories.rule as rule, request_histories.created_at as created_at").
+		Joins("JOIN users ON users.id = request_histories.user_id").
+		Joins("JOIN sites ON sites.id = request_histories.site_id")
+	if site := r.URL.Query().Get("site"); site != "" {
+		query = query.Where("sites.url = ?", site)
+	}
+	return paginate(r, query, "request_histories.id")
+}
+
+func sendHistory(w http.ResponseWriter, query *gorm.DB) {
+	results := []historyResponse{}
+	if err := query.Scan(&results).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, results, http.StatusOK)
+}
+
+// HandleHistory lists the history of all requests, newest first
+// (GET [?user=][&site=][&actor=][&before=][&limit=]). Requires the
+// audit:view permission.
+func (h *Handler) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermViewAudit); !ok {
+		return
+	}
+	query, ok := h.historyQuery(r)
+	if !ok {
+		sendJSONError(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	if user := r.URL.Query().Get("user"); user != "" {
+		query = query.Where("users.email = ?", user)
+	}
+	if actor := r.URL.Query().Get("actor"); actor != "" {
+		query = query.Where("request_histories.actor = ?", actor)
+	}
+	sendHistory(w, query)
+}
+
+// HandleRequestHistory lists the history of the caller's own requests,
+// newest first (GET [?site=][&before=][&limit=]).
+func (h *Handler) HandleRequestHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	query, ok := h.historyQuery(r)
+	if !ok {
+		sendJSONError(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	sendHistory(w, query.Where("request_histories.user_id = ?", user.ID))
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestHistory(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	auditor := models.User{Email: "auditor@example.com", Role: models.RoleAuditor}
+	approver := models.User{Email: "approver@example.com", Role: models.RoleApprover}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	bob := models.User{Email: "bob@example.com", Role: models.RoleUser}
+	for _, user := range []*models.User{&auditor, &approver, &alice, &bob} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	require.NoError(t, db.Create(&models.ApprovalRule{Name: "decline-bob", SiteURL: "https://wiki.example.com",
+		EmailDomain: "example.com", Action: models.RuleDecline, Priority: 10}).Error)
+
+	serve := func(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, r)
+		return rr
+	}
+	history := func(handler http.HandlerFunc, caller string, target string) []historyResponse {
+		rr := serve(handler, requestAs(caller, http.MethodGet, target, ""))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var entries []historyResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&entries))
+		return entries
+	}
+
+	serve(h.HandleRequestSite, requestAs(alice.Email, http.MethodPost, "/api/request", `{"redirect": "https://prod.example.com", "justification": "INC-7"}`))
+	serve(h.HandleUpdateSiteState, requestAs(approver.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://prod.example.com", "newState": "authorized", "reason": "On call"}`))
+	serve(h.HandleUpdateSiteState, requestAs(approver.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://prod.example.com", "newState": "revoked", "reason": "Incident over"}`))
+	serve(h.HandleRequestSite, requestAs(bob.Email, http.MethodPost, "/api/request", `{"redirect": "https://wiki.example.com"}`))
+
+	assert.Equal(t, http.StatusForbidden, serve(h.HandleHistory, requestAs(alice.Email, http.MethodGet, "/api/history", "")).Code)
+
+	entries := history(h.HandleHistory, auditor.Email, "/api/history?user=alice@example.com")
+	require.Len(t, entries, 3)
+	assert.Equal(t, historyResponse{ID: entries[0].ID, User: alice.Email, Site: "https://prod.example.com", Actor: approver.Email,
+		FromState: models.Authorized, ToState: models.Revoked, Reason: "Incident over", CreatedAt: entries[0].CreatedAt}, entries[0])
+	assert.Equal(t, models.Authorized, entries[1].ToState)
+	assert.Equal(t, "On call", entries[1].Reason)
+	assert.Equal(t, models.State(""), entries[2].FromState)
+	assert.Equal(t, models.Requested, entries[2].ToState)
+	assert.Equal(t, "INC-7", entries[2].Reason)
+	assert.Equal(t, alice.Email, entries[2].Actor)
+
+	entries = history(h.HandleHistory, auditor.Email, "/api/history?actor=rule:decline-bob")
+	require.Len(t, entries, 1)
+	assert.Equal(t, bob.Email, entries[0].User)
+	assert.Equal(t, models.Declined, entries[0].ToState)
+	assert.Equal(t, "decline-bob", entries[0].Rule)
+
+	entries = history(h.HandleHistory, auditor.Email, "/api/history?limit=2")
+	require.Len(t, entries, 2)
+	older := history(h.HandleHistory, auditor.Email, fmt.Sprintf("/api/history?before=%d", entries[1].ID))
+	assert.Len(t, older, 3)
+
+	entries = history(h.HandleRequestHistory, bob.Email, "/api/request/history")
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, bob.Email, entry.User)
+	}
+}
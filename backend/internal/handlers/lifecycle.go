@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Actors recorded for transitions not made by a user.
+const (
+	actorSystem     = "system"
+	actorRulePrefix = "rule:"
+)
+
+// errIllegalTransition is returned by transition when the request may not
+// move to the wanted state, including when it changed in the meantime.
+var errIllegalTransition = errors.New("illegal state transition")
+
+// findUserSite loads a request. Requests that do not exist yet come back
+// with the empty state, which transition treats as new.
+func (h *Handler) findUserSite(userID uint, siteID uint) (*models.UserSite, error) {
+	userSite := &models.UserSite{}
+	err := h.db.Where(&models.UserSite{UserID: userID, SiteID: siteID}).Limit(1).Find(userSite).Error
+	userSite.UserID, userSite.SiteID = userID, siteID
+	return userSite, err
+}
+
+// transition moves a request to the next state if the state machine allows
+// it, records who did it and when in the request and its history, stores the
+// extra fields along with it, queues the webhooks subscribed to it and
+// publishes it to the event streams once committed. The update only applies
+// while the request is still in the state it was loaded in, so concurrent
+// decisions cannot both win.
+func (h *Handler) transition(userSite *models.UserSite, next models.State, actor string, fields map[string]interface{}) error {
+	from := userSite.State
+	if !from.CanTransitionTo(next) {
+		return fmt.Errorf("%w from %s to %s", errIllegalTransition, displayState(from), next)
+	}
+	now := time.Now()
+	update := map[string]interface{}{"state": next, "state_changed_at": now, "state_changed_by": actor}
+	if next == models.Authorized {
+		// A new grant deserves a new reminder before it expires.
+		update["expiry_reminded_at"] = nil
+	}
+	for column, value := range fields {
+		update[column] = value
+	}
+
+	key := models.UserSite{UserID: userSite.UserID, SiteID: userSite.SiteID}
+	var entry *models.RequestHistory
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if from == "" {
+			if err := tx.Where(&key).Attrs(models.UserSite{State: next}).FirstOrCreate(&key).Error; err != nil {
+				return err
+			}
+			if key.State != next {
+				return fmt.Errorf("%w: request was created concurrently", errIllegalTransition)
+			}
+		}
+		result := tx.Model(&models.UserSite{}).
+			Where("user_id = ? AND site_id = ? AND state = ?", key.UserID, key.SiteID, stateOrNext(from, next)).
+			Updates(update)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w: request changed concurrently", errIllegalTransition)
+		}
+		entry = historyEntry(key.UserID, key.SiteID, from, next, actor, fields, now)
+		if err := appendHistory(tx, entry); err != nil {
+			return err
+		}
+		return h.enqueueWebhooks(tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	h.events.publish(entry)
+	return h.db.Where(&key).First(userSite).Error
+}
+
+// historyEntry describes a transition for the request history. The reason
+// is the decision reason or, for requests, the justification.
+func historyEntry(userID uint, siteID uint, from models.State, next models.State, actor string, fields map[string]interface{}, at time.Time) *models.RequestHistory {
+	entry := &models.RequestHistory{UserID: userID, SiteID: siteID, Actor: actor, FromState: from, ToState: next, CreatedAt: at}
+	if reason, ok := fields["decision_reason"].(string); ok && reason != "" {
+		entry.Reason = reason
+	} else if justification, ok := fields["justification"].(string); ok {
+		entry.Reason = justification
+	}
+	if rule, ok := fields["decided_by_rule"].(string); ok {
+		entry.Rule = rule
+	}
+	return entry
+}
+
+// appendHistory adds an entry to the request history.
+func appendHistory(tx *gorm.DB, entry *models.RequestHistory) error {
+	return tx.Create(entry).Error
+}
+
+// stateOrNext is the state a request is in right before its update: new
+// requests have just been created in the next state.
+func stateOrNext(from models.State, next models.State) models.State {
+	if from == "" {
+		return next
+	}
+	return from
+}
+
+// HandleWithdrawRequest lets users take back their own pending request
+// (POST {"site"}).
+func (h *Handler) HandleWithdrawRequest(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Site string `json:"site"`
+	}
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	var body RequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	site, ok := h.siteFromRequest(w, body.Site)
+	if !ok {
+		return
+	}
+	userSite, err := h.findUserSite(user.ID, site.ID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if userSite.State == "" {
+		sendJSONError(w, "No request to withdraw", http.StatusNotFound)
+		return
+	}
+	err = h.transition(userSite, models.Withdrawn, user.Email, nil)
+	if errors.Is(err, errIllegalTransition) {
+		sendJSONError(w, "Only pending requests can be withdrawn", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = h.clearApprovals(user.ID, site.ID)
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONSuccess(w, "Request withdrawn", http.StatusOK)
+}
+
+// displayState names a state for error messages.
+func displayState(state models.State) string {
+	if state == "" {
+		return "new"
+	}
+	return string(state)
+}
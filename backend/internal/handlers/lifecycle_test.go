@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLifecycle(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin}
+	owner := models.User{Email: "owner@example.com", Role: models.RoleUser}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	for _, user := range []*models.User{&admin, &owner, &alice} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	site := models.Site{URL: "https://wiki.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.SiteApprover{SiteID: site.ID, UserID: owner.ID}).Error)
+
+	request := func() {
+		rr := httptest.NewRecorder()
+		h.HandleRequestSite(rr, requestAs(alice.Email, http.MethodPost, "/api/request", `{"redirect": "https://wiki.example.com"}`))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	decide := func(approver string, state models.State) int {
+		rr := httptest.NewRecorder()
+		h.HandleUpdateSiteState(rr, requestAs(approver, http.MethodPost, "/api/requests/update",
+			`{"userEmail": "alice@example.com", "siteURL": "https://wiki.example.com", "newState": "`+string(state)+`"}`))
+		return rr.Code
+	}
+	withdraw := func() int {
+		rr := httptest.NewRecorder()
+		h.HandleWithdrawRequest(rr, requestAs(alice.Email, http.MethodPost, "/api/request/withdraw", `{"site": "https://wiki.example.com"}`))
+		return rr.Code
+	}
+	current := func() models.UserSite {
+		var userSite models.UserSite
+		require.NoError(t, db.Where("user_id = ? AND site_id = ?", alice.ID, site.ID).First(&userSite).Error)
+		return userSite
+	}
+
+	assert.Equal(t, http.StatusNotFound, withdraw())
+	request()
+	assert.Equal(t, models.Requested, current().State)
+	assert.Equal(t, alice.Email, current().StateChangedBy)
+	assert.NotNil(t, current().StateChangedAt)
+
+	assert.Equal(t, http.StatusOK, withdraw())
+	assert.Equal(t, models.Withdrawn, current().State)
+	assert.Equal(t, http.StatusConflict, withdraw())
+	assert.Equal(t, http.StatusConflict, decide(owner.Email, models.Declined), "withdrawn requests cannot be declined")
+
+	request()
+	assert.Equal(t, http.StatusOK, decide(owner.Email, models.Declined))
+	request()
+	assert.Equal(t, models.Requested, current().State, "declined requests can be asked for again")
+	assert.Equal(t, http.StatusOK, decide(owner.Email, models.Authorized))
+	assert.Equal(t, owner.Email, current().StateChangedBy)
+	assert.Equal(t, http.StatusConflict, withdraw(), "granted access is revoked, not withdrawn")
+	assert.Equal(t, http.StatusConflict, decide(owner.Email, models.Declined), "granted access is revoked, not declined")
+	assert.Equal(t, http.StatusForbidden, decide(owner.Email, models.Revoked), "site approvers cannot revoke")
+	assert.Equal(t, http.StatusBadRequest, decide(admin.Email, models.Expired))
+
+	assert.Equal(t, http.StatusOK, decide(admin.Email, models.Revoked))
+	assert.Equal(t, models.Revoked, current().State)
+	assert.Equal(t, admin.Email, current().StateChangedBy)
+	decision, err := h.authorize(nil, alice.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessDenied, decision)
+
+	request()
+	assert.Equal(t, models.Requested, current().State, "revoked access can be asked for again")
+
+	rr := httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(admin.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://wikki.example.com", "newState": "authorized"}`))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	var sites int64
+	require.NoError(t, db.Model(&models.Site{}).Where("url = ?", "https://wikki.example.com").Count(&sites).Error)
+	assert.Zero(t, sites, "decisions do not create sites")
+}
+
+func TestStateTransitions(t *testing.T) {
+	assert.True(t, models.State("").CanTransitionTo(models.Requested))
+	assert.True(t, models.Requested.CanTransitionTo(models.PendingSecondApproval))
+	assert.True(t, models.PendingSecondApproval.CanTransitionTo(models.Authorized))
+	assert.True(t, models.Authorized.CanTransitionTo(models.Authorized))
+	assert.False(t, models.Authorized.CanTransitionTo(models.Withdrawn))
+	assert.True(t, models.Declined.CanTransitionTo(models.Requested))
+	assert.False(t, models.Declined.CanTransitionTo(models.Withdrawn))
+	assert.False(t, models.Expired.CanTransitionTo(models.Revoked))
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// siteUseInterval is how often the last use of a site is written per user
+// and instance. Forward auth runs on every request to a site.
+const siteUseInterval = time.Minute
+
+// myAccessEntry is one site in the caller's portal: the state of their
+// request for it, when they last used it and whether and why they can reach
+// it now.
+type myAccessEntry struct {
+	Site        string     `json:"site"`
+	State       string     `json:"state,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+	Access      bool       `json:"access"`
+	Sources     []string   `json:"sources"`
+	Conditional bool       `json:"conditional"`
+}
+
+// accessCheck answers the request page polling for a decision.
+type accessCheck struct {
+	Site      string     `json:"site"`
+	State     string     `json:"state,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Access    bool       `json:"access"`
+	Redirect  string     `json:"redirect,omitempty"`
+}
+
+// recordSiteUse remembers that the user got through to the site. Failures
+// are logged; they must not fail the forward-auth request.
+func (h *Handler) recordSiteUse(email string, siteURL string, now time.Time) {
+	key := email + "\n" + siteURL
+	if last, ok := h.siteUses.Load(key); ok && now.Sub(last.(time.Time)) < siteUseInterval {
+		return
+	}
+	h.siteUses.Store(key, now)
+	site, err := h.findSite(siteURL)
+	var user models.User
+	if err == nil && site != nil {
+		err = h.db.Where("email = ?", email).First(&user).Error
+	}
+	if err == nil && site != nil {
+		use := models.SiteUse{UserID: user.ID, SiteID: site.ID}
+		err = h.db.Where(&use).Assign(models.SiteUse{LastUsedAt: now}).FirstOrCreate(&use).Error
+	}
+	if err != nil {
+		slog.Error("Recording site use failed", "user", email, "site", siteURL, "error", err)
+	}
+}
+
+// HandleMyAccess lists the caller's sites (GET): those they requested, used
+// or can reach, with the state, decision reason and expiry of their request,
+// their last use and the grants letting them in now.
+func (h *Handler) HandleMyAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	var requests []struct {
+		Site      string
+		State     string
+		Reason    string
+		ExpiresAt *time.Time
+	}
+	var uses []struct {
+		Site       string
+		LastUsedAt *time.Time
+	}
+	err := h.db.Table("user_sites").
+		Select("sites.url as site, user_sites.state as state, user_sites.decision_reason as reason, user_sites.expires_at as expires_at").
+		Joins("JOIN sites ON sites.id = user_sites.site_id").
+		Where("user_sites.user_id = ?", user.ID).
+		Scan(&requests).Error
+	if err == nil {
+		err = h.db.Table("site_uses").
+			Select("sites.url as site, site_uses.last_used_at as last_used_at").
+			Joins("JOIN sites ON sites.id = site_uses.site_id").
+			Where("site_uses.user_id = ?", user.ID).
+			Scan(&uses).Error
+	}
+	var access []accessEntry
+	if err == nil {
+		access, err = h.computeAccess(accessFilter{UserID: user.ID})
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sites := map[string]*myAccessEntry{}
+	entry := func(site string) *myAccessEntry {
+		if sites[site] == nil {
+			sites[site] = &myAccessEntry{Site: site, Sources: []string{}}
+		}
+		return sites[site]
+	}
+	for _, request := range requests {
+		e := entry(request.Site)
+		e.State, e.Reason, e.ExpiresAt = request.State, request.Reason, request.ExpiresAt
+	}
+	for _, use := range uses {
+		entry(use.Site).LastUsedAt = use.LastUsedAt
+	}
+	for _, grant := range access {
+		e := entry(grant.Site)
+		e.Access, e.Sources, e.Conditional = true, grant.Sources, grant.Conditional
+	}
+	results := make([]myAccessEntry, 0, len(sites))
+	for _, e := range sites {
+		results = append(results, *e)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Site < results[j].Site })
+	sendJSONResponse(w, results, http.StatusOK)
+}
+
+// HandleAccessCheck tells the request page whether the caller can reach the
+// site now (GET ?site=), so it can poll and send the user on once their
+// request is approved. The answer is the forward-auth decision for a GET of
+// the site from the caller's address, built like /api/explain does; policies
+// on other paths, methods or headers may still turn the user away there.
+func (h *Handler) HandleAccessCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	siteURL := r.URL.Query().Get("site")
+	if siteURL == "" {
+		sendJSONError(w, "Missing site", http.StatusBadRequest)
+		return
+	}
+	_, forwarded, err := h.explainRequest(siteURL)
+	if err != nil {
+		sendJSONError(w, "Invalid site", http.StatusBadRequest)
+		return
+	}
+	forwarded.RemoteAddr = r.RemoteAddr
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		forwarded.Header["X-Forwarded-For"] = forwardedFor
+	}
+
+	site, err := h.findSite(siteURL)
+	userSite := &models.UserSite{}
+	if err == nil && site != nil {
+		userSite, err = h.findUserSite(user.ID, site.ID)
+	}
+	var decision accessDecision
+	if err == nil {
+		decision, err = h.authorize(forwarded, user.Email, siteURL)
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	check := accessCheck{
+		Site:      siteURL,
+		State:     string(userSite.State),
+		Reason:    userSite.DecisionReason,
+		ExpiresAt: userSite.ExpiresAt,
+		Access:    decision == accessGranted,
+	}
+	// Only known sites, so the page cannot be made to send users anywhere.
+	if check.Access && site != nil {
+		check.Redirect = siteURL
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSONResponse(w, check, http.StatusOK)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMyAccess(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	require.NoError(t, db.Create(&admin).Error)
+	require.NoError(t, db.Create(&alice).Error)
+	dashboard := models.Site{URL: "https://dashboard.example.com"}
+	require.NoError(t, db.Create(&dashboard).Error)
+	group := models.Group{Name: "ops"}
+	require.NoError(t, db.Create(&group).Error)
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: group.ID, UserID: alice.ID}).Error)
+	require.NoError(t, db.Create(&models.GroupSite{GroupID: group.ID, SiteID: dashboard.ID}).Error)
+
+	check := func() accessCheck {
+		rr := httptest.NewRecorder()
+		h.HandleAccessCheck(rr, requestAs(alice.Email, http.MethodGet, "/api/access/check?site=https://wiki.example.com", ""))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var check accessCheck
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&check))
+		return check
+	}
+	rr := httptest.NewRecorder()
+	h.HandleRequestSite(rr, requestAs(alice.Email, http.MethodPost, "/api/request", `{"redirect": "https://wiki.example.com"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	pending := check()
+	assert.Equal(t, string(models.Requested), pending.State)
+	assert.False(t, pending.Access)
+	assert.Empty(t, pending.Redirect)
+
+	rr = httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(admin.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://wiki.example.com", "newState": "authorized", "reason": "on call", "expiresAt": "2099-01-01T00:00:00Z"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	approved := check()
+	assert.True(t, approved.Access)
+	assert.Equal(t, "https://wiki.example.com", approved.Redirect)
+	assert.Equal(t, "on call", approved.Reason)
+
+	rr = httptest.NewRecorder()
+	h.respondAuthorization(rr, requestAs(alice.Email, http.MethodGet, "/api/authenticate", ""), alice.Email, dashboard.URL)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.HandleMyAccess(rr, requestAs(alice.Email, http.MethodGet, "/api/access/me", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var sites []myAccessEntry
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&sites))
+	require.Len(t, sites, 2)
+	assert.Equal(t, dashboard.URL, sites[0].Site)
+	assert.Empty(t, sites[0].State, "group grants need no request")
+	assert.Equal(t, []string{"group:ops"}, sites[0].Sources)
+	assert.NotNil(t, sites[0].LastUsedAt)
+	assert.Equal(t, "https://wiki.example.com", sites[1].Site)
+	assert.Equal(t, string(models.Authorized), sites[1].State)
+	assert.Equal(t, "on call", sites[1].Reason)
+	require.NotNil(t, sites[1].ExpiresAt)
+	assert.Equal(t, 2099, sites[1].ExpiresAt.Year())
+	assert.True(t, sites[1].Access)
+	assert.Equal(t, []string{accessSourceDirect}, sites[1].Sources)
+	assert.Nil(t, sites[1].LastUsedAt)
+
+	// Policies judge the site, not the polling request.
+	status := models.Site{URL: "https://status.example.com"}
+	require.NoError(t, db.Create(&status).Error)
+	require.NoError(t, db.Create(&models.SitePolicy{SiteID: status.ID, Name: "front-page", Effect: models.PolicyAllow,
+		Expression: `request.host == "status.example.com" && request.path == "/"`}).Error)
+	rr = httptest.NewRecorder()
+	h.HandleAccessCheck(rr, requestAs(alice.Email, http.MethodGet, "/api/access/check?site=https://status.example.com", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var public accessCheck
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&public))
+	assert.True(t, public.Access)
+	assert.Equal(t, status.URL, public.Redirect)
+}
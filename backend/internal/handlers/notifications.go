@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/B-Urb/KubeVoyage/internal/mail"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	notificationCursor    = "notifications"
+	notificationBatchSize = 100
+	defaultExpiryReminder = 72 * time.Hour
+)
+
+// Mail templates of the notifications, see the mail package.
+const (
+	templateRequestCreated = "request_created"
+	templateRequestDecided = "request_decided"
+	templateGrantExpiring  = "grant_expiring"
+	templateExtension      = "extension_requested"
+)
+
+// notificationData is what the mail templates see.
+type notificationData struct {
+	User      string
+	Site      string
+	State     string
+	Actor     string
+	Reason    string
+	ExpiresAt *time.Time
+	Link      string
+	// ApproveLink and DeclineLink decide a new request in one click.
+	ApproveLink string
+	DeclineLink string
+}
+
+// SendNotifications mails approvers about new requests and requesters about
+// decisions, reading the request history from where it stopped last time,
+// and reminds requesters of grants about to expire. Delivery is best effort:
+// failed emails are logged and not retried. Without a mailer it does nothing.
+func (h *Handler) SendNotifications(ctx context.Context, now time.Time) error {
+	if h.mailer == nil {
+		return nil
+	}
+	if err := h.notifyHistory(ctx); err != nil {
+		return err
+	}
+	return h.remindExpiringGrants(ctx, now)
+}
+
+// notifyHistory notifies about the history entries added since the last
+// call. The first call only marks where to start, so enabling email does not
+// mail about old requests.
+func (h *Handler) notifyHistory(ctx context.Context) error {
+	var cursor models.Cursor
+	if err := h.db.Where("name = ?", notificationCursor).Limit(1).Find(&cursor).Error; err != nil {
+		return err
+	}
+	if cursor.Name == "" {
+		var last []uint
+		if err := h.db.Model(&models.RequestHistory{}).Order("id DESC").Limit(1).Pluck("id", &last).Error; err != nil {
+			return err
+		}
+		cursor = models.Cursor{Name: notificationCursor}
+		if len(last) > 0 {
+			cursor.Position = last[0]
+		}
+		return h.db.Create(&cursor).Error
+	}
+	for {
+		var entries []models.RequestHistory
+		err := h.db.Where("id > ?", cursor.Position).Order("id").Limit(notificationBatchSize).Find(&entries).Error
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		for i := range entries {
+			if err := h.notifyEntry(ctx, &entries[i]); err != nil {
+				return err
+			}
+			cursor.Position = entries[i].ID
+			if err := h.db.Save(&cursor).Error; err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// notifyEntry mails the people interested in a history entry: the approvers
+// of requests that are still pending when the entry is read, and the
+// requester of decisions they did not make themselves.
+func (h *Handler) notifyEntry(ctx context.Context, entry *models.RequestHistory) error {
+	var user models.User
+	var site models.Site
+	if err := h.db.Limit(1).Find(&user, entry.UserID).Error; err != nil || user.ID == 0 {
+		return err
+	}
+	if err := h.db.Limit(1).Find(&site, entry.SiteID).Error; err != nil || site.ID == 0 {
+		return err
+	}
+	userSite, err := h.findUserSite(user.ID, site.ID)
+	if err != nil {
+		return err
+	}
+	data := notificationData{
+		User:   user.Email,
+		Site:   site.URL,
+		State:  string(entry.ToState),
+		Actor:  entry.Actor,
+		Reason: entry.Reason,
+	}
+
+	switch {
+	case requestEventType(entry.FromState, entry.ToState) == eventRequestCreated:
+		// Requests an approval rule decided right away need nobody.
+		if !userSite.State.Pending() {
+			return nil
+		}
+		approvers, err := h.requestApprovers(user.ID, site.ID)
+		if err != nil {
+			return err
+		}
+		data.Link = h.link("/requests")
+		return h.notifyUsers(ctx, approvers, func(p models.NotificationPreference) bool { return p.NewRequests },
+			templateRequestCreated, func(approver *models.User) (notificationData, error) {
+				approverData := data
+				var err error
+				approverData.ApproveLink, approverData.DeclineLink, err = h.newDecisionLinks(approver, user.ID, site.ID, time.Now())
+				return approverData, err
+			})
+	case isExtensionRequest(entry, &user):
+		if userSite.State != models.Authorized || userSite.ExtensionRequestedAt == nil {
+			return nil
+		}
+		approvers, err := h.requestApprovers(user.ID, site.ID)
+		if err != nil {
+			return err
+		}
+		data.ExpiresAt = userSite.ExpiresAt
+		data.Link = h.link("/requests")
+		return h.notifyUsers(ctx, approvers, func(p models.NotificationPreference) bool { return p.NewRequests },
+			templateExtension, staticData(data))
+	case entry.ToState == models.Authorized || entry.ToState == models.Declined || entry.ToState == models.Revoked:
+		if entry.Actor == user.Email {
+			return nil
+		}
+		if entry.ToState == models.Authorized && userSite.State == models.Authorized {
+			data.ExpiresAt = userSite.ExpiresAt
+		}
+		data.Link = h.link("/")
+		return h.notifyUsers(ctx, []models.User{user}, func(p models.NotificationPreference) bool { return p.Decisions },
+			templateRequestDecided, staticData(data))
+	}
+	return nil
+}
+
+// isExtensionRequest reports whether the entry is a grant holder asking for
+// an extension: nobody else moves a grant to itself in their own name, as
+// approvers cannot decide their own requests.
+func isExtensionRequest(entry *models.RequestHistory, user *models.User) bool {
+	return entry.FromState == models.Authorized && entry.ToState == models.Authorized && entry.Actor == user.Email
+}
+
+// requestApprovers returns who may decide a request for the site: its owners,
+// approvers, approver group members and the approvers a rule routed the
+// request to. Sites without any fall back to the global approvers. The
+// requester is never among them.
+func (h *Handler) requestApprovers(userID uint, siteID uint) ([]models.User, error) {
+	var ids []uint
+	err := h.db.Raw(`SELECT user_id FROM site_owners WHERE site_id = ?
+		UNION SELECT user_id FROM site_approvers WHERE site_id = ?
+		UNION SELECT group_members.user_id FROM group_members
+			JOIN site_approver_groups ON site_approver_groups.group_id = group_members.group_id
+			WHERE site_approver_groups.site_id = ?
+		UNION SELECT approver_id FROM request_approvers WHERE user_id = ? AND site_id = ?`,
+		siteID, siteID, siteID, userID, siteID).Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+	query := h.db.Where("id <> ?", userID).Order("email")
+	if len(ids) > 0 {
+		query = query.Where("id IN ?", ids)
+	} else {
+		query = query.Where("role IN ?", models.RolesWith(models.PermDecideRequests))
+	}
+	var approvers []models.User
+	return approvers, query.Find(&approvers).Error
+}
+
+// remindExpiringGrants mails requesters whose grant expires within the
+// reminder window, once per grant.
+func (h *Handler) remindExpiringGrants(ctx context.Context, now time.Time) error {
+	window := h.expiryReminder
+	if window <= 0 {
+		window = defaultExpiryReminder
+	}
+	var userSites []models.UserSite
+	err := h.db.Where("state = ? AND expires_at > ? AND expires_at <= ? AND expiry_reminded_at IS NULL",
+		models.Authorized, now, now.Add(window)).Find(&userSites).Error
+	if err != nil {
+		return err
+	}
+	for _, userSite := range userSites {
+		// Claim the reminder first, so it goes out once even if the grant
+		// changes in the meantime.
+		result := h.db.Model(&models.UserSite{}).
+			Where("user_id = ? AND site_id = ? AND expiry_reminded_at IS NULL", userSite.UserID, userSite.SiteID).
+			Update("expiry_reminded_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		var user models.User
+		var site models.Site
+		if err := h.db.First(&user, userSite.UserID).Error; err != nil {
+			return err
+		}
+		if err := h.db.First(&site, userSite.SiteID).Error; err != nil {
+			return err
+		}
+		data := notificationData{User: user.Email, Site: site.URL, State: string(userSite.State), ExpiresAt: userSite.ExpiresAt,
+			Link: h.link("/")}
+		err := h.notifyUsers(ctx, []models.User{user}, func(p models.NotificationPreference) bool { return p.Expiry },
+			templateGrantExpiring, staticData(data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyUsers mails the users that want the notification, with the template
+// data built for each of them. Machine principals have no mailbox and are
+// skipped.
+func (h *Handler) notifyUsers(ctx context.Context, users []models.User, wants func(models.NotificationPreference) bool, template string, data func(*models.User) (notificationData, error)) error {
+	for i := range users {
+		user := &users[i]
+		if user.Kind != "" && user.Kind != models.KindUser {
+			continue
+		}
+		preference, err := h.notificationPreference(user.ID)
+		if err != nil {
+			return err
+		}
+		if !wants(preference) {
+			continue
+		}
+		userData, err := data(user)
+		if err != nil {
+			return err
+		}
+		msg, err := mail.NewTemplateMessage(user.Email, template, userData)
+		if err != nil {
+			return err
+		}
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			slog.Error("Sending notification failed", "to", user.Email, "template", template, "error", err)
+		}
+	}
+	return nil
+}
+
+func staticData(data notificationData) func(*models.User) (notificationData, error) {
+	return func(*models.User) (notificationData, error) { return data, nil }
+}
+
+// notificationPreference returns the stored preference of the user, or all
+// notifications for users who never chose.
+func (h *Handler) notificationPreference(userID uint) (models.NotificationPreference, error) {
+	preference := models.NotificationPreference{UserID: userID, NewRequests: true, Decisions: true, Expiry: true}
+	err := h.db.Where("user_id = ?", userID).Limit(1).Find(&preference).Error
+	return preference, err
+}
+
+func (h *Handler) link(path string) string {
+	return strings.TrimSuffix(h.BaseURL, "/") + path
+}
+
+// HandleNotificationPreferences reads (GET) and replaces (POST
+// {"newRequests", "decisions", "expiry"}) the email notifications the caller
+// wants.
+func (h *Handler) HandleNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		preference, err := h.notificationPreference(user.ID)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, preference, http.StatusOK)
+	case http.MethodPost:
+		var preference models.NotificationPreference
+		if err := json.NewDecoder(r.Body).Decode(&preference); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		preference.UserID = user.ID
+		if err := h.db.Save(&preference).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, preference, http.StatusOK)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RunNotifications calls SendNotifications every interval until ctx is done.
+func (h *Handler) RunNotifications(ctx context.Context, interval time.Duration) {
+	if h.mailer == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := h.SendNotifications(ctx, now); err != nil {
+				slog.Error("Sending notifications failed", "error", err)
+			}
+		}
+	}
+}
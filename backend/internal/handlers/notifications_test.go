@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifications(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	mailer := &recordingMailer{}
+	h.mailer, h.BaseURL = mailer, "https://auth.example.com"
+
+	owner := models.User{Email: "owner@example.com", Role: models.RoleUser}
+	muted := models.User{Email: "muted@example.com", Role: models.RoleUser}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	for _, user := range []*models.User{&owner, &muted, &alice} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	site := models.Site{URL: "https://wiki.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	require.NoError(t, db.Create(&models.SiteOwner{SiteID: site.ID, UserID: owner.ID}).Error)
+	require.NoError(t, db.Create(&models.SiteApprover{SiteID: site.ID, UserID: muted.ID}).Error)
+
+	rr := httptest.NewRecorder()
+	h.HandleNotificationPreferences(rr, requestAs(muted.Email, http.MethodPost, "/api/notifications/preferences",
+		`{"newRequests": false, "decisions": true, "expiry": true}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	now := time.Now()
+	require.NoError(t, h.SendNotifications(context.Background(), now))
+	rr = httptest.NewRecorder()
+	h.HandleRequestSite(rr, requestAs(alice.Email, http.MethodPost, "/api/request",
+		`{"redirect": "https://wiki.example.com", "justification": "on call"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, h.SendNotifications(context.Background(), now))
+
+	require.Len(t, mailer.sent, 1, "only approvers who want new requests hear about them")
+	assert.Equal(t, owner.Email, mailer.sent[0].To)
+	assert.Equal(t, "Access request for https://wiki.example.com from alice@example.com", mailer.sent[0].Subject)
+	assert.Contains(t, mailer.sent[0].Body, "Justification: on call")
+	assert.Contains(t, mailer.sent[0].Body, "https://auth.example.com/requests")
+
+	expiresAt := now.Add(48 * time.Hour).UTC().Truncate(time.Second)
+	rr = httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(owner.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://wiki.example.com", "newState": "authorized", "expiresAt": "`+
+			expiresAt.Format(time.RFC3339)+`"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, h.SendNotifications(context.Background(), now))
+
+	require.Len(t, mailer.sent, 3, "the decision and the expiry reminder")
+	decision := mailer.sent[1]
+	assert.Equal(t, alice.Email, decision.To)
+	assert.Equal(t, "Your access to https://wiki.example.com was authorized", decision.Subject)
+	assert.Contains(t, decision.Body, "owner@example.com authorized your access")
+	assert.Contains(t, decision.Body, "The access expires on")
+	assert.Equal(t, "Your access to https://wiki.example.com expires soon", mailer.sent[2].Subject)
+
+	require.NoError(t, h.SendNotifications(context.Background(), now.Add(time.Hour)))
+	assert.Len(t, mailer.sent, 3, "grants are reminded once")
+
+	rr = httptest.NewRecorder()
+	h.HandleRequestExtension(rr, requestAs(alice.Email, http.MethodPost, "/api/request/extend", `{"site": "https://wiki.example.com"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, h.SendNotifications(context.Background(), now.Add(time.Hour)))
+	require.Len(t, mailer.sent, 4, "asking for an extension is no new grant to remind of")
+	assert.Equal(t, owner.Email, mailer.sent[3].To)
+	assert.Equal(t, "Extension request for https://wiki.example.com from alice@example.com", mailer.sent[3].Subject)
+	assert.Contains(t, mailer.sent[3].Body, "The access expires on")
+}
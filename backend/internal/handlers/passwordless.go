@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/mail"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	loginChallengeTTL = 10 * time.Minute
+	// At most loginChallengeLimit codes are sent to one address per window.
+	loginChallengeWindow = 15 * time.Minute
+	loginChallengeLimit  = 3
+	loginCodeAttempts    = 5
+	loginBindingCookie   = "login-binding"
+	loginEmailSent       = "If the address belongs to an account, a login link has been sent"
+)
+
+// HandleLoginEmail starts a passwordless login by mailing a single-use link
+// and a 6-digit code to the user. The redirect and token query parameters are
+// the same as for /api/login and are restored once the login completes.
+func (h *Handler) HandleLoginEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.mailer == nil || h.upstream != nil {
+		sendJSONError(w, "Passwordless login is disabled", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Email) == "" {
+		sendJSONError(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(body.Email)
+
+	var recent int64
+	err := h.db.Model(&models.LoginChallenge{}).
+		Where("email = ? AND created_at > ?", email, time.Now().Add(-loginChallengeWindow)).
+		Count(&recent).Error
+	if err != nil {
+		h.logError(w, "Database error while checking login rate", err, http.StatusInternalServerError)
+		return
+	}
+	if recent >= loginChallengeLimit {
+		sendJSONError(w, "Too many login requests, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// Unknown addresses get the same answer so accounts cannot be probed.
+	var user models.User
+	err = h.db.Where("email = ? AND kind = ?", email, models.KindUser).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		sendJSONSuccess(w, loginEmailSent, http.StatusOK)
+		return
+	}
+	if err != nil {
+		h.logError(w, "Database error while fetching user", err, http.StatusInternalServerError)
+		return
+	}
+
+	code, err := generateLoginCode()
+	if err != nil {
+		h.logError(w, "Failed to generate login code", err, http.StatusInternalServerError)
+		return
+	}
+	link := generateSessionID()
+	binding := generateSessionID()
+	siteURL, _ := h.getRedirectUrl(r)
+	challenge := models.LoginChallenge{
+		Email:        user.Email,
+		CodeHash:     h.hashLoginSecret(code),
+		LinkHash:     h.hashLoginSecret(link),
+		BrowserHash:  h.hashLoginSecret(binding),
+		Redirect:     siteURL,
+		OneTimeToken: r.URL.Query().Get("token"),
+		ExpiresAt:    time.Now().Add(loginChallengeTTL),
+	}
+	if err := h.db.Create(&challenge).Error; err != nil {
+		h.logError(w, "Database error while creating login challenge", err, http.StatusInternalServerError)
+		return
+	}
+
+	linkURL := strings.TrimSuffix(h.BaseURL, "/") + "/api/login/magic?token=" + url.QueryEscape(link)
+	err = h.mailer.Send(r.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Your KubeVoyage login",
+		Body: fmt.Sprintf("Use this link to log in to KubeVoyage:\n\n%s\n\nOr enter this code: %s\n\n"+
+			"The link and code expire in %d minutes and only work in the browser where you requested them. "+
+			"If you did not request them, you can ignore this email.\n",
+			linkURL, code, int(loginChallengeTTL.Minutes())),
+	})
+	if err != nil {
+		h.logError(w, "Failed to send login email", err, http.StatusBadGateway)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginBindingCookie,
+		Value:    binding,
+		Path:     "/api/login",
+		MaxAge:   int(loginChallengeTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode, // Sent along when the link is opened from a mail client
+	})
+	sendJSONSuccess(w, loginEmailSent, http.StatusOK)
+}
+
+// HandleLoginMagic completes a passwordless login from the emailed link and
+// sends the user on to the site they originally asked for.
+func (h *Handler) HandleLoginMagic(w http.ResponseWriter, r *http.Request) {
+	aw := &auditWriter{ResponseWriter: w}
+	defer h.finishAuditEvent(r, aw, models.AuthActionLogin)
+	w = aw
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auditIdentity(w, "", authMethodMagicLink)
+	binding, ok := h.loginBinding(r)
+	if !ok {
+		auditReason(w, "browser_mismatch")
+		http.Error(w, "Open this link in the browser where you requested it", http.StatusUnauthorized)
+		return
+	}
+	var challenge models.LoginChallenge
+	err := h.db.Where("link_hash = ? AND browser_hash = ?", h.hashLoginSecret(r.URL.Query().Get("token")), binding).
+		First(&challenge).Error
+	if err == nil {
+		auditIdentity(w, challenge.Email, authMethodMagicLink)
+		aw.event.Site = challenge.Redirect
+	}
+	if err != nil || !h.consumeChallenge(&challenge) {
+		auditReason(w, "invalid_token")
+		http.Error(w, "This login link is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+	if err := h.markEmailVerified(challenge.Email); err != nil {
+		h.logError(w, "Internal Server Error", err, http.StatusInternalServerError)
+		return
+	}
+
+	redirect, err := h.startSession(w, r, challenge.Email, challenge.Redirect, challenge.OneTimeToken)
+	if err != nil {
+		h.logError(w, "Internal Server Error", err, http.StatusInternalServerError)
+		return
+	}
+	clearLoginBinding(w)
+	auditReason(w, "login_successful")
+	auditAllowed(w)
+	if redirect {
+		http.Redirect(w, r, "/api/redirect", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleLoginCode completes a passwordless login with the emailed code. It
+// answers like /api/login so the login page can continue the same way.
+func (h *Handler) HandleLoginCode(w http.ResponseWriter, r *http.Request) {
+	aw := &auditWriter{ResponseWriter: w}
+	defer h.finishAuditEvent(r, aw, models.AuthActionLogin)
+	w = aw
+
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.mailer == nil || h.upstream != nil {
+		auditReason(w, "passwordless_disabled")
+		sendJSONError(w, "Passwordless login is disabled", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		auditReason(w, "invalid_request")
+		sendJSONError(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	auditIdentity(w, strings.TrimSpace(body.Email), authMethodLoginCode)
+	binding, ok := h.loginBinding(r)
+	if !ok {
+		auditReason(w, "browser_mismatch")
+		sendJSONError(w, "Enter the code in the browser where you requested it", http.StatusUnauthorized)
+		return
+	}
+
+	var challenge models.LoginChallenge
+	err := h.db.Where("email = ? AND browser_hash = ? AND used_at IS NULL AND attempts < ? AND expires_at > ?",
+		strings.TrimSpace(body.Email), binding, loginCodeAttempts, time.Now()).
+		Order("id desc").
+		First(&challenge).Error
+	if err != nil {
+		auditReason(w, "invalid_credentials")
+		sendJSONError(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	aw.event.Site = challenge.Redirect
+	// Claim one of the attempts before looking at the code, so parallel
+	// guesses cannot get past the limit. The last attempt uses the challenge
+	// up whatever its outcome.
+	last := challenge.Attempts+1 >= loginCodeAttempts
+	updates := map[string]interface{}{"attempts": challenge.Attempts + 1}
+	if last {
+		updates["used_at"] = time.Now()
+	}
+	result := h.db.Model(&models.LoginChallenge{}).
+		Where("id = ? AND used_at IS NULL AND attempts = ?", challenge.ID, challenge.Attempts).
+		Updates(updates)
+	if result.Error != nil {
+		h.logError(w, "Internal Server Error", result.Error, http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 || !hmac.Equal([]byte(h.hashLoginSecret(strings.TrimSpace(body.Code))), []byte(challenge.CodeHash)) {
+		auditReason(w, "invalid_credentials")
+		sendJSONError(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	// The last attempt already used the challenge up for this request.
+	if !last && !h.consumeChallenge(&challenge) {
+		auditReason(w, "invalid_credentials")
+		sendJSONError(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	if err := h.markEmailVerified(challenge.Email); err != nil {
+		h.logError(w, "Internal Server Error", err, http.StatusInternalServerError)
+		return
+	}
+
+	redirect, err := h.startSession(w, r, challenge.Email, challenge.Redirect, challenge.OneTimeToken)
+	if err != nil {
+		h.logError(w, "Internal Server Error", err, http.StatusInternalServerError)
+		return
+	}
+	clearLoginBinding(w)
+	auditReason(w, "login_successful")
+	sendJSONResponse(w, LoginResponse{Success: true, Message: "Login successful", Redirect: redirect}, http.StatusOK)
+}
+
+// consumeChallenge marks an unexpired challenge as used. Only one caller can
+// ever succeed for a given challenge.
+func (h *Handler) consumeChallenge(challenge *models.LoginChallenge) bool {
+	result := h.db.Model(&models.LoginChallenge{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", challenge.ID, time.Now()).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+func (h *Handler) loginBinding(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(loginBindingCookie)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return h.hashLoginSecret(cookie.Value), true
+}
+
+func clearLoginBinding(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: loginBindingCookie, Path: "/api/login", MaxAge: -1, HttpOnly: true, Secure: true})
+}
+
+// hashLoginSecret keys the hash with the JWT secret so that a leaked table
+// of 6-digit codes cannot simply be brute forced.
+func (h *Handler) hashLoginSecret(secret string) string {
+	mac := hmac.New(sha256.New, h.JWTKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateLoginCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/audit"
+	"github.com/B-Urb/KubeVoyage/internal/mail"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingMailer struct {
+	sent []mail.Message
+}
+
+func (m *recordingMailer) Send(_ context.Context, msg mail.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func setupPasswordlessTest(t *testing.T) (*Handler, *recordingMailer) {
+	db := setupTestDatabase()
+	require.NoError(t, db.Create(&models.User{Email: "alice@example.com", Role: "user"}).Error)
+	mailer := &recordingMailer{}
+	return &Handler{db: db, JWTKey: []byte("test"), BaseURL: "https://auth.example.com", mailer: mailer}, mailer
+}
+
+func requestLoginEmail(h *Handler, email string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "https://auth.example.com/api/login/email?redirect=https://wiki.example.com&token=handoff",
+		bytes.NewBufferString(`{"email": "`+email+`"}`))
+	rr := httptest.NewRecorder()
+	h.HandleLoginEmail(rr, req)
+	return rr
+}
+
+func TestPasswordlessMagicLink(t *testing.T) {
+	h, mailer := setupPasswordlessTest(t)
+	chain, err := audit.NewDBChain(h.db, nil)
+	require.NoError(t, err)
+	h.audit = chain
+
+	rr := requestLoginEmail(h, "alice@example.com")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Len(t, mailer.sent, 1)
+	binding := rr.Result().Cookies()[0]
+	assert.Equal(t, loginBindingCookie, binding.Name)
+
+	link, err := url.Parse(regexp.MustCompile(`https://\S+`).FindString(mailer.sent[0].Body))
+	require.NoError(t, err)
+	follow := func(withBinding bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, link.String(), nil)
+		if withBinding {
+			req.AddCookie(binding)
+		}
+		rr := httptest.NewRecorder()
+		h.HandleLoginMagic(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, follow(false).Code, "link must be bound to the requesting browser")
+
+	rr = follow(true)
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	assert.Equal(t, "/api/redirect", rr.Header().Get("Location"))
+	assert.Equal(t, TokenInfo{true, "alice@example.com"}, oneTimeStore["handoff"])
+	var alice models.User
+	require.NoError(t, h.db.Where("email = ?", "alice@example.com").First(&alice).Error)
+	assert.True(t, alice.EmailVerified, "the login proved the address")
+
+	assert.Equal(t, http.StatusUnauthorized, follow(true).Code, "link must be single-use")
+
+	var events []models.AuthEvent
+	require.NoError(t, h.db.Where("action = ?", models.AuthActionLogin).Order("id").Find(&events).Error)
+	require.Len(t, events, 3)
+	assert.Equal(t, models.AuthOutcomeDeny, events[0].Outcome)
+	assert.Equal(t, "browser_mismatch", events[0].Reason)
+	assert.Equal(t, models.AuthOutcomeAllow, events[1].Outcome)
+	assert.Equal(t, "alice@example.com", events[1].User)
+	assert.Equal(t, authMethodMagicLink, events[1].Method)
+	assert.Equal(t, "https://wiki.example.com", events[1].Site)
+	assert.Equal(t, models.AuthOutcomeDeny, events[2].Outcome)
+	assert.Equal(t, "invalid_token", events[2].Reason)
+}
+
+func TestPasswordlessCode(t *testing.T) {
+	h, mailer := setupPasswordlessTest(t)
+
+	rr := requestLoginEmail(h, "alice@example.com")
+	require.Equal(t, http.StatusOK, rr.Code)
+	binding := rr.Result().Cookies()[0]
+	code := regexp.MustCompile(`code: (\d{6})`).FindStringSubmatch(mailer.sent[0].Body)[1]
+
+	submit := func(code string) int {
+		req := httptest.NewRequest(http.MethodPost, "https://auth.example.com/api/login/code",
+			bytes.NewBufferString(`{"email": "alice@example.com", "code": "`+code+`"}`))
+		req.AddCookie(binding)
+		rr := httptest.NewRecorder()
+		h.HandleLoginCode(rr, req)
+		return rr.Code
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	assert.Equal(t, http.StatusUnauthorized, submit(wrong))
+	assert.Equal(t, http.StatusOK, submit(code))
+	assert.Equal(t, http.StatusUnauthorized, submit(code), "code must be single-use")
+
+	// Every guess counts, the last one included.
+	rr = requestLoginEmail(h, "alice@example.com")
+	require.Equal(t, http.StatusOK, rr.Code)
+	binding = rr.Result().Cookies()[0]
+	code = regexp.MustCompile(`code: (\d{6})`).FindStringSubmatch(mailer.sent[1].Body)[1]
+	for i := 1; i < loginCodeAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, submit(wrong))
+	}
+	assert.Equal(t, http.StatusOK, submit(code), "the last attempt may still succeed")
+
+	rr = requestLoginEmail(h, "alice@example.com")
+	require.Equal(t, http.StatusOK, rr.Code)
+	binding = rr.Result().Cookies()[0]
+	code = regexp.MustCompile(`code: (\d{6})`).FindStringSubmatch(mailer.sent[2].Body)[1]
+	for i := 0; i < loginCodeAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, submit(wrong))
+	}
+	assert.Equal(t, http.StatusUnauthorized, submit(code), "the challenge is used up")
+	var challenge models.LoginChallenge
+	require.NoError(t, h.db.Order("id desc").First(&challenge).Error)
+	assert.Equal(t, loginCodeAttempts, challenge.Attempts)
+	assert.NotNil(t, challenge.UsedAt)
+}
+
+func TestPasswordlessRateLimitAndUnknownUser(t *testing.T) {
+	h, mailer := setupPasswordlessTest(t)
+
+	assert.Equal(t, http.StatusOK, requestLoginEmail(h, "nobody@example.com").Code)
+	assert.Empty(t, mailer.sent, "unknown addresses must not receive mail")
+
+	for i := 0; i < loginChallengeLimit; i++ {
+		assert.Equal(t, http.StatusOK, requestLoginEmail(h, "alice@example.com").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, requestLoginEmail(h, "alice@example.com").Code)
+	assert.Len(t, mailer.sent, loginChallengeLimit)
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/policy"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HandleSitePolicies lists (GET ?site=), creates or replaces by name
+// (POST {"siteURL", "name", "expression", "effect"}) and deletes
+// (DELETE ?site=&name=) the CEL policies of a site. Expressions are compiled
+// before they are saved. Requires the sites:manage permission.
+func (h *Handler) HandleSitePolicies(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		SiteURL    string              `json:"siteURL"`
+		Name       string              `json:"name"`
+		Expression string              `json:"expression"`
+		Effect     models.PolicyEffect `json:"effect"`
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageSites); !ok {
+		return
+	}
+	var body RequestBody
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		body = RequestBody{SiteURL: r.URL.Query().Get("site"), Name: r.URL.Query().Get("name")}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Name) == "" {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site, ok := h.siteFromRequest(w, body.SiteURL)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		policies := []models.SitePolicy{}
+		if err := h.db.Where("site_id = ?", site.ID).Order("name").Find(&policies).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, policies, http.StatusOK)
+	case http.MethodPost:
+		if body.Effect == "" {
+			body.Effect = models.PolicyAllow
+		}
+		if !body.Effect.IsValid() {
+			sendJSONError(w, "Invalid effect", http.StatusBadRequest)
+			return
+		}
+		if _, err := policy.Compile(body.Expression); err != nil {
+			sendJSONError(w, "Invalid expression: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sitePolicy := models.SitePolicy{SiteID: site.ID, Name: strings.TrimSpace(body.Name)}
+		err := h.db.Where(&sitePolicy).
+			Assign(models.SitePolicy{Expression: body.Expression, Effect: body.Effect}).
+			FirstOrCreate(&sitePolicy).Error
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, sitePolicy, http.StatusOK)
+	case http.MethodDelete:
+		result := h.db.Where("site_id = ? AND name = ?", site.ID, body.Name).Delete(&models.SitePolicy{})
+		if result.Error != nil {
+			log.Printf("Database error: %v", result.Error)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			sendJSONError(w, "Policy not found", http.StatusNotFound)
+			return
+		}
+		sendJSONSuccess(w, "Policy deleted", http.StatusOK)
+	}
+}
+
+// HandlePolicyTest evaluates an expression against a sample input
+// (POST {"expression", "input"}) without saving anything. Requires the
+// sites:manage permission.
+func (h *Handler) HandlePolicyTest(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Expression string       `json:"expression"`
+		Input      policy.Input `json:"input"`
+	}
+	type ResponseBody struct {
+		Result bool   `json:"result"`
+		Error  string `json:"error,omitempty"`
+	}
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageSites); !ok {
+		return
+	}
+	var body RequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	compiled, err := policy.Compile(body.Expression)
+	if err != nil {
+		sendJSONError(w, "Invalid expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := compiled.Evaluate(body.Input)
+	if err != nil {
+		sendJSONResponse(w, ResponseBody{Error: err.Error()}, http.StatusOK)
+		return
+	}
+	sendJSONResponse(w, ResponseBody{Result: result}, http.StatusOK)
+}
+
+// evaluatePolicy runs a stored policy against the input.
+func evaluatePolicy(sitePolicy models.SitePolicy, input *policy.Input) (bool, error) {
+	compiled, err := policy.Cached(sitePolicy.Expression)
+	if err != nil {
+		return false, err
+	}
+	return compiled.Evaluate(*input)
+}
+
+// policyInput collects the attributes of the user and of the forwarded
+// request. Traefik passes the original method, host and URI in
+// X-Forwarded-* headers along with the original request headers.
+func (h *Handler) policyInput(r *http.Request, user *models.User) (*policy.Input, error) {
+	groups := []string{}
+	err := h.db.Model(&models.Group{}).
+		Where("id IN (?)", h.db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", user.ID)).
+		Order("name").
+		Pluck("name", &groups).Error
+	if err != nil {
+		return nil, err
+	}
+	input := &policy.Input{
+		User: policy.User{Email: user.Email, Groups: groups, Role: string(user.Role), Kind: user.Kind},
+		Time: time.Now(),
+	}
+	if r == nil {
+		return input, nil
+	}
+
+	request := policy.Request{
+		Method:  r.Header.Get("X-Forwarded-Method"),
+		Host:    r.Header.Get("X-Forwarded-Host"),
+		Path:    r.URL.Path,
+		Headers: make(map[string]string, len(r.Header)),
+	}
+	if request.Method == "" {
+		request.Method = r.Method
+	}
+	if request.Host == "" {
+		request.Host = r.Host
+	}
+	if uri := r.Header.Get("X-Forwarded-Uri"); uri != "" {
+		if parsed, err := url.ParseRequestURI(uri); err == nil {
+			request.Path = parsed.Path
+		}
+	}
+	request.IP = h.clientIP(r)
+	for name, values := range r.Header {
+		request.Headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	input.Request = request
+	return input, nil
+}
+
+// clientIP returns the address of the original client: the right-most
+// X-Forwarded-For hop that is not a trusted proxy, or the peer address when
+// the request did not come through one.
+func (h *Handler) clientIP(r *http.Request) string {
+	return h.trustedProxies.ClientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"))
+}
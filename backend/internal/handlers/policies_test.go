@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSitePolicies(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	admin := models.User{Email: "admin@example.com", Role: models.RoleSuperAdmin}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	require.NoError(t, db.Create(&admin).Error)
+	require.NoError(t, db.Create(&alice).Error)
+	site := models.Site{URL: "https://grafana.example.com"}
+	require.NoError(t, db.Create(&site).Error)
+	oncall := models.Group{Name: "oncall"}
+	require.NoError(t, db.Create(&oncall).Error)
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: oncall.ID, UserID: alice.ID, Source: models.GroupSourceManual}).Error)
+
+	save := func(body string) int {
+		rr := httptest.NewRecorder()
+		h.HandleSitePolicies(rr, requestAs(admin.Email, http.MethodPost, "/api/sites/policies", body))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, save(`{"siteURL": "https://grafana.example.com", "name": "broken", "expression": "user.groups.exists(g, "}`))
+	require.Equal(t, http.StatusOK, save(`{"siteURL": "https://grafana.example.com", "name": "oncall-read",
+		"expression": "user.groups.exists(g, g == \"oncall\") && request.method == \"GET\""}`))
+	require.Equal(t, http.StatusOK, save(`{"siteURL": "https://grafana.example.com", "name": "no-admin-ui", "effect": "deny",
+		"expression": "request.path.startsWith(\"/admin\")"}`))
+
+	forwarded := func(method string, uri string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/authenticate", nil)
+		req.Header.Set("X-Forwarded-Method", method)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		return req
+	}
+	decision, err := h.authorize(forwarded(http.MethodGet, "/d/overview?orgId=1"), alice.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessGranted, decision)
+
+	decision, err = h.authorize(forwarded(http.MethodPost, "/api/dashboards"), alice.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessNotRequested, decision)
+
+	// Deny policies win over grants.
+	require.NoError(t, db.Create(&models.UserSite{UserID: alice.ID, SiteID: site.ID, State: models.Authorized}).Error)
+	decision, err = h.authorize(forwarded(http.MethodGet, "/admin/users"), alice.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessDenied, decision)
+	decision, err = h.authorize(forwarded(http.MethodGet, "/admin/users"), admin.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessDenied, decision, "even for roles that reach every site")
+	decision, err = h.authorize(forwarded(http.MethodGet, "/d/overview"), admin.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessGranted, decision)
+
+	// Only trusted proxies name the client.
+	require.Equal(t, http.StatusOK, save(`{"siteURL": "https://grafana.example.com", "name": "office-only", "effect": "deny",
+		"expression": "!request.ip.startsWith(\"10.\")"}`))
+	spoofed := forwarded(http.MethodGet, "/d/overview")
+	spoofed.Header.Set("X-Forwarded-For", "10.1.2.3")
+	spoofed.RemoteAddr = "203.0.113.9:4711"
+	decision, err = h.authorize(spoofed, alice.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessDenied, decision)
+	spoofed.RemoteAddr = "192.0.2.1:4711"
+	decision, err = h.authorize(spoofed, alice.Email, site.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessGranted, decision)
+
+	rr := httptest.NewRecorder()
+	h.HandlePolicyTest(rr, requestAs(admin.Email, http.MethodPost, "/api/policies/test",
+		`{"expression": "request.ip.startsWith(\"10.\")", "input": {"request": {"ip": "10.1.2.3"}}}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"result": true}`, rr.Body.String())
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
 	"github.com/B-Urb/KubeVoyage/internal/models"
 	"gorm.io/gorm"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func (h *Handler) HandleRequests(w http.ResponseWriter, r *http.Request) {
@@ -15,22 +18,48 @@ func (h *Handler) HandleRequests(w http.ResponseWriter, r *http.Request) {
 		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	userEmail, err := h.getUserFromSession(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-	isAdmin, err := IsUserAdmin(h.db, userEmail)
-	if !isAdmin {
-		http.Error(w, "Only Admins can view this", http.StatusUnauthorized)
+	user, ok := h.requireUser(w, r)
+	if !ok {
 		return
 	}
-	var results []models.UserSiteResponse
-	err = h.db.Table("user_sites").
-		Select("users.email as user, sites.url as site, user_sites.state as state").
+	query := h.db.Table("user_sites").
+		Select("users.email as user, sites.url as site, user_sites.state as state, user_sites.expires_at as expires_at, " +
+			"user_sites.extension_requested_at IS NOT NULL as extension_requested, " +
+			"user_sites.justification as justification, user_sites.decision_reason as reason, " +
+			"sites.required_approvals as required_approvals, user_sites.decided_by_rule as rule, " +
+			"user_sites.state_changed_by as changed_by, user_sites.state_changed_at as changed_at").
 		Joins("JOIN users ON users.id = user_sites.user_id").
-		Joins("JOIN sites ON sites.id = user_sites.site_id").
-		Scan(&results).Error
+		Joins("JOIN sites ON sites.id = user_sites.site_id")
+	// Delegated approvers only see the requests of the sites they decide
+	// and those routed to them by approval rules.
+	if !user.Role.Can(models.PermViewRequests) {
+		siteIDs, _, err := h.approvableSites(user)
+		var routed int64
+		if err == nil {
+			err = h.db.Model(&models.RequestApprover{}).Where("approver_id = ?", user.ID).Count(&routed).Error
+		}
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if len(siteIDs) == 0 && routed == 0 {
+			sendJSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		routedToUser := h.db.Model(&models.RequestApprover{}).Select("1").
+			Where("request_approvers.user_id = user_sites.user_id AND request_approvers.site_id = user_sites.site_id AND request_approvers.approver_id = ?", user.ID)
+		if len(siteIDs) > 0 {
+			query = query.Where("sites.id IN ? OR EXISTS (?)", siteIDs, routedToUser)
+		} else {
+			query = query.Where("EXISTS (?)", routedToUser)
+		}
+	}
+	results := []models.UserSiteResponse{}
+	err := query.Scan(&results).Error
+	if err == nil {
+		err = h.attachApprovals(results)
+	}
 
 	if err != nil {
 		log.Printf("Database error: %v", err)
@@ -44,7 +73,7 @@ func (h *Handler) HandleRequests(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) HandleRequestSite(w http.ResponseWriter, r *http.Request) {
 	var redirect models.Redirect
 
-	userEmail, err := h.getUserFromSession(r)
+	userEmail, err := h.getRequestUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -70,14 +99,54 @@ func (h *Handler) HandleRequestSite(w http.ResponseWriter, r *http.Request) {
 		site = models.Site{URL: redirect.Redirect}
 		h.db.Create(&site)
 	}
+	justification := strings.TrimSpace(redirect.Justification)
+	if site.RequireJustification && justification == "" {
+		sendJSONError(w, "A justification is required for this site", http.StatusBadRequest)
+		return
+	}
 
-	// Create a new UserSite entry with state "requested"
-	userSite := models.UserSite{
-		UserID: user.ID, // Use the ID from the user query
-		SiteID: site.ID,
-		State:  models.Requested,
+	userSite, err := h.findUserSite(user.ID, site.ID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// New requests are created, ended ones are asked for again like new ones
+	// and pending requests take the latest justification.
+	switch {
+	case userSite.State == "":
+		err = h.transition(userSite, models.Requested, user.Email, map[string]interface{}{"justification": justification})
+	case userSite.State == models.Declined || userSite.State == models.Expired || userSite.State == models.Revoked ||
+		userSite.State == models.Withdrawn || (userSite.State.Pending() && justification != ""):
+		err = h.transition(userSite, models.Requested, user.Email, map[string]interface{}{
+			"expires_at": nil, "justification": justification, "decision_reason": "", "decided_by_rule": "",
+		})
+		if err == nil {
+			err = h.clearApprovals(user.ID, site.ID)
+		}
+	}
+	if err != nil {
+		log.Printf("Requesting access failed: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if userSite.State == models.Requested {
+		rule, err := h.applyApprovalRules(r, &user, &site)
+		if err != nil {
+			log.Printf("Applying approval rules failed: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if rule != nil && rule.Action == models.RuleAuthorize {
+			w.Write([]byte("Access granted"))
+			return
+		}
+		if rule != nil && rule.Action == models.RuleDecline {
+			w.Write([]byte("Request declined"))
+			return
+		}
 	}
-	h.db.Create(&userSite)
 
 	w.Write([]byte("Request submitted"))
 }
@@ -86,6 +155,11 @@ func (h *Handler) HandleUpdateSiteState(w http.ResponseWriter, r *http.Request)
 		UserEmail string `json:"userEmail"`
 		SiteURL   string `json:"siteURL"`
 		NewState  string `json:"newState"`
+		// ExpiresAt limits an authorization. The site default applies when
+		// it is omitted.
+		ExpiresAt *time.Time `json:"expiresAt"`
+		// Reason is shown to the requester along with the decision.
+		Reason string `json:"reason"`
 	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -96,39 +170,143 @@ func (h *Handler) HandleUpdateSiteState(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	// Approvers decide requests; revoking a grant is an admin action. Every
+	// other state is reached by the requester or by the system.
 	state := models.State(body.NewState)
-	if !state.IsValid() {
+	if state != models.Authorized && state != models.Declined && state != models.Revoked {
 		http.Error(w, "Invalid state value", http.StatusBadRequest)
 		return
 	}
-	userEmail, err := h.getUserFromSession(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+	approver, ok := h.requireRequestApprover(w, r, body.SiteURL, body.UserEmail)
+	if !ok {
 		return
 	}
-	isAdmin, err := IsUserAdmin(h.db, userEmail)
-	if !isAdmin {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+	if state == models.Revoked && !approver.Role.Can(models.PermDecideRequests) {
+		http.Error(w, "Only admins can revoke access", http.StatusForbidden)
 		return
 	}
 	var userID uint
 	if err := h.db.Model(&models.User{}).Where("email = ?", body.UserEmail).Select("id").First(&userID).Error; err != nil {
-		http.Error(w, fmt.Errorf("failed to find user: %w", err).Error(), http.StatusBadRequest)
-		return
+		// Service accounts may be granted before they ever called a site.
+		if !strings.HasPrefix(body.UserEmail, auth.ServiceAccountPrefix) {
+			http.Error(w, fmt.Errorf("failed to find user: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := auth.ParseServiceAccountUsername(body.UserEmail); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		principal, err := h.ensurePrincipal(body.UserEmail, models.KindServiceAccount)
+		if err != nil {
+			http.Error(w, fmt.Errorf("failed to create service account: %w", err).Error(), http.StatusInternalServerError)
+			return
+		}
+		userID = principal.ID
 	}
 
 	// 2. Find the site ID
-	var siteID uint
-	if err := h.db.Model(&models.Site{}).Where("url = ?", body.SiteURL).Select("id").First(&siteID).Error; err != nil {
-		http.Error(w, fmt.Errorf("failed to find site: %w", err).Error(), http.StatusBadRequest)
+	site, err := h.findSite(body.SiteURL)
+	if err != nil {
+		http.Error(w, fmt.Errorf("failed to find site: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+	if site == nil {
+		http.Error(w, "Site not found", http.StatusNotFound)
 		return
 	}
 
-	// 3. Update the UserSite record
-	if err := h.db.Model(&models.UserSite{}).Where("user_id = ? AND site_id = ?", userID, siteID).Update("state", state).Error; err != nil {
-		http.Error(w, fmt.Errorf("failed to find and update request: %w", err).Error(), http.StatusBadRequest)
+	progress, err := h.decideRequest(approver, userID, site, state, body.ExpiresAt, body.Reason)
+	var decisionErr *decisionError
+	if errors.As(err, &decisionErr) {
+		http.Error(w, decisionErr.message, decisionErr.status)
+		return
+	}
+	if progress != nil {
+		sendJSONResponse(w, progress, http.StatusAccepted)
 		return
 	}
 
 	w.Write([]byte("State updated successfully"))
 }
+
+// decisionError is a decision refused by decideRequest, with the status and
+// message to answer with.
+type decisionError struct {
+	status  int
+	message string
+}
+
+func (e *decisionError) Error() string {
+	return e.message
+}
+
+// decideRequest authorizes or declines the request of the user for the site
+// as the approver, who must already be allowed to decide it. Sites needing
+// several approvers only record the approval until enough have accepted,
+// which is reported as progress. Refusals are *decisionError.
+func (h *Handler) decideRequest(approver *models.User, userID uint, site *models.Site, state models.State, requestedExpiry *time.Time, reason string) (*approvalProgress, error) {
+	if state == models.Authorized && userID == approver.ID {
+		return nil, &decisionError{http.StatusForbidden, "You cannot approve your own request"}
+	}
+
+	userSite, err := h.findUserSite(userID, site.ID)
+	if err != nil {
+		return nil, &decisionError{http.StatusInternalServerError, fmt.Errorf("failed to find request: %w", err).Error()}
+	}
+	if !userSite.State.CanTransitionTo(state) {
+		return nil, &decisionError{http.StatusConflict, fmt.Sprintf("Cannot move a %s request to %s", displayState(userSite.State), state)}
+	}
+
+	var expiresAt *time.Time
+	if state == models.Authorized {
+		var err error
+		if expiresAt, err = grantExpiry(*site, requestedExpiry, time.Now()); err != nil {
+			return nil, &decisionError{http.StatusBadRequest, err.Error()}
+		}
+	}
+
+	// Sites needing several approvers wait in pending_second_approval until
+	// enough distinct approvers have accepted.
+	if state == models.Authorized && needsSeveralApprovals(*site) {
+		counts, err := h.countsAsApprover(approver.ID, site.ID)
+		if err != nil {
+			return nil, &decisionError{http.StatusInternalServerError, fmt.Errorf("failed to check approval groups: %w", err).Error()}
+		}
+		if !counts {
+			return nil, &decisionError{http.StatusForbidden, "You are not in an approval group of this site"}
+		}
+		approvals, err := h.recordApproval(userID, site.ID, approver.ID)
+		if err != nil {
+			return nil, &decisionError{http.StatusInternalServerError, fmt.Errorf("failed to record approval: %w", err).Error()}
+		}
+		if len(approvals) < site.RequiredApprovals {
+			// Every partial approval of a pending request is a change to it,
+			// with history, webhooks and events. Decided requests only
+			// collect the approval until the last one moves them.
+			if userSite.State.CanTransitionTo(models.PendingSecondApproval) {
+				err = h.transition(userSite, models.PendingSecondApproval, approver.Email, nil)
+			}
+			if err != nil {
+				return nil, &decisionError{http.StatusConflict, fmt.Errorf("failed to update request: %w", err).Error()}
+			}
+			return &approvalProgress{State: userSite.State, Approvals: approvals, RequiredApprovals: site.RequiredApprovals}, nil
+		}
+	}
+
+	// 3. Update the UserSite record, creating it for direct grants
+	err = h.transition(userSite, state, approver.Email, map[string]interface{}{
+		"expires_at": expiresAt, "extension_requested_at": nil, "decision_reason": strings.TrimSpace(reason),
+		"decided_by_rule": "",
+	})
+	if errors.Is(err, errIllegalTransition) {
+		return nil, &decisionError{http.StatusConflict, err.Error()}
+	}
+	if err != nil {
+		return nil, &decisionError{http.StatusInternalServerError, fmt.Errorf("failed to update request: %w", err).Error()}
+	}
+	// The decision is final, the next one starts collecting approvals anew.
+	if err := h.clearApprovals(userID, site.ID); err != nil {
+		log.Printf("Database error: %v", err)
+	}
+	return nil, nil
+}
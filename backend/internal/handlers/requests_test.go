@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/B-Urb/KubeVoyage/internal/models"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,7 +24,7 @@ func TestHandleRegister(t *testing.T) {
 	// Assuming you have a function to set up a test database
 	db := setupTestDatabase()
 
-	app := &App{DB: db}
+	app := &Handler{db: db}
 	handler := http.HandlerFunc(app.HandleRegister)
 
 	handler.ServeHTTP(rr, req)
@@ -32,3 +33,27 @@ func TestHandleRegister(t *testing.T) {
 	assert.Equal(t, http.StatusCreated, rr.Code, "Expected status code 201")
 	// Add more assertions as needed
 }
+
+func TestHandleRegisterIgnoresRole(t *testing.T) {
+	db := setupTestDatabase()
+	app := &Handler{db: db}
+
+	body := bytes.NewBufferString(`{"email": "mallory@example.com", "password": "password123", "role": "superadmin"}`)
+	rr := httptest.NewRecorder()
+	app.HandleRegister(rr, httptest.NewRequest(http.MethodPost, "/api/register", body))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var user models.User
+	assert.NoError(t, db.Where("email = ?", "mallory@example.com").First(&user).Error)
+	assert.Equal(t, models.RoleUser, user.Role)
+}
+
+func TestHandleRegisterRejectsServiceAccountNames(t *testing.T) {
+	db := setupTestDatabase()
+	app := &Handler{db: db}
+
+	body := bytes.NewBufferString(`{"email": "system:serviceaccount:ci:deployer", "password": "password123"}`)
+	rr := httptest.NewRecorder()
+	app.HandleRegister(rr, httptest.NewRequest(http.MethodPost, "/api/register", body))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
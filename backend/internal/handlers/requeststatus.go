@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type requestStatus struct {
+	Site               string     `json:"site"`
+	State              string     `json:"state"`
+	Justification      string     `json:"justification"`
+	Reason             string     `json:"reason"`
+	ExpiresAt          *time.Time `json:"expiresAt,omitempty"`
+	ExtensionRequested bool       `json:"extensionRequested"`
+	ChangedBy          string     `json:"changedBy,omitempty"`
+	ChangedAt          *time.Time `json:"changedAt,omitempty"`
+}
+
+type commentResponse struct {
+	ID        uint      `json:"id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HandleRequestStatus shows the caller their own requests, including the
+// approver's decision reason. GET ?site= narrows the list to one site.
+func (h *Handler) HandleRequestStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := h.db.Table("user_sites").
+		Select("sites.url as site, user_sites.state as state, user_sites.justification as justification, "+
+			"user_sites.decision_reason as reason, user_sites.expires_at as expires_at, "+
+			"user_sites.extension_requested_at IS NOT NULL as extension_requested, "+
+			"user_sites.state_changed_by as changed_by, user_sites.state_changed_at as changed_at").
+		Joins("JOIN sites ON sites.id = user_sites.site_id").
+		Where("user_sites.user_id = ?", user.ID).
+		Order("sites.url")
+	if site := r.URL.Query().Get("site"); site != "" {
+		query = query.Where("sites.url = ?", site)
+	}
+	results := []requestStatus{}
+	if err := query.Scan(&results).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, results, http.StatusOK)
+}
+
+// HandleRequestComments reads (GET ?site=&user=) and extends
+// (POST {"site", "user", "body"}) the comment thread of a request. The user
+// defaults to the caller; only the requester and the approvers of the site
+// take part in the thread.
+func (h *Handler) HandleRequestComments(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Site string `json:"site"`
+		User string `json:"user"`
+		Body string `json:"body"`
+	}
+	caller, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	var body RequestBody
+	switch r.Method {
+	case http.MethodGet:
+		body = RequestBody{Site: r.URL.Query().Get("site"), User: r.URL.Query().Get("user")}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Body) == "" {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	site, ok := h.siteFromRequest(w, body.Site)
+	if !ok {
+		return
+	}
+	requester := caller
+	if body.User != "" && body.User != caller.Email {
+		allowed, err := h.canApproveRequest(caller, site, body.User)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			sendJSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		requester = &models.User{}
+		if err := h.db.Where("email = ?", body.User).First(requester).Error; err != nil {
+			sendJSONError(w, "User not found", http.StatusNotFound)
+			return
+		}
+	}
+	err := h.db.Where(&models.UserSite{UserID: requester.ID, SiteID: site.ID}).First(&models.UserSite{}).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		sendJSONError(w, "Request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		comment := models.RequestComment{UserID: requester.ID, SiteID: site.ID, AuthorID: caller.ID, Body: strings.TrimSpace(body.Body)}
+		if err := h.db.Create(&comment).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, commentResponse{ID: comment.ID, Author: caller.Email, Body: comment.Body, CreatedAt: comment.CreatedAt}, http.StatusCreated)
+		return
+	}
+
+	results := []commentResponse{}
+	err = h.db.Table("request_comments").
+		Select("request_comments.id as id, users.email as author, request_comments.body as body, request_comments.created_at as created_at").
+		Joins("JOIN users ON users.id = request_comments.author_id").
+		Where("request_comments.user_id = ? AND request_comments.site_id = ?", requester.ID, site.ID).
+		Order("request_comments.id").
+		Scan(&results).Error
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, results, http.StatusOK)
+}
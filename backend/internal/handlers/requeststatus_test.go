@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestJustificationAndReason(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	admin := models.User{Email: "admin@example.com", Role: models.RoleSuperAdmin}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	bob := models.User{Email: "bob@example.com", Role: models.RoleUser}
+	for _, user := range []*models.User{&admin, &alice, &bob} {
+		require.NoError(t, db.Create(user).Error)
+	}
+	require.NoError(t, db.Create(&models.Site{URL: "https://prod.example.com", RequireJustification: true}).Error)
+
+	rr := httptest.NewRecorder()
+	h.HandleRequestSite(rr, requestAs(alice.Email, http.MethodPost, "/api/request", `{"redirect": "https://prod.example.com"}`))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleRequestSite(rr, requestAs(alice.Email, http.MethodPost, "/api/request", `{"redirect": "https://prod.example.com", "justification": "INC-42"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.HandleRequestComments(rr, requestAs(admin.Email, http.MethodPost, "/api/request/comments", `{"site": "https://prod.example.com", "user": "alice@example.com", "body": "Which cluster?"}`))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleRequestComments(rr, requestAs(bob.Email, http.MethodGet, "/api/request/comments?site=https://prod.example.com&user=alice@example.com", ""))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleRequestComments(rr, requestAs(alice.Email, http.MethodGet, "/api/request/comments?site=https://prod.example.com", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var comments []commentResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&comments))
+	require.Len(t, comments, 1)
+	assert.Equal(t, "admin@example.com", comments[0].Author)
+	assert.Equal(t, "Which cluster?", comments[0].Body)
+
+	rr = httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(admin.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://prod.example.com", "newState": "declined", "reason": "Use staging"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.HandleRequestStatus(rr, requestAs(alice.Email, http.MethodGet, "/api/request/status", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var statuses []requestStatus
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&statuses))
+	require.Len(t, statuses, 1)
+	assert.NotNil(t, statuses[0].ChangedAt)
+	statuses[0].ChangedAt = nil
+	assert.Equal(t, []requestStatus{{
+		Site: "https://prod.example.com", State: string(models.Declined), Justification: "INC-42", Reason: "Use staging",
+		ChangedBy: admin.Email,
+	}}, statuses)
+}
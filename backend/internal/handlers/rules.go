@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type ruleBody struct {
+	Name        string            `json:"name"`
+	Priority    int               `json:"priority"`
+	SiteURL     string            `json:"siteURL"`
+	EmailDomain string            `json:"emailDomain"`
+	Group       string            `json:"group"`
+	Claim       string            `json:"claim"`
+	Action      models.RuleAction `json:"action"`
+	Approvers   []string          `json:"approvers"`
+}
+
+func newRuleBody(rule models.ApprovalRule) ruleBody {
+	approvers := []string{}
+	for _, approver := range strings.Split(rule.Approvers, ",") {
+		if approver != "" {
+			approvers = append(approvers, approver)
+		}
+	}
+	return ruleBody{
+		Name:        rule.Name,
+		Priority:    rule.Priority,
+		SiteURL:     rule.SiteURL,
+		EmailDomain: rule.EmailDomain,
+		Group:       rule.Group,
+		Claim:       rule.Claim,
+		Action:      rule.Action,
+		Approvers:   approvers,
+	}
+}
+
+// HandleRules lists (GET), creates or replaces by name (POST) and deletes
+// (DELETE ?name=) approval rules. Requires the rules:manage permission.
+func (h *Handler) HandleRules(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requirePermission(w, r, models.PermManageRules); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var rules []models.ApprovalRule
+		if err := h.db.Order("priority, id").Find(&rules).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		results := make([]ruleBody, 0, len(rules))
+		for _, rule := range rules {
+			results = append(results, newRuleBody(rule))
+		}
+		sendJSONResponse(w, results, http.StatusOK)
+	case http.MethodPost:
+		var body ruleBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		rule, err := body.rule()
+		if err != nil {
+			sendJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rule.Action == models.RuleAuthorize && rule.SiteURL != "" {
+			site, err := h.findSite(rule.SiteURL)
+			if err != nil {
+				log.Printf("Database error: %v", err)
+				sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if site != nil && needsSeveralApprovals(*site) {
+				sendJSONError(w, "Sites needing several approvals cannot be authorized by a rule", http.StatusBadRequest)
+				return
+			}
+		}
+		// Save rather than Assign, so criteria can be cleared again.
+		var existing models.ApprovalRule
+		err = h.db.Where("name = ?", rule.Name).Limit(1).Find(&existing).Error
+		if err == nil {
+			rule.ID = existing.ID
+			err = h.db.Save(&rule).Error
+		}
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, newRuleBody(rule), http.StatusOK)
+	case http.MethodDelete:
+		result := h.db.Where("name = ?", r.URL.Query().Get("name")).Delete(&models.ApprovalRule{})
+		if result.Error != nil {
+			log.Printf("Database error: %v", result.Error)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			sendJSONError(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		sendJSONSuccess(w, "Rule deleted", http.StatusOK)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rule validates the body and turns it into an approval rule.
+func (b ruleBody) rule() (models.ApprovalRule, error) {
+	rule := models.ApprovalRule{
+		Name:        strings.TrimSpace(b.Name),
+		Priority:    b.Priority,
+		SiteURL:     strings.TrimSpace(b.SiteURL),
+		EmailDomain: strings.ToLower(strings.TrimPrefix(strings.TrimSpace(b.EmailDomain), "@")),
+		Group:       strings.TrimSpace(b.Group),
+		Claim:       strings.TrimSpace(b.Claim),
+		Action:      b.Action,
+	}
+	if rule.Name == "" {
+		return rule, errors.New("name is required")
+	}
+	if !rule.Action.IsValid() {
+		return rule, fmt.Errorf("invalid action: %s", rule.Action)
+	}
+	if rule.SiteURL == "" && rule.EmailDomain == "" && rule.Group == "" && rule.Claim == "" {
+		return rule, errors.New("at least one of siteURL, emailDomain, group or claim is required")
+	}
+	var approvers []string
+	for _, approver := range b.Approvers {
+		if approver = strings.TrimSpace(approver); approver != "" {
+			approvers = append(approvers, approver)
+		}
+	}
+	if rule.Action == models.RuleRoute && len(approvers) == 0 {
+		return rule, errors.New("route rules need approvers")
+	}
+	rule.Approvers = strings.Join(approvers, ",")
+	return rule, nil
+}
+
+// applyApprovalRules runs the approval rules against a pending request and
+// applies the first one that matches. Authorize rules are skipped for sites
+// needing several approvals. It returns nil when no rule matched
+// and the request waits for approvers as usual.
+func (h *Handler) applyApprovalRules(r *http.Request, user *models.User, site *models.Site) (*models.ApprovalRule, error) {
+	var rules []models.ApprovalRule
+	if err := h.db.Order("priority, id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	claims := h.upstreamClaims(r)
+	for i := range rules {
+		rule := &rules[i]
+		// A rule is no approver, so it cannot stand in for several of them.
+		if rule.Action == models.RuleAuthorize && needsSeveralApprovals(*site) {
+			continue
+		}
+		matched, err := h.ruleMatches(rule, user, site, claims)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+		return rule, h.applyRule(rule, user, site)
+	}
+	return nil, nil
+}
+
+func (h *Handler) ruleMatches(rule *models.ApprovalRule, user *models.User, site *models.Site, claims []string) (bool, error) {
+	if rule.SiteURL != "" && rule.SiteURL != site.URL {
+		return false, nil
+	}
+	// Anyone can register any address, so only addresses the user proved to
+	// own count as being in a domain.
+	if rule.EmailDomain != "" {
+		at := strings.LastIndex(user.Email, "@")
+		if !user.EmailVerified || at < 0 || !strings.EqualFold(user.Email[at+1:], rule.EmailDomain) {
+			return false, nil
+		}
+	}
+	if rule.Claim != "" && !slices.Contains(claims, rule.Claim) {
+		return false, nil
+	}
+	if rule.Group != "" {
+		group, err := h.findGroup(rule.Group)
+		if err != nil || group == nil {
+			return false, err
+		}
+		var memberships int64
+		err = h.db.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, user.ID).Count(&memberships).Error
+		if err != nil || memberships == 0 {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (h *Handler) applyRule(rule *models.ApprovalRule, user *models.User, site *models.Site) error {
+	userSite, err := h.findUserSite(user.ID, site.ID)
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{"decided_by_rule": rule.Name}
+	switch rule.Action {
+	case models.RuleAuthorize:
+		expiresAt, err := grantExpiry(*site, nil, time.Now())
+		if err != nil {
+			return err
+		}
+		fields["expires_at"] = expiresAt
+		fields["decision_reason"] = fmt.Sprintf("Approved by rule %s", rule.Name)
+		return h.transition(userSite, models.Authorized, actorRulePrefix+rule.Name, fields)
+	case models.RuleDecline:
+		fields["decision_reason"] = fmt.Sprintf("Declined by rule %s", rule.Name)
+		return h.transition(userSite, models.Declined, actorRulePrefix+rule.Name, fields)
+	case models.RuleRoute:
+		for _, email := range newRuleBody(*rule).Approvers {
+			var approver models.User
+			if err := h.db.Where("email = ?", email).First(&approver).Error; err != nil {
+				slog.Warn("Skipping unknown approver of rule", "rule", rule.Name, "approver", email)
+				continue
+			}
+			route := models.RequestApprover{UserID: user.ID, SiteID: site.ID, ApproverID: approver.ID}
+			if err := h.db.Where(&route).FirstOrCreate(&route).Error; err != nil {
+				return err
+			}
+		}
+		fields["decision_reason"] = fmt.Sprintf("Routed by rule %s to %s", rule.Name, strings.ReplaceAll(rule.Approvers, ",", ", "))
+	}
+	if err := h.db.Model(userSite).Update("decided_by_rule", rule.Name).Error; err != nil {
+		return err
+	}
+	return appendHistory(h.db, historyEntry(user.ID, site.ID, userSite.State, userSite.State, actorRulePrefix+rule.Name, fields, time.Now()))
+}
+
+// upstreamClaims returns the group claims asserted by the SSO gateway for
+// this request, if any.
+func (h *Handler) upstreamClaims(r *http.Request) []string {
+	if h.upstream == nil {
+		return nil
+	}
+	identity, err := h.upstream.Identity(r)
+	if err != nil {
+		return nil
+	}
+	return identity.Groups
+}
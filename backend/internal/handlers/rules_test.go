@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApprovalRules(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	h.upstream.GroupsHeader = "X-Forwarded-Groups"
+
+	admin := models.User{Email: "admin@example.com", Role: models.RoleSuperAdmin}
+	owner := models.User{Email: "owner@ourcompany.com", Role: models.RoleUser}
+	require.NoError(t, db.Create(&admin).Error)
+	require.NoError(t, db.Create(&owner).Error)
+
+	for _, rule := range []string{
+		`{"name": "wiki-for-staff", "priority": 10, "siteURL": "https://wiki.example.com", "emailDomain": "@OurCompany.com", "action": "authorize"}`,
+		`{"name": "no-contractors", "priority": 20, "claim": "contractors", "action": "decline"}`,
+		`{"name": "billing-owner", "priority": 30, "siteURL": "https://billing.example.com", "action": "route", "approvers": ["owner@ourcompany.com"]}`,
+	} {
+		rr := httptest.NewRecorder()
+		h.HandleRules(rr, requestAs(admin.Email, http.MethodPost, "/api/rules", rule))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr := httptest.NewRecorder()
+	h.HandleRules(rr, requestAs(admin.Email, http.MethodPost, "/api/rules", `{"name": "everyone", "action": "authorize"}`))
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "rules without criteria are rejected")
+
+	// Rules cannot replace the approvers of sites needing several of them.
+	require.NoError(t, db.Create(&models.Site{URL: "https://vault.example.com", RequiredApprovals: 2}).Error)
+	rr = httptest.NewRecorder()
+	h.HandleRules(rr, requestAs(admin.Email, http.MethodPost, "/api/rules",
+		`{"name": "vault-for-staff", "siteURL": "https://vault.example.com", "emailDomain": "ourcompany.com", "action": "authorize"}`))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleRules(rr, requestAs(admin.Email, http.MethodPost, "/api/rules",
+		`{"name": "staff-everywhere", "priority": 40, "emailDomain": "ourcompany.com", "action": "authorize"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	request := func(email string, site string, groups string) *models.UserSite {
+		req := requestAs(email, http.MethodPost, "/api/request", `{"redirect": "`+site+`"}`)
+		rr := httptest.NewRecorder()
+		req.Header.Set("X-Forwarded-Groups", groups)
+		h.HandleRequestSite(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		var userSite models.UserSite
+		require.NoError(t, db.Joins("JOIN users ON users.id = user_sites.user_id").Joins("JOIN sites ON sites.id = user_sites.site_id").
+			Where("users.email = ? AND sites.url = ?", email, site).First(&userSite).Error)
+		return &userSite
+	}
+
+	userSite := request("jane@ourcompany.com", "https://wiki.example.com", "")
+	assert.Equal(t, models.Authorized, userSite.State)
+	assert.Equal(t, "wiki-for-staff", userSite.DecidedByRule)
+	userSite = request("jane@ourcompany.com", "https://vault.example.com", "")
+	assert.Equal(t, models.Requested, userSite.State)
+	assert.Empty(t, userSite.DecidedByRule)
+
+	// Self-registered addresses are not verified and match no domain.
+	var rule models.ApprovalRule
+	require.NoError(t, db.Where("name = ?", "wiki-for-staff").First(&rule).Error)
+	site := models.Site{URL: "https://wiki.example.com"}
+	for verified, want := range map[bool]bool{false: false, true: true} {
+		matched, err := h.ruleMatches(&rule, &models.User{Email: "mallory@ourcompany.com", EmailVerified: verified}, &site, nil)
+		require.NoError(t, err)
+		assert.Equal(t, want, matched)
+	}
+
+	userSite = request("max@partner.com", "https://wiki.example.com", "contractors")
+	assert.Equal(t, models.Declined, userSite.State)
+	assert.Equal(t, "no-contractors", userSite.DecidedByRule)
+
+	userSite = request("max@partner.com", "https://billing.example.com", "")
+	assert.Equal(t, models.Requested, userSite.State)
+	assert.Equal(t, "billing-owner", userSite.DecidedByRule)
+
+	// The routed owner may now decide this request, but no other one.
+	rr = httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(owner.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "jane@ourcompany.com", "siteURL": "https://wiki.example.com", "newState": "declined"}`))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(owner.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "max@partner.com", "siteURL": "https://billing.example.com", "newState": "authorized"}`))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The route ends with the request it was made for.
+	var routes int64
+	require.NoError(t, db.Model(&models.RequestApprover{}).Count(&routes).Error)
+	assert.Zero(t, routes)
+	var billing models.Site
+	require.NoError(t, db.Where("url = ?", "https://billing.example.com").First(&billing).Error)
+	allowed, err := h.canApproveRequest(&owner, &billing, "max@partner.com")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/B-Urb/KubeVoyage/internal/util"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// newServiceAccountValidator builds the validator selected by SA_TOKEN_AUTH
+// ("tokenreview" or "jwks"). It returns nil when ServiceAccount tokens are
+// not accepted.
+func newServiceAccountValidator() (auth.TokenValidator, error) {
+	mode, _ := util.GetEnvOrDefault("SA_TOKEN_AUTH", "off")
+	if mode == "off" {
+		return nil, nil
+	}
+	credentials, _ := util.GetEnvOrDefault("SA_TOKEN_CREDENTIALS_FILE", serviceAccountDir+"/token")
+	caFile, _ := util.GetEnvOrDefault("SA_TOKEN_CA_FILE", serviceAccountDir+"/ca.crt")
+	audiences := util.GetEnvList("SA_TOKEN_AUDIENCES")
+	client, err := auth.NewClusterClient(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case "tokenreview":
+		apiServer, _ := util.GetEnvOrDefault("KUBERNETES_API_URL", "https://kubernetes.default.svc")
+		return &auth.TokenReviewer{
+			APIServer:       apiServer,
+			CredentialsFile: credentials,
+			Audiences:       audiences,
+			Client:          client,
+			CacheTTL:        time.Minute,
+		}, nil
+	case "jwks":
+		issuer, _ := util.GetEnvOrDefault("SA_TOKEN_ISSUER", "https://kubernetes.default.svc.cluster.local")
+		jwksURL, _ := util.GetEnvOrDefault("SA_TOKEN_JWKS_URL", "")
+		return &auth.JWKSValidator{
+			Issuer:          issuer,
+			JWKSURL:         jwksURL,
+			CredentialsFile: credentials,
+			Audiences:       audiences,
+			Client:          client,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported SA_TOKEN_AUTH: %s", mode)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// handleServiceAccountAuth answers a forward-auth request that carries a
+// ServiceAccount token. It returns false without writing a response when the
+// bearer token is not a ServiceAccount token, so the request can continue
+// through the normal session flow.
+func (h *Handler) handleServiceAccountAuth(w http.ResponseWriter, r *http.Request, siteURL string, token string) bool {
+	account, err := h.serviceAccounts.Validate(r.Context(), token)
+	if errors.Is(err, auth.ErrNotServiceAccountToken) {
+		return false
+	}
+	if err != nil {
+		slog.Info("Rejected service account token", "error", err)
+		auditReason(w, "invalid_token")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return true
+	}
+
+	principal, err := h.ensurePrincipal(account.Username(), models.KindServiceAccount)
+	if errors.Is(err, errPrincipalKind) {
+		slog.Warn("Service account identity belongs to another principal", "identity", account.Username())
+		auditReason(w, "identity_conflict")
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	if err != nil {
+		h.logError(w, "Database error while fetching service account", err, http.StatusInternalServerError)
+		return true
+	}
+	auditIdentity(w, principal.Email, authMethodServiceAccount)
+	decision, err := h.authorize(r, principal.Email, siteURL)
+	if err != nil {
+		h.logError(w, "Database error while checking user authorization", err, http.StatusInternalServerError)
+		return true
+	}
+	auditReason(w, decision.String())
+	if decision != accessGranted {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// errPrincipalKind is returned by ensurePrincipal when the identity already
+// belongs to a principal of another kind.
+var errPrincipalKind = errors.New("identity belongs to another kind of principal")
+
+// ensurePrincipal returns the user row of the given kind for an identity
+// vouched for by an external source, creating a password-less row on first
+// sight so admins can grant it sites like any other user. An identity never
+// resolves to a principal of another kind, so a certificate or token cannot
+// take over a human account and a registration cannot take over a workload.
+func (h *Handler) ensurePrincipal(identity string, kind string) (models.User, error) {
+	var user models.User
+	err := h.db.Where("email = ? AND kind = ?", identity, kind).Limit(1).Find(&user).Error
+	if err != nil || user.ID != 0 {
+		return user, err
+	}
+	var taken int64
+	if err := h.db.Model(&models.User{}).Where("email = ?", identity).Count(&taken).Error; err != nil {
+		return user, err
+	}
+	if taken > 0 {
+		return user, fmt.Errorf("%w: %s", errPrincipalKind, identity)
+	}
+	user = models.User{Email: identity, Role: models.RoleUser, Kind: kind}
+	return user, h.db.Create(&user).Error
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsurePrincipal(t *testing.T) {
+	db := setupTestDatabase()
+	h := &Handler{db: db}
+
+	human := models.User{Email: "alice@example.com", Role: models.RoleUser, Kind: models.KindUser}
+	require.NoError(t, db.Create(&human).Error)
+	_, err := h.ensurePrincipal(human.Email, models.KindService)
+	assert.ErrorIs(t, err, errPrincipalKind, "workloads never resolve to a human")
+
+	account, err := h.ensurePrincipal("system:serviceaccount:ci:deployer", models.KindServiceAccount)
+	require.NoError(t, err)
+	assert.Equal(t, models.KindServiceAccount, account.Kind)
+	again, err := h.ensurePrincipal(account.Email, models.KindServiceAccount)
+	require.NoError(t, err)
+	assert.Equal(t, account.ID, again.ID, "known principals are reused")
+}
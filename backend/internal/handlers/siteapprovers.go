@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"net/http"
+	"slices"
+)
+
+type siteApproversResponse struct {
+	Site      string   `json:"site"`
+	Owners    []string `json:"owners"`
+	Approvers []string `json:"approvers"`
+	Groups    []string `json:"groups"`
+}
+
+// HandleSiteOwners adds (POST {"siteURL", "email"}) and removes
+// (DELETE ?site=&email=) the owners of a site. Requires the sites:manage
+// permission.
+func (h *Handler) HandleSiteOwners(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		SiteURL string `json:"siteURL"`
+		Email   string `json:"email"`
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageSites); !ok {
+		return
+	}
+	var body RequestBody
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		body = RequestBody{SiteURL: r.URL.Query().Get("site"), Email: r.URL.Query().Get("email")}
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	site, ok := h.siteFromRequest(w, body.SiteURL)
+	if !ok {
+		return
+	}
+	var user models.User
+	if err := h.db.Where("email = ?", body.Email).First(&user).Error; err != nil {
+		sendJSONError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	owner := models.SiteOwner{SiteID: site.ID, UserID: user.ID}
+	var err error
+	if r.Method == http.MethodPost {
+		err = h.db.Where(&owner).FirstOrCreate(&owner).Error
+	} else {
+		err = h.db.Where(&owner).Delete(&models.SiteOwner{}).Error
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONSuccess(w, "Site owners updated", http.StatusOK)
+}
+
+// HandleSiteApprovers lets site owners manage who decides requests for their
+// site. GET ?site= lists owners, approvers and approver groups,
+// POST {"siteURL", "email"|"group"} adds an approver and
+// DELETE ?site=&email=|&group= removes one. Callers with the sites:manage
+// permission may manage every site.
+func (h *Handler) HandleSiteApprovers(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		SiteURL string `json:"siteURL"`
+		Email   string `json:"email"`
+		Group   string `json:"group"`
+	}
+	caller, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	var body RequestBody
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		query := r.URL.Query()
+		body = RequestBody{SiteURL: query.Get("site"), Email: query.Get("email"), Group: query.Get("group")}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	site, ok := h.siteFromRequest(w, body.SiteURL)
+	if !ok {
+		return
+	}
+	if !caller.Role.Can(models.PermManageSites) {
+		var owners int64
+		if err := h.db.Model(&models.SiteOwner{}).Where(&models.SiteOwner{SiteID: site.ID, UserID: caller.ID}).Count(&owners).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if owners == 0 {
+			sendJSONError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		result, err := h.siteApprovers(site)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, result, http.StatusOK)
+		return
+	}
+
+	if (body.Email == "") == (body.Group == "") {
+		sendJSONError(w, "Exactly one of email or group is required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if body.Email != "" {
+		var user models.User
+		if err := h.db.Where("email = ?", body.Email).First(&user).Error; err != nil {
+			sendJSONError(w, "User not found", http.StatusNotFound)
+			return
+		}
+		approver := models.SiteApprover{SiteID: site.ID, UserID: user.ID}
+		if r.Method == http.MethodPost {
+			err = h.db.Where(&approver).FirstOrCreate(&approver).Error
+		} else {
+			err = h.db.Where(&approver).Delete(&models.SiteApprover{}).Error
+		}
+	} else {
+		group, ok := h.groupFromRequest(w, body.Group)
+		if !ok {
+			return
+		}
+		approver := models.SiteApproverGroup{SiteID: site.ID, GroupID: group.ID}
+		if r.Method == http.MethodPost {
+			err = h.db.Where(&approver).FirstOrCreate(&approver).Error
+		} else {
+			err = h.db.Where(&approver).Delete(&models.SiteApproverGroup{}).Error
+		}
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONSuccess(w, "Site approvers updated", http.StatusOK)
+}
+
+func (h *Handler) siteApprovers(site *models.Site) (siteApproversResponse, error) {
+	result := siteApproversResponse{Site: site.URL, Owners: []string{}, Approvers: []string{}, Groups: []string{}}
+	err := h.db.Model(&models.User{}).
+		Joins("JOIN site_owners ON site_owners.user_id = users.id").
+		Where("site_owners.site_id = ?", site.ID).
+		Order("users.email").
+		Pluck("users.email", &result.Owners).Error
+	if err == nil {
+		err = h.db.Model(&models.User{}).
+			Joins("JOIN site_approvers ON site_approvers.user_id = users.id").
+			Where("site_approvers.site_id = ?", site.ID).
+			Order("users.email").
+			Pluck("users.email", &result.Approvers).Error
+	}
+	if err == nil {
+		// "groups" is a reserved word in MySQL, so stay away from qualified
+		// column names of that table.
+		err = h.db.Model(&models.Group{}).
+			Where("id IN (?)", h.db.Model(&models.SiteApproverGroup{}).Select("group_id").Where("site_id = ?", site.ID)).
+			Order("name").
+			Pluck("name", &result.Groups).Error
+	}
+	return result, err
+}
+
+// approvableSites returns the IDs of the sites the user may decide requests
+// for as owner, approver or member of an approver group. all is true when
+// the role of the user allows deciding requests for every site.
+func (h *Handler) approvableSites(user *models.User) (siteIDs []uint, all bool, err error) {
+	if user.Role.Can(models.PermDecideRequests) {
+		return nil, true, nil
+	}
+	err = h.db.Raw(`SELECT site_id FROM site_owners WHERE user_id = ?
+		UNION SELECT site_id FROM site_approvers WHERE user_id = ?
+		UNION SELECT site_approver_groups.site_id FROM site_approver_groups
+			JOIN group_members ON group_members.group_id = site_approver_groups.group_id
+			WHERE group_members.user_id = ?`, user.ID, user.ID, user.ID).
+		Scan(&siteIDs).Error
+	return siteIDs, false, err
+}
+
+// canApproveSite reports whether the user may decide requests for the site.
+// Unknown sites (nil) can only be decided by global approvers.
+func (h *Handler) canApproveSite(user *models.User, site *models.Site) (bool, error) {
+	siteIDs, all, err := h.approvableSites(user)
+	if err != nil {
+		return false, err
+	}
+	return all || (site != nil && slices.Contains(siteIDs, site.ID)), nil
+}
+
+// canApproveRequest reports whether the user may decide the request of
+// requesterEmail for the site, either as approver of the whole site or
+// because an approval rule routed the request to them.
+func (h *Handler) canApproveRequest(user *models.User, site *models.Site, requesterEmail string) (bool, error) {
+	allowed, err := h.canApproveSite(user, site)
+	if err != nil || allowed || site == nil {
+		return allowed, err
+	}
+	var routed int64
+	err = h.db.Model(&models.RequestApprover{}).
+		Joins("JOIN users ON users.id = request_approvers.user_id").
+		Where("users.email = ? AND request_approvers.site_id = ? AND request_approvers.approver_id = ?", requesterEmail, site.ID, user.ID).
+		Count(&routed).Error
+	return routed > 0, err
+}
+
+// requireRequestApprover answers the request and returns false unless the
+// caller may decide the request of requesterEmail for siteURL.
+func (h *Handler) requireRequestApprover(w http.ResponseWriter, r *http.Request, siteURL string, requesterEmail string) (*models.User, bool) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	site, err := h.findSite(siteURL)
+	allowed := false
+	if err == nil {
+		allowed, err = h.canApproveRequest(user, site, requesterEmail)
+	}
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !allowed {
+		sendJSONError(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// siteFromRequest resolves a site named in a request and answers with an
+// error when it does not exist.
+func (h *Handler) siteFromRequest(w http.ResponseWriter, siteURL string) (*models.Site, bool) {
+	site, err := h.findSite(siteURL)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if site == nil {
+		sendJSONError(w, "Site not found", http.StatusNotFound)
+		return nil, false
+	}
+	return site, true
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelegatedApprovers(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+
+	users := map[string]*models.User{}
+	for _, email := range []string{"owner@example.com", "oncall@example.com", "alice@example.com", "bob@example.com"} {
+		user := &models.User{Email: email, Role: models.RoleUser}
+		require.NoError(t, db.Create(user).Error)
+		users[email] = user
+	}
+	wiki := models.Site{URL: "https://wiki.example.com"}
+	grafana := models.Site{URL: "https://grafana.example.com"}
+	require.NoError(t, db.Create(&wiki).Error)
+	require.NoError(t, db.Create(&grafana).Error)
+	group := models.Group{Name: "oncall"}
+	require.NoError(t, db.Create(&group).Error)
+	require.NoError(t, db.Create(&models.GroupMember{GroupID: group.ID, UserID: users["oncall@example.com"].ID, Source: models.GroupSourceManual}).Error)
+	require.NoError(t, db.Create(&models.SiteOwner{SiteID: wiki.ID, UserID: users["owner@example.com"].ID}).Error)
+	require.NoError(t, db.Create(&models.UserSite{UserID: users["alice@example.com"].ID, SiteID: wiki.ID, State: models.Requested}).Error)
+	require.NoError(t, db.Create(&models.UserSite{UserID: users["alice@example.com"].ID, SiteID: grafana.ID, State: models.Requested}).Error)
+
+	serve := func(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// Without any delegation the on-call engineer sees nothing.
+	rr := serve(h.HandleRequests, requestAs("oncall@example.com", http.MethodGet, "/api/requests", ""))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Only the owner may delegate.
+	rr = serve(h.HandleSiteApprovers, requestAs("bob@example.com", http.MethodPost, "/api/sites/approvers", `{"siteURL": "https://wiki.example.com", "group": "oncall"}`))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = serve(h.HandleSiteApprovers, requestAs("owner@example.com", http.MethodPost, "/api/sites/approvers", `{"siteURL": "https://wiki.example.com", "group": "oncall"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = serve(h.HandleRequests, requestAs("oncall@example.com", http.MethodGet, "/api/requests", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var results []models.UserSiteResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&results))
+	assert.Equal(t, []models.UserSiteResponse{{User: "alice@example.com", Site: wiki.URL, State: string(models.Requested), Approvals: []string{}}}, results)
+
+	rr = serve(h.HandleUpdateSiteState, requestAs("oncall@example.com", http.MethodPost, "/api/requests/update", `{"userEmail": "alice@example.com", "siteURL": "https://grafana.example.com", "newState": "authorized"}`))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = serve(h.HandleUpdateSiteState, requestAs("oncall@example.com", http.MethodPost, "/api/requests/update", `{"userEmail": "alice@example.com", "siteURL": "https://wiki.example.com", "newState": "authorized"}`))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	decision, err := h.authorize(nil, "alice@example.com", wiki.URL)
+	require.NoError(t, err)
+	assert.Equal(t, accessGranted, decision)
+}
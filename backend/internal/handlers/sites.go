@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+)
+
+type siteResponse struct {
+	URL                  string   `json:"url"`
+	AllowBasicAuth       bool     `json:"allowBasicAuth"`
+	DefaultGrantDays     int      `json:"defaultGrantDays"`
+	RequireJustification bool     `json:"requireJustification"`
+	RequiredApprovals    int      `json:"requiredApprovals"`
+	ApprovalGroups       []string `json:"approvalGroups"`
+}
+
+func newSiteResponse(site models.Site) siteResponse {
+	return siteResponse{
+		URL:                  site.URL,
+		AllowBasicAuth:       site.AllowBasicAuth,
+		DefaultGrantDays:     site.DefaultGrantDays,
+		RequireJustification: site.RequireJustification,
+		RequiredApprovals:    site.RequiredApprovals,
+		ApprovalGroups:       []string{},
+	}
+}
+
+// HandleSites lists all known sites with their settings. Requires the
+// sites:manage permission.
+func (h *Handler) HandleSites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageSites); !ok {
+		return
+	}
+
+	var sites []models.Site
+	if err := h.db.Order("url").Find(&sites).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	results := make([]siteResponse, 0, len(sites))
+	for _, site := range sites {
+		result := newSiteResponse(site)
+		var err error
+		if result.ApprovalGroups, err = h.approvalGroupNames(site.ID); err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		results = append(results, result)
+	}
+	sendJSONResponse(w, results, http.StatusOK)
+}
+
+// HandleUpdateSite changes the settings of a site. Fields that are omitted
+// from the body are left untouched. Requires the sites:manage permission.
+func (h *Handler) HandleUpdateSite(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		URL                  string `json:"url"`
+		AllowBasicAuth       *bool  `json:"allowBasicAuth"`
+		DefaultGrantDays     *int   `json:"defaultGrantDays"`
+		RequireJustification *bool  `json:"requireJustification"`
+		RequiredApprovals    *int   `json:"requiredApprovals"`
+		// ApprovalGroups replaces the groups whose approvals count.
+		ApprovalGroups *[]string `json:"approvalGroups"`
+	}
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body RequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.URL == "" {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.DefaultGrantDays != nil && *body.DefaultGrantDays < 0 {
+		sendJSONError(w, "defaultGrantDays must not be negative", http.StatusBadRequest)
+		return
+	}
+	if body.RequiredApprovals != nil && *body.RequiredApprovals < 0 {
+		sendJSONError(w, "requiredApprovals must not be negative", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageSites); !ok {
+		return
+	}
+
+	var site models.Site
+	if err := h.db.Where(models.Site{URL: body.URL}).FirstOrCreate(&site).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if body.AllowBasicAuth != nil {
+		site.AllowBasicAuth = *body.AllowBasicAuth
+	}
+	if body.DefaultGrantDays != nil {
+		site.DefaultGrantDays = *body.DefaultGrantDays
+	}
+	if body.RequireJustification != nil {
+		site.RequireJustification = *body.RequireJustification
+	}
+	if body.RequiredApprovals != nil {
+		site.RequiredApprovals = *body.RequiredApprovals
+	}
+	if err := h.db.Save(&site).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if body.ApprovalGroups != nil {
+		err := h.setApprovalGroups(site.ID, *body.ApprovalGroups)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			sendJSONError(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	result := newSiteResponse(site)
+	var err error
+	if result.ApprovalGroups, err = h.approvalGroupNames(site.ID); err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, result, http.StatusOK)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type createTokenResponse struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// HandleTokens lets the logged-in user list (GET), create (POST) and revoke
+// (DELETE ?id=) app tokens for HTTP Basic access.
+func (h *Handler) HandleTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens := []models.AppToken{}
+		if err := h.db.Where("user_id = ?", user.ID).Order("id").Find(&tokens).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, tokens, http.StatusOK)
+	case http.MethodPost:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" {
+			sendJSONError(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		secret := appTokenPrefix + generateSessionID()
+		token := models.AppToken{UserID: user.ID, Name: body.Name, TokenHash: hashAppToken(secret)}
+		if err := h.db.Create(&token).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// The plain token is only ever shown once.
+		sendJSONResponse(w, createTokenResponse{ID: token.ID, Name: token.Name, Token: secret}, http.StatusCreated)
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			sendJSONError(w, "Invalid token id", http.StatusBadRequest)
+			return
+		}
+		result := h.db.Where("id = ? AND user_id = ?", id, user.ID).Delete(&models.AppToken{})
+		if result.Error != nil {
+			log.Printf("Database error: %v", result.Error)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			sendJSONError(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		sendJSONSuccess(w, "Token revoked", http.StatusOK)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"log"
+	"net/http"
+)
+
+type userResponse struct {
+	Email string      `json:"email"`
+	Role  models.Role `json:"role"`
+	Kind  string      `json:"kind"`
+}
+
+// HandleUsers lists all users with their role. Requires the users:manage
+// permission.
+func (h *Handler) HandleUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requirePermission(w, r, models.PermManageUsers); !ok {
+		return
+	}
+
+	var users []models.User
+	if err := h.db.Order("email").Find(&users).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	results := make([]userResponse, 0, len(users))
+	for _, user := range users {
+		results = append(results, userResponse{Email: user.Email, Role: user.Role, Kind: user.Kind})
+	}
+	sendJSONResponse(w, results, http.StatusOK)
+}
+
+// HandleUpdateUserRole assigns a role to a user (POST {"email", "role"}).
+// Requires the users:manage permission; callers cannot change their own role
+// so the last superadmin cannot lock themselves out.
+func (h *Handler) HandleUpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Email string      `json:"email"`
+		Role  models.Role `json:"role"`
+	}
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller, ok := h.requirePermission(w, r, models.PermManageUsers)
+	if !ok {
+		return
+	}
+	var body RequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !body.Role.IsValid() {
+		sendJSONError(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if body.Email == caller.Email {
+		sendJSONError(w, "Cannot change your own role", http.StatusForbidden)
+		return
+	}
+
+	var user models.User
+	if err := h.db.Where("email = ?", body.Email).First(&user).Error; err != nil {
+		sendJSONError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := h.db.Model(&user).Update("role", body.Role).Error; err != nil {
+		log.Printf("Database error: %v", err)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendJSONResponse(w, userResponse{Email: user.Email, Role: body.Role, Kind: user.Kind}, http.StatusOK)
+}
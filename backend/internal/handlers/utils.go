@@ -1,11 +1,12 @@
 package handlers
 
 import (
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/B-Urb/KubeVoyage/internal/models"
-	"gorm.io/gorm"
+	"golang.org/x/crypto/scrypt"
 	"log"
 	"net/http"
 	"net/url"
@@ -73,21 +74,52 @@ func sendJSONResponse(w http.ResponseWriter, data interface{}, statusCode int) {
 	json.NewEncoder(w).Encode(data)
 }
 
-func IsUserAdmin(db *gorm.DB, email string) (bool, error) {
-	var user models.User
-
-	if email == "" {
-		return false, errors.New("user is empty")
+// verifyPassword compares a plain password against the stored scrypt hash.
+func verifyPassword(storedPassword string, password string) bool {
+	storedHash, err := base64.StdEncoding.DecodeString(storedPassword)
+	if err != nil || len(storedHash) == 0 {
+		return false
+	}
+	inputHash, err := scrypt.Key([]byte(password), nil, 16384, 8, 1, 32)
+	if err != nil {
+		return false
 	}
-	// Find the user by email
-	result := db.Where("email = ?", email).First(&user)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return false, errors.New("user not found")
+	return subtle.ConstantTimeCompare(storedHash, inputHash) == 1
+}
+
+// markEmailVerified records that the user proved to own their email address.
+func (h *Handler) markEmailVerified(email string) error {
+	return h.db.Model(&models.User{}).
+		Where("email = ? AND kind = ? AND email_verified = ?", email, models.KindUser, false).
+		Update("email_verified", true).Error
+}
+
+// requireUser answers the request with 401 and returns false unless the
+// caller is signed in.
+func (h *Handler) requireUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userEmail, err := h.getRequestUser(r)
+	if err != nil || userEmail == "" {
+		sendJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
 	}
-	if result.Error != nil {
-		return false, result.Error
+	var user models.User
+	if err := h.db.Where("email = ?", userEmail).First(&user).Error; err != nil {
+		sendJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
 	}
+	return &user, true
+}
 
-	// Check if the user's role is "admin"
-	return user.Role == "admin", nil
+// requirePermission answers the request and returns false unless the caller
+// is signed in (401) and their role grants the permission (403).
+func (h *Handler) requirePermission(w http.ResponseWriter, r *http.Request, perm models.Permission) (*models.User, bool) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !user.Role.Can(perm) {
+		sendJSONError(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
 }
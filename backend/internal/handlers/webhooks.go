@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types of request transitions.
+const (
+	eventRequestCreated      = "request.created"
+	eventRequestStateChanged = "request.state_changed"
+	eventGrantExpired        = "grant.expired"
+)
+
+var webhookEvents = []string{eventRequestCreated, eventRequestStateChanged, eventGrantExpired}
+
+const (
+	webhookMaxAttempts   = 8
+	webhookBaseBackoff   = 30 * time.Second
+	webhookMaxBackoff    = time.Hour
+	webhookBatchSize     = 50
+	webhookMaxErrorBytes = 512
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// requestEventType names the event of a transition. Asking again for ended
+// requests creates a new request, like asking for the first time.
+func requestEventType(from models.State, next models.State) string {
+	switch {
+	case next == models.Expired:
+		return eventGrantExpired
+	case next == models.Requested && !from.Pending():
+		return eventRequestCreated
+	}
+	return eventRequestStateChanged
+}
+
+// webhookPayload is the JSON body posted to webhooks. The request is the
+// history entry of the transition; its id identifies the event.
+type webhookPayload struct {
+	Type    string          `json:"type"`
+	Request historyResponse `json:"request"`
+}
+
+type webhookBody struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Format    string    `json:"format"`
+	Active    *bool     `json:"active,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newWebhookBody(hook models.Webhook) webhookBody {
+	return webhookBody{
+		Name:      hook.Name,
+		URL:       hook.URL,
+		Events:    strings.Split(hook.Events, ","),
+		Format:    hook.Format,
+		Active:    &hook.Active,
+		CreatedAt: hook.CreatedAt,
+	}
+}
+
+// webhook validates the body and turns it into a webhook.
+func (b webhookBody) webhook() (models.Webhook, error) {
+	hook := models.Webhook{Name: strings.TrimSpace(b.Name), URL: strings.TrimSpace(b.URL), Secret: b.Secret, Format: b.Format,
+		Active: true}
+	if hook.Format == "" {
+		hook.Format = models.WebhookFormatJSON
+	}
+	if hook.Format != models.WebhookFormatJSON && hook.Format != models.WebhookFormatChat {
+		return hook, fmt.Errorf("unknown format: %s", hook.Format)
+	}
+	if b.Active != nil {
+		hook.Active = *b.Active
+	}
+	if hook.Name == "" {
+		return hook, errors.New("name is required")
+	}
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return hook, errors.New("url must be an absolute http or https URL")
+	}
+	var events []string
+	for _, event := range b.Events {
+		event = strings.TrimSpace(event)
+		if event != "*" && !slices.Contains(webhookEvents, event) {
+			return hook, fmt.Errorf("unknown event: %s", event)
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return hook, errors.New("at least one event is required")
+	}
+	hook.Events = strings.Join(events, ",")
+	return hook, nil
+}
+
+// subscribed reports whether the webhook receives the event type.
+func subscribed(hook models.Webhook, event string) bool {
+	events := strings.Split(hook.Events, ",")
+	return slices.Contains(events, event) || slices.Contains(events, "*")
+}
+
+// HandleWebhooks lists (GET), creates or replaces by name (POST) and deletes
+// (DELETE ?name=) webhooks. A new webhook without a secret gets a generated
+// one, which only the POST response shows. Requires the webhooks:manage
+// permission.
+func (h *Handler) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requirePermission(w, r, models.PermManageHooks); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var hooks []models.Webhook
+		if err := h.db.Order("name").Find(&hooks).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		results := make([]webhookBody, 0, len(hooks))
+		for _, hook := range hooks {
+			results = append(results, newWebhookBody(hook))
+		}
+		sendJSONResponse(w, results, http.StatusOK)
+	case http.MethodPost:
+		var body webhookBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		hook, err := body.webhook()
+		if err != nil {
+			sendJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var existing models.Webhook
+		err = h.db.Where("name = ?", hook.Name).Limit(1).Find(&existing).Error
+		if err == nil {
+			hook.ID, hook.CreatedAt = existing.ID, existing.CreatedAt
+			if hook.Secret == "" {
+				hook.Secret = existing.Secret
+			}
+			if hook.Secret == "" {
+				hook.Secret, err = newWebhookSecret()
+			}
+		}
+		if err == nil {
+			err = h.db.Save(&hook).Error
+		}
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		result := newWebhookBody(hook)
+		if body.Secret == "" && existing.ID == 0 {
+			result.Secret = hook.Secret
+		}
+		sendJSONResponse(w, result, http.StatusOK)
+	case http.MethodDelete:
+		var hook models.Webhook
+		err := h.db.Where("name = ?", r.URL.Query().Get("name")).Limit(1).Find(&hook).Error
+		if err == nil && hook.ID == 0 {
+			sendJSONError(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = h.db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+					return err
+				}
+				return tx.Delete(&hook).Error
+			})
+		}
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sendJSONSuccess(w, "Webhook deleted", http.StatusOK)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+type webhookDeliveryResponse struct {
+	models.WebhookDelivery
+	Webhook string `json:"webhook"`
+}
+
+// HandleWebhookDeliveries lists deliveries newest first (GET [?webhook=]
+// [&status=][&event=][&before=][&limit=]) and queues a delivery again
+// (POST {"id"}). Requires the webhooks:manage permission.
+func (h *Handler) HandleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requirePermission(w, r, models.PermManageHooks); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var hooks []models.Webhook
+		if err := h.db.Find(&hooks).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		names := map[uint]string{}
+		query := h.db.Model(&models.WebhookDelivery{})
+		for _, hook := range hooks {
+			names[hook.ID] = hook.Name
+		}
+		if name := r.URL.Query().Get("webhook"); name != "" {
+			ids := []uint{}
+			for id, hookName := range names {
+				if hookName == name {
+					ids = append(ids, id)
+				}
+			}
+			query = query.Where("webhook_id IN ?", ids)
+		}
+		for _, param := range []string{"status", "event"} {
+			if value := r.URL.Query().Get(param); value != "" {
+				query = query.Where(param+" = ?", value)
+			}
+		}
+		query, ok := paginate(r, query, "id")
+		if !ok {
+			sendJSONError(w, "Invalid query", http.StatusBadRequest)
+			return
+		}
+		var deliveries []models.WebhookDelivery
+		if err := query.Find(&deliveries).Error; err != nil {
+			log.Printf("Database error: %v", err)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		results := make([]webhookDeliveryResponse, 0, len(deliveries))
+		for _, delivery := range deliveries {
+			results = append(results, webhookDeliveryResponse{WebhookDelivery: delivery, Webhook: names[delivery.WebhookID]})
+		}
+		sendJSONResponse(w, results, http.StatusOK)
+	case http.MethodPost:
+		var body struct {
+			ID uint `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		result := h.db.Model(&models.WebhookDelivery{}).Where("id = ?", body.ID).Updates(map[string]interface{}{
+			"status": models.DeliveryPending, "attempts": 0, "next_attempt_at": time.Now(),
+		})
+		if result.Error != nil {
+			log.Printf("Database error: %v", result.Error)
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			sendJSONError(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		sendJSONSuccess(w, "Delivery queued", http.StatusOK)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// enqueueWebhooks adds a delivery of the transition to the outbox of every
+// active webhook subscribed to it. It runs in the transaction of the
+// transition, so events are queued exactly when the transition commits.
+func (h *Handler) enqueueWebhooks(tx *gorm.DB, entry *models.RequestHistory) error {
+	event := requestEventType(entry.FromState, entry.ToState)
+	var hooks []models.Webhook
+	if err := tx.Where("active = ?", true).Find(&hooks).Error; err != nil {
+		return err
+	}
+	hooks = slices.DeleteFunc(hooks, func(hook models.Webhook) bool { return !subscribed(hook, event) })
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	request, err := newHistoryResponse(tx, entry)
+	if err != nil {
+		return err
+	}
+	payloads := map[string][]byte{}
+	deliveries := make([]models.WebhookDelivery, 0, len(hooks))
+	for _, hook := range hooks {
+		payload, ok := payloads[hook.Format]
+		if !ok {
+			if hook.Format == models.WebhookFormatChat {
+				payload, err = json.Marshal(h.chatMessage(event, entry, request))
+			} else {
+				payload, err = json.Marshal(webhookPayload{Type: event, Request: request})
+			}
+			if err != nil {
+				return err
+			}
+			payloads[hook.Format] = payload
+		}
+		deliveries = append(deliveries, models.WebhookDelivery{
+			WebhookID:     hook.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: entry.CreatedAt,
+		})
+	}
+	return tx.Create(&deliveries).Error
+}
+
+// webhookBackoff is the wait after the given number of failed attempts.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
+
+// DeliverWebhooks posts the deliveries that are due. Failed attempts are
+// retried with exponential backoff until webhookMaxAttempts, after which the
+// delivery is marked failed. It returns the number of deliveries attempted.
+func (h *Handler) DeliverWebhooks(ctx context.Context, now time.Time) (int, error) {
+	var deliveries []models.WebhookDelivery
+	err := h.db.Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, now).
+		Order("id").Limit(webhookBatchSize).Find(&deliveries).Error
+	if err != nil || len(deliveries) == 0 {
+		return 0, err
+	}
+	hooks := map[uint]*models.Webhook{}
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		hook, ok := hooks[delivery.WebhookID]
+		if !ok {
+			hook = &models.Webhook{}
+			if err := h.db.Limit(1).Find(hook, delivery.WebhookID).Error; err != nil {
+				return i, err
+			}
+			hooks[delivery.WebhookID] = hook
+		}
+
+		update := map[string]interface{}{"attempts": delivery.Attempts + 1, "last_attempt_at": now}
+		if !hook.Active {
+			update["status"], update["error"] = models.DeliveryFailed, "webhook is disabled"
+		} else if code, err := postWebhook(ctx, hook, delivery, now); err != nil {
+			update["response_code"], update["error"] = code, truncate(err.Error(), webhookMaxErrorBytes)
+			if delivery.Attempts+1 >= webhookMaxAttempts {
+				update["status"] = models.DeliveryFailed
+			} else {
+				update["next_attempt_at"] = now.Add(webhookBackoff(delivery.Attempts + 1))
+			}
+		} else {
+			update["response_code"], update["error"], update["status"] = code, "", models.DeliveryDelivered
+		}
+		if err := h.db.Model(delivery).Updates(update).Error; err != nil {
+			return i, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+// postWebhook sends one delivery. The signature header uses the same scheme
+// as signed upstream headers: t=<unix seconds>,v1=<hex HMAC-SHA256 of
+// "<t>.<body>"> keyed with the webhook secret.
+func postWebhook(ctx context.Context, hook *models.Webhook, delivery *models.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "KubeVoyage-Webhook")
+	req.Header.Set("X-KubeVoyage-Event", delivery.Event)
+	req.Header.Set("X-KubeVoyage-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-KubeVoyage-Signature", auth.SignHeader([]byte(hook.Secret), now, delivery.Payload))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookMaxErrorBytes))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func truncate(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	return value[:size]
+}
+
+// RunWebhookDelivery calls DeliverWebhooks every interval until ctx is done.
+func (h *Handler) RunWebhookDelivery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// Drain the backlog batch by batch before waiting again.
+			for {
+				attempted, err := h.DeliverWebhooks(ctx, now)
+				if err != nil {
+					slog.Error("Delivering webhooks failed", "error", err)
+				}
+				if err != nil || attempted < webhookBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/B-Urb/KubeVoyage/internal/auth"
+	"github.com/B-Urb/KubeVoyage/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   string
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin}
+	alice := models.User{Email: "alice@example.com", Role: models.RoleUser}
+	require.NoError(t, db.Create(&admin).Error)
+	require.NoError(t, db.Create(&alice).Error)
+
+	var mu sync.Mutex
+	var received []receivedWebhook
+	status := http.StatusInternalServerError
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, receivedWebhook{header: r.Header, body: string(body)})
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	rr := httptest.NewRecorder()
+	h.HandleWebhooks(rr, requestAs(alice.Email, http.MethodPost, "/api/webhooks", `{"name": "chat", "url": "`+receiver.URL+`", "events": ["request.created"]}`))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleWebhooks(rr, requestAs(admin.Email, http.MethodPost, "/api/webhooks", `{"name": "chat", "url": "`+receiver.URL+`", "events": ["request.bogus"]}`))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleWebhooks(rr, requestAs(admin.Email, http.MethodPost, "/api/webhooks", `{"name": "chat", "url": "`+receiver.URL+`", "events": ["request.created"]}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var hook webhookBody
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&hook))
+	require.NotEmpty(t, hook.Secret, "a generated secret is shown once")
+
+	rr = httptest.NewRecorder()
+	h.HandleRequestSite(rr, requestAs(alice.Email, http.MethodPost, "/api/request", `{"redirect": "https://wiki.example.com"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	rr = httptest.NewRecorder()
+	h.HandleUpdateSiteState(rr, requestAs(admin.Email, http.MethodPost, "/api/requests/update",
+		`{"userEmail": "alice@example.com", "siteURL": "https://wiki.example.com", "newState": "authorized"}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var deliveries []models.WebhookDelivery
+	require.NoError(t, db.Find(&deliveries).Error)
+	require.Len(t, deliveries, 1, "only subscribed events are queued")
+
+	now := time.Now()
+	attempted, err := h.DeliverWebhooks(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempted)
+	require.NoError(t, db.First(&deliveries[0]).Error)
+	assert.Equal(t, models.DeliveryPending, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].ResponseCode)
+	assert.WithinDuration(t, now.Add(webhookBaseBackoff), deliveries[0].NextAttemptAt, time.Second)
+
+	attempted, err = h.DeliverWebhooks(context.Background(), now)
+	require.NoError(t, err)
+	assert.Zero(t, attempted, "retries wait for the backoff")
+
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+	later := now.Add(webhookBaseBackoff + time.Second)
+	_, err = h.DeliverWebhooks(context.Background(), later)
+	require.NoError(t, err)
+	require.NoError(t, db.First(&deliveries[0]).Error)
+	assert.Equal(t, models.DeliveryDelivered, deliveries[0].Status)
+	assert.Empty(t, deliveries[0].Error)
+
+	require.Len(t, received, 2)
+	last := received[1]
+	assert.Equal(t, eventRequestCreated, last.header.Get("X-KubeVoyage-Event"))
+	assert.Equal(t, auth.SignHeader([]byte(hook.Secret), later, last.body), last.header.Get("X-KubeVoyage-Signature"))
+	var payload webhookPayload
+	require.NoError(t, json.Unmarshal([]byte(last.body), &payload))
+	assert.Equal(t, eventRequestCreated, payload.Type)
+	assert.Equal(t, alice.Email, payload.Request.User)
+	assert.Equal(t, "https://wiki.example.com", payload.Request.Site)
+	assert.Equal(t, models.Requested, payload.Request.ToState)
+
+	rr = httptest.NewRecorder()
+	h.HandleWebhookDeliveries(rr, requestAs(admin.Email, http.MethodGet, "/api/webhooks/deliveries?webhook=chat&status=delivered", ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var results []webhookDeliveryResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&results))
+	require.Len(t, results, 1)
+	assert.Equal(t, "chat", results[0].Webhook)
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	db := setupTestDatabase()
+	h := newTestHandler(db)
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin}
+	require.NoError(t, db.Create(&admin).Error)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+	hook := models.Webhook{Name: "ops", URL: receiver.URL, Secret: "secret", Events: "*", Active: true}
+	require.NoError(t, db.Create(&hook).Error)
+	delivery := models.WebhookDelivery{WebhookID: hook.ID, Event: eventGrantExpired, Payload: "{}", Status: models.DeliveryPending,
+		NextAttemptAt: time.Now()}
+	require.NoError(t, db.Create(&delivery).Error)
+
+	now := time.Now()
+	for i := 0; i < webhookMaxAttempts; i++ {
+		now = now.Add(webhookMaxBackoff)
+		_, err := h.DeliverWebhooks(context.Background(), now)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.First(&delivery).Error)
+	assert.Equal(t, models.DeliveryFailed, delivery.Status)
+	assert.Equal(t, webhookMaxAttempts, delivery.Attempts)
+	assert.Contains(t, delivery.Error, "maintenance")
+
+	rr := httptest.NewRecorder()
+	h.HandleWebhookDeliveries(rr, requestAs(admin.Email, http.MethodPost, "/api/webhooks/deliveries", `{"id": 1}`))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, db.First(&delivery).Error)
+	assert.Equal(t, models.DeliveryPending, delivery.Status)
+	assert.Zero(t, delivery.Attempts)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, webhookBaseBackoff, webhookBackoff(1))
+	assert.Equal(t, 4*webhookBaseBackoff, webhookBackoff(3))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(20))
+}
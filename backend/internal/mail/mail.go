@@ -0,0 +1,143 @@
+// Package mail delivers the emails KubeVoyage sends to its users.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"github.com/B-Urb/KubeVoyage/internal/util"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewMailerFromEnv returns the mailer selected by MAIL_BACKEND: "smtp", "log"
+// or "file" (.eml files in MAIL_DIR) for development, or "none" (the default)
+// which returns nil and disables all features that need email.
+func NewMailerFromEnv() (Mailer, error) {
+	backend, _ := util.GetEnvOrDefault("MAIL_BACKEND", "none")
+	switch backend {
+	case "none":
+		return nil, nil
+	case "log":
+		return LogMailer{}, nil
+	case "file":
+		dir, _ := util.GetEnvOrDefault("MAIL_DIR", "mail")
+		from, _ := util.GetEnvOrDefault("MAIL_FROM", "kubevoyage@localhost")
+		return NewFileMailer(dir, from)
+	case "smtp":
+		host, err := util.GetEnvOrError("SMTP_HOST")
+		if err != nil {
+			return nil, err
+		}
+		from, err := util.GetEnvOrError("MAIL_FROM")
+		if err != nil {
+			return nil, err
+		}
+		port, _ := util.GetEnvOrDefault("SMTP_PORT", "587")
+		user, _ := util.GetEnvOrDefault("SMTP_USER", "")
+		password, _ := util.GetEnvOrDefault("SMTP_PASSWORD", "")
+		return &SMTPMailer{Addr: net.JoinHostPort(host, port), Host: host, From: from, Username: user, Password: password}, nil
+	}
+	return nil, fmt.Errorf("unsupported MAIL_BACKEND: %s", backend)
+}
+
+// LogMailer writes messages to the log instead of sending them. Only meant
+// for local development, since it leaks login codes into the logs.
+type LogMailer struct{}
+
+func (LogMailer) Send(_ context.Context, msg Message) error {
+	slog.Info("Email", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileMailer writes every message as an .eml file into a directory, where
+// mail clients can open it. Only meant for development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+
+	mu    sync.Mutex
+	count int
+}
+
+// NewFileMailer creates the directory if needed.
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating mail directory: %w", err)
+	}
+	return &FileMailer{Dir: dir, From: from}, nil
+}
+
+func (m *FileMailer) Send(_ context.Context, msg Message) error {
+	now := time.Now()
+	m.mu.Lock()
+	m.count++
+	name := fmt.Sprintf("%s-%04d-%s.eml", now.UTC().Format("20060102T150405.000000000"), m.count, fileSafe(msg.To))
+	m.mu.Unlock()
+	return os.WriteFile(filepath.Join(m.Dir, name), Render(m.From, msg, now), 0o600)
+}
+
+// fileSafe keeps an address usable as part of a file name.
+func fileSafe(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '@' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// SMTPMailer delivers messages through an SMTP relay, using STARTTLS when the
+// server offers it.
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(_ context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, Render(m.From, msg, time.Now()))
+}
+
+// Render formats msg as an RFC 5322 message.
+func Render(from string, msg Message, date time.Time) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + headerValue(from) + "\r\n")
+	b.WriteString("To: " + headerValue(msg.To) + "\r\n")
+	b.WriteString("Subject: " + headerValue(msg.Subject) + "\r\n")
+	b.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// headerValue keeps user controlled values from injecting extra headers.
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer, err := NewFileMailer(dir, "kubevoyage@example.com")
+	require.NoError(t, err)
+
+	_, err = NewTemplateMessage("alice@example.com", "grant_expiring", map[string]any{"Site": "https://wiki.example.com"})
+	assert.Error(t, err, "templates fail on missing data instead of mailing nonsense")
+	msg, err := NewTemplateMessage("alice/../x@example.com", "request_created", map[string]any{
+		"User": "alice@example.com", "Site": "https://wiki.example.com", "Reason": "", "Link": "https://auth.example.com/requests", "ApproveLink": "", "DeclineLink": "",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Access request for https://wiki.example.com from alice@example.com", msg.Subject)
+	assert.NotContains(t, msg.Body, "Justification")
+	require.NoError(t, mailer.Send(context.Background(), msg))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Contains(t, filepath.Base(files[0]), "alice_.._x@example.com")
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "Subject: Access request for https://wiki.example.com from alice@example.com\r\n")
+	assert.Contains(t, string(content), "Review the request at https://auth.example.com/requests\r\n")
+
+	_, err = NewTemplateMessage("alice@example.com", "unknown", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var templateFiles embed.FS
+
+// templates holds one template set per file, so every file can define its
+// own "subject" and "body".
+var templates = map[string]*template.Template{}
+
+func init() {
+	paths, err := fs.Glob(templateFiles, "templates/*.tmpl")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range paths {
+		name := strings.TrimSuffix(path.Base(file), ".tmpl")
+		templates[name] = template.Must(template.New(name).Option("missingkey=error").ParseFS(templateFiles, file))
+	}
+}
+
+// NewTemplateMessage renders the named template from the templates directory
+// into a message to the given address.
+func NewTemplateMessage(to string, name string, data any) (Message, error) {
+	tmpl, ok := templates[name]
+	if !ok {
+		return Message{}, fmt.Errorf("unknown mail template: %s", name)
+	}
+	var subject, body strings.Builder
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: strings.TrimSpace(subject.String()), Body: strings.TrimLeft(body.String(), "\n")}, nil
+}
@@ -1,45 +1,474 @@
 package models
 
+import "time"
+
 type User struct {
 	ID       uint   `gorm:"primaryKey"`
 	Email    string `gorm:"uniqueIndex"`
 	Password string
-	Role     string
+	Role     Role
+	// Kind tells human accounts apart from machine principals. Machine
+	// principals use their identity (e.g. system:serviceaccount:ns:name) as
+	// Email and have no password.
+	Kind string `gorm:"default:user"`
+	// EmailVerified is set once the user proved to own Email: through a
+	// passwordless login, the trusted upstream gateway or the email SAN of a
+	// client certificate. Self-registration does not verify it.
+	EmailVerified bool
 }
 
+const (
+	KindUser           = "user"
+	KindServiceAccount = "serviceaccount"
+	KindService        = "service"
+)
+
 type Site struct {
 	ID  uint   `gorm:"primaryKey"`
 	URL string `gorm:"uniqueIndex"`
+	// AllowBasicAuth lets non-browser clients authenticate against this site
+	// with HTTP Basic credentials instead of following the login redirect.
+	AllowBasicAuth bool
+	// DefaultGrantDays limits new grants for this site to the given number of
+	// days unless the approver picks an expiry. Zero means no limit.
+	DefaultGrantDays int
+	// RequireJustification rejects access requests without a justification.
+	RequireJustification bool
+	// RequiredApprovals is the number of distinct approvers that must accept
+	// a request before it is authorized. Values below 2 mean one approver.
+	RequiredApprovals int
 }
 
 type UserSite struct {
 	UserID uint `gorm:"primaryKey"`
 	SiteID uint `gorm:"primaryKey"`
 	State  State
+	// ExpiresAt ends an authorized grant. Nil grants never expire.
+	ExpiresAt *time.Time `gorm:"index"`
+	// ExtensionRequestedAt is set when the user asks for an expiring grant
+	// to be extended and cleared by the next decision.
+	ExtensionRequestedAt *time.Time
+	// Justification is the requester's reason for wanting access.
+	Justification string
+	// DecisionReason is the approver's reason for the current state.
+	DecisionReason string
+	// DecidedByRule names the approval rule that decided or routed the
+	// request, empty for decisions made by people.
+	DecidedByRule string
+	// StateChangedAt and StateChangedBy record the last transition: the
+	// email of the user, "rule:<name>" or "system".
+	StateChangedAt *time.Time
+	StateChangedBy string
+	// ExpiryRemindedAt is set once the requester was reminded of the coming
+	// expiry and cleared when the grant is authorized again.
+	ExpiryRemindedAt *time.Time
+}
+
+// Active reports whether the grant authorizes access at the given time.
+func (u UserSite) Active(now time.Time) bool {
+	return u.State == Authorized && (u.ExpiresAt == nil || now.Before(*u.ExpiresAt))
 }
 
 type UserSiteResponse struct {
-	User  string `json:"user"`
-	Site  string `json:"site"`
-	State string `json:"state"`
+	User               string     `json:"user"`
+	Site               string     `json:"site"`
+	State              string     `json:"state"`
+	ExpiresAt          *time.Time `json:"expiresAt,omitempty"`
+	ExtensionRequested bool       `json:"extensionRequested"`
+	Justification      string     `json:"justification"`
+	Reason             string     `json:"reason"`
+	Rule               string     `json:"rule,omitempty"`
+	// Approvals lists who accepted a request that needs several approvers.
+	Approvals         []string   `json:"approvals" gorm:"-"`
+	RequiredApprovals int        `json:"requiredApprovals"`
+	ChangedBy         string     `json:"changedBy,omitempty"`
+	ChangedAt         *time.Time `json:"changedAt,omitempty"`
+}
+
+// SiteApprovalGroup restricts which approvals count towards the
+// RequiredApprovals of a site: when a site has any, only approvals from
+// members of these groups count.
+type SiteApprovalGroup struct {
+	SiteID  uint `gorm:"primaryKey"`
+	GroupID uint `gorm:"primaryKey"`
+}
+
+// RequestApproval records one approver accepting a request on a site that
+// needs several approvers.
+type RequestApproval struct {
+	UserID     uint `gorm:"primaryKey"`
+	SiteID     uint `gorm:"primaryKey"`
+	ApproverID uint `gorm:"primaryKey"`
+	CreatedAt  time.Time
+}
+
+// RequestApprover lets a user decide a single request, as routed there by
+// an approval rule.
+type RequestApprover struct {
+	UserID     uint `gorm:"primaryKey"`
+	SiteID     uint `gorm:"primaryKey"`
+	ApproverID uint `gorm:"primaryKey"`
+}
+
+// RuleAction is what an approval rule does with a matching request.
+type RuleAction string
+
+const (
+	RuleAuthorize RuleAction = "authorize"
+	RuleDecline   RuleAction = "decline"
+	// RuleRoute leaves the request pending and lets the rule's approvers
+	// decide it.
+	RuleRoute RuleAction = "route"
+)
+
+func (a RuleAction) IsValid() bool {
+	switch a {
+	case RuleAuthorize, RuleDecline, RuleRoute:
+		return true
+	}
+	return false
+}
+
+// ApprovalRule decides new access requests without an approver. Every
+// non-empty criterion must match; rules are tried by ascending Priority and
+// the first match wins.
+type ApprovalRule struct {
+	ID       uint   `gorm:"primaryKey"`
+	Name     string `gorm:"uniqueIndex"`
+	Priority int
+	// SiteURL matches the exact URL of the requested site.
+	SiteURL string
+	// EmailDomain matches the domain of the requester's email address.
+	EmailDomain string
+	// Group matches members of the named group.
+	Group string
+	// Claim matches a group claim asserted by the SSO gateway.
+	Claim  string
+	Action RuleAction
+	// Approvers is a comma separated list of emails for RuleRoute.
+	Approvers string
+}
+
+// PolicyEffect is what a site policy does when its expression is true.
+type PolicyEffect string
+
+const (
+	// PolicyAllow grants access like a static grant would.
+	PolicyAllow PolicyEffect = "allow"
+	// PolicyDeny blocks access even for users holding a grant.
+	PolicyDeny PolicyEffect = "deny"
+)
+
+func (e PolicyEffect) IsValid() bool {
+	return e == PolicyAllow || e == PolicyDeny
+}
+
+// SitePolicy is a CEL expression evaluated on every forward-auth request
+// for a site.
+type SitePolicy struct {
+	ID         uint         `gorm:"primaryKey" json:"-"`
+	SiteID     uint         `gorm:"uniqueIndex:idx_site_policy" json:"-"`
+	Name       string       `gorm:"uniqueIndex:idx_site_policy" json:"name"`
+	Expression string       `json:"expression"`
+	Effect     PolicyEffect `json:"effect"`
+}
+
+// RequestComment is one message in the discussion of an access request,
+// which is identified by its user and site.
+type RequestComment struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index:idx_request_comment" json:"-"`
+	SiteID    uint      `gorm:"index:idx_request_comment" json:"-"`
+	AuthorID  uint      `json:"-"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RequestHistory is one entry of the append-only trail of an access
+// request: who moved it from which state to which, when and why. Rows are
+// only ever inserted.
+type RequestHistory struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index:idx_request_history"`
+	SiteID    uint   `gorm:"index:idx_request_history"`
+	Actor     string `gorm:"index"`
+	FromState State
+	ToState   State
+	Reason    string
+	Rule      string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// AuthEvent records one authentication decision: a forward-auth check, a
+// login or a logout.
+type AuthEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Time      time.Time `gorm:"index" json:"time"`
+	Action    string    `gorm:"index" json:"action"`
+	User      string    `gorm:"index" json:"user"`
+	Site      string    `gorm:"index" json:"site"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason"`
+	Method    string    `json:"method,omitempty"`
+	ClientIP  string    `json:"clientIP"`
+	UserAgent string    `json:"userAgent"`
+	// PrevHash and Hash chain every event to the one before it, see the
+	// audit package.
+	PrevHash string `json:"prevHash"`
+	Hash     string `gorm:"index" json:"hash"`
+}
+
+// AuditHead holds the hash of the newest event in the auth_events table.
+// Writers lock its single row, so events are chained in one line even with
+// several instances writing.
+type AuditHead struct {
+	ID   uint `gorm:"primaryKey"`
+	Hash string
+}
+
+// AuditSeal is a signature over the head of the audit chain, so that the
+// events up to EventID can be verified without trusting the database.
+type AuditSeal struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	EventID   uint      `json:"eventID"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"createdAt"`
+	Signature []byte    `json:"signature"`
+}
+
+// Webhook subscribes a URL to request events. Events is the comma separated
+// list of event types it receives.
+type Webhook struct {
+	ID     uint   `gorm:"primaryKey"`
+	Name   string `gorm:"uniqueIndex"`
+	URL    string
+	Secret string
+	Events string
+	// Format is WebhookFormatJSON, the default, or WebhookFormatChat for
+	// Slack and Mattermost incoming webhooks.
+	Format    string
+	Active    bool
+	CreatedAt time.Time
+}
+
+// Payload formats of webhooks.
+const (
+	WebhookFormatJSON = "json"
+	WebhookFormatChat = "chat"
+)
+
+// ChatIdentity maps the user id of a chat system to the KubeVoyage user who
+// decides requests from chat messages.
+type ChatIdentity struct {
+	ID         uint   `gorm:"primaryKey"`
+	ChatUserID string `gorm:"uniqueIndex"`
+	UserID     uint   `gorm:"index"`
+	CreatedAt  time.Time
 }
 
+// WebhookDelivery is one event queued for one webhook. Deliveries form the
+// outbox the delivery worker drains; delivered and failed ones stay as the
+// delivery log.
+type WebhookDelivery struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	WebhookID     uint       `gorm:"index" json:"-"`
+	Event         string     `json:"event"`
+	Payload       string     `json:"payload"`
+	Status        string     `gorm:"index:idx_webhook_delivery_due" json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index:idx_webhook_delivery_due" json:"nextAttemptAt"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+	ResponseCode  int        `json:"responseCode,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+// Statuses of webhook deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// SiteUse records when a user last got through to a site, whichever grant
+// let them in.
+type SiteUse struct {
+	UserID     uint `gorm:"primaryKey;autoIncrement:false"`
+	SiteID     uint `gorm:"primaryKey;autoIncrement:false"`
+	LastUsedAt time.Time
+}
+
+// NotificationPreference stores which emails a user wants. Users without a
+// row get all of them.
+type NotificationPreference struct {
+	UserID      uint `gorm:"primaryKey;autoIncrement:false" json:"-"`
+	NewRequests bool `json:"newRequests"`
+	Decisions   bool `json:"decisions"`
+	Expiry      bool `json:"expiry"`
+}
+
+// Cursor remembers how far a background job has read an append-only table.
+type Cursor struct {
+	Name     string `gorm:"primaryKey"`
+	Position uint
+}
+
+// Actions and outcomes of auth events.
+const (
+	AuthActionAuthenticate = "authenticate"
+	AuthActionLogin        = "login"
+	AuthActionLogout       = "logout"
+
+	AuthOutcomeAllow = "allow"
+	AuthOutcomeDeny  = "deny"
+	AuthOutcomeError = "error"
+)
+
 type State string
 
 const (
 	Requested  State = "requested"
 	Authorized State = "authorized"
 	Declined   State = "declined"
+	// Expired grants were authorized until their expires_at passed.
+	Expired State = "expired"
+	// Revoked grants were withdrawn by an admin after being authorized.
+	Revoked State = "revoked"
+	// Withdrawn requests were taken back by the requester.
+	Withdrawn State = "withdrawn"
+	// PendingSecondApproval requests have some but not all of the approvals
+	// their site requires.
+	PendingSecondApproval State = "pending_second_approval"
 )
 
+// transitions lists the legal next states of every state. The empty state
+// stands for a request that does not exist yet.
+var transitions = map[State][]State{
+	"":                    {Requested, PendingSecondApproval, Authorized, Declined},
+	Requested:             {Requested, PendingSecondApproval, Authorized, Declined, Withdrawn},
+	PendingSecondApproval: {Requested, PendingSecondApproval, Authorized, Declined, Withdrawn},
+	Authorized:            {Authorized, Revoked, Expired},
+	Declined:              {Requested, Authorized},
+	Expired:               {Requested, Authorized},
+	Revoked:               {Requested, Authorized},
+	Withdrawn:             {Requested, Authorized},
+}
+
 func (s State) IsValid() bool {
 	switch s {
-	case Requested, Authorized, Declined:
+	case Requested, Authorized, Declined, Expired, Revoked, Withdrawn, PendingSecondApproval:
 		return true
 	}
 	return false
 }
 
+// CanTransitionTo reports whether a request may move from s to next.
+// Staying in requested, pending_second_approval or authorized is legal and
+// updates the request, for example to extend a grant.
+func (s State) CanTransitionTo(next State) bool {
+	for _, legal := range transitions[s] {
+		if legal == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending reports whether the request still waits for a decision.
+func (s State) Pending() bool {
+	return s == Requested || s == PendingSecondApproval
+}
+
+// Group bundles users so that sites can be granted to all of them at once.
+type Group struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	Name        string `gorm:"uniqueIndex" json:"name"`
+	Description string `json:"description"`
+}
+
+type GroupMember struct {
+	GroupID uint `gorm:"primaryKey"`
+	UserID  uint `gorm:"primaryKey"`
+	// Source tells memberships managed through the API apart from the ones
+	// synced from SSO claims, which are replaced on every sync.
+	Source string
+}
+
+const (
+	GroupSourceManual = "manual"
+	GroupSourceSSO    = "sso"
+)
+
+// GroupSite grants a site to every member of a group.
+type GroupSite struct {
+	GroupID uint `gorm:"primaryKey"`
+	SiteID  uint `gorm:"primaryKey"`
+}
+
+// SiteOwner lets a user decide requests for a site and manage its approvers.
+type SiteOwner struct {
+	SiteID uint `gorm:"primaryKey"`
+	UserID uint `gorm:"primaryKey"`
+}
+
+// SiteApprover lets a user decide requests for a single site.
+type SiteApprover struct {
+	SiteID uint `gorm:"primaryKey"`
+	UserID uint `gorm:"primaryKey"`
+}
+
+// SiteApproverGroup lets every member of a group decide requests for a site.
+type SiteApproverGroup struct {
+	SiteID  uint `gorm:"primaryKey"`
+	GroupID uint `gorm:"primaryKey"`
+}
+
+// AppToken is a long-lived secret a user can present as the password of an
+// HTTP Basic request, so that tools never need the real account password.
+type AppToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index" json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `gorm:"uniqueIndex" json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// LoginChallenge is a pending passwordless login. The user proves control of
+// Email by following the magic link or entering the code, from the same
+// browser that asked for it.
+type LoginChallenge struct {
+	ID           uint   `gorm:"primaryKey"`
+	Email        string `gorm:"index"`
+	CodeHash     string
+	LinkHash     string `gorm:"uniqueIndex"`
+	BrowserHash  string
+	Redirect     string
+	OneTimeToken string
+	Attempts     int
+	ExpiresAt    time.Time
+	UsedAt       *time.Time
+	CreatedAt    time.Time `gorm:"index"`
+}
+
+// DecisionLink is a single-use link that approves or declines one request
+// on behalf of one approver. Only the keyed hash of its token is stored.
+type DecisionLink struct {
+	ID         uint   `gorm:"primaryKey"`
+	TokenHash  string `gorm:"uniqueIndex"`
+	UserID     uint   `gorm:"index:idx_decision_link"`
+	SiteID     uint   `gorm:"index:idx_decision_link"`
+	ApproverID uint
+	// RequestEntryID is the history entry that created the request, so the
+	// link dies when the request ends and is asked for again.
+	RequestEntryID uint
+	State          State
+	ExpiresAt      time.Time
+	UsedAt         *time.Time
+	CreatedAt      time.Time
+}
+
 type Redirect struct {
-	Redirect string
+	Redirect      string
+	Justification string
 }
@@ -0,0 +1,78 @@
+package models
+
+// Role is the global role of a user. It decides which API permissions the
+// user holds; access to individual sites is granted separately.
+type Role string
+
+const (
+	RoleSuperAdmin Role = "superadmin"
+	// RoleAdmin is the role of installations that predate fine-grained roles
+	// and keeps the full access it always had.
+	RoleAdmin    Role = "admin"
+	RoleApprover Role = "approver"
+	RoleAuditor  Role = "auditor"
+	RoleUser     Role = "user"
+)
+
+// Permission is a single capability checked by an API handler.
+type Permission string
+
+const (
+	// PermAccessAllSites bypasses the per-site checks of forward auth.
+	PermAccessAllSites Permission = "sites:access-all"
+	PermManageSites    Permission = "sites:manage"
+	PermViewRequests   Permission = "requests:view"
+	PermDecideRequests Permission = "requests:decide"
+	PermManageGroups   Permission = "groups:manage"
+	PermManageRules    Permission = "rules:manage"
+	PermManageUsers    Permission = "users:manage"
+	PermViewAudit      Permission = "audit:view"
+	PermManageHooks    Permission = "webhooks:manage"
+)
+
+var allPermissions = []Permission{
+	PermAccessAllSites,
+	PermManageSites,
+	PermViewRequests,
+	PermDecideRequests,
+	PermManageGroups,
+	PermManageRules,
+	PermManageUsers,
+	PermViewAudit,
+	PermManageHooks,
+}
+
+var rolePermissions = map[Role][]Permission{
+	RoleSuperAdmin: allPermissions,
+	RoleAdmin:      allPermissions,
+	RoleApprover:   {PermViewRequests, PermDecideRequests},
+	RoleAuditor:    {PermViewRequests, PermViewAudit},
+	RoleUser:       {},
+}
+
+func (r Role) IsValid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Can reports whether the role grants the permission. Unknown roles grant
+// nothing.
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// RolesWith lists the roles that grant the permission.
+func RolesWith(p Permission) []Role {
+	var roles []Role
+	for role := range rolePermissions {
+		if role.Can(p) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
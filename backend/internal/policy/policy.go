@@ -0,0 +1,158 @@
+// Package policy evaluates site access policies written in the Common
+// Expression Language (CEL) against the attributes of a forwarded request.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User holds the attributes of the caller visible to policies as `user`.
+type User struct {
+	Email  string   `json:"email"`
+	Groups []string `json:"groups"`
+	Role   string   `json:"role"`
+	Kind   string   `json:"kind"`
+}
+
+// Request holds the attributes of the forwarded request visible to policies
+// as `request`. Header names are lower case.
+type Request struct {
+	IP      string            `json:"ip"`
+	Method  string            `json:"method"`
+	Host    string            `json:"host"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Input is everything a policy is evaluated against. Time is visible as
+// `now`.
+type Input struct {
+	User    User      `json:"user"`
+	Request Request   `json:"request"`
+	Time    time.Time `json:"time"`
+}
+
+// Policy is a compiled expression that evaluates to a bool.
+type Policy struct {
+	Expression string
+	program    cel.Program
+}
+
+// cacheLimit bounds the compiled policies kept by Cached.
+const cacheLimit = 1024
+
+var (
+	envOnce sync.Once
+	env     *cel.Env
+	envErr  error
+
+	cacheMu sync.RWMutex
+	cache   = map[string]*Policy{}
+)
+
+func environment() (*cel.Env, error) {
+	envOnce.Do(func() {
+		env, envErr = cel.NewEnv(
+			cel.Variable("user", cel.MapType(cel.StringType, cel.DynType)),
+			cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+			cel.Variable("now", cel.TimestampType),
+		)
+	})
+	return env, envErr
+}
+
+// Compile parses and type-checks an expression. It fails unless the
+// expression evaluates to a bool, so broken policies are caught when they
+// are saved rather than when a user is waiting at the door.
+func Compile(expression string) (*Policy, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, errors.New("empty policy expression")
+	}
+	e, err := environment()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := e.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("policy must evaluate to a bool, not %s", ast.OutputType())
+	}
+	program, err := e.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &Policy{Expression: expression, program: program}, nil
+}
+
+// Cached compiles stored policies, which run on every forward-auth check,
+// once. It keeps at most cacheLimit of them and starts over when full, so
+// edited and deleted policies do not pile up.
+func Cached(expression string) (*Policy, error) {
+	cacheMu.RLock()
+	policy, ok := cache[expression]
+	cacheMu.RUnlock()
+	if ok {
+		return policy, nil
+	}
+	policy, err := Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if len(cache) >= cacheLimit {
+		cache = map[string]*Policy{}
+	}
+	cache[expression] = policy
+	return policy, nil
+}
+
+// Evaluate runs the policy. Expressions that fail at runtime, for example
+// by reading a missing header, or that do not produce a bool return an
+// error.
+func (p *Policy) Evaluate(input Input) (bool, error) {
+	groups := input.User.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	headers := input.Request.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	now := input.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	out, _, err := p.program.Eval(map[string]any{
+		"user": map[string]any{
+			"email":  input.User.Email,
+			"groups": groups,
+			"role":   input.User.Role,
+			"roles":  []string{input.User.Role},
+			"kind":   input.User.Kind,
+		},
+		"request": map[string]any{
+			"ip":      input.Request.IP,
+			"method":  input.Request.Method,
+			"host":    input.Request.Host,
+			"path":    input.Request.Path,
+			"headers": headers,
+		},
+		"now": now,
+	})
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("policy evaluated to %v, not a bool", out.Value())
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileRejectsInvalidPolicies(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"user.email ==",
+		`"not a bool"`,
+		"1 + 1",
+		"unknown.field == 1",
+	} {
+		_, err := Compile(expression)
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	input := Input{
+		User: User{Email: "alice@example.com", Groups: []string{"oncall"}, Role: "user"},
+		Request: Request{
+			IP:      "10.0.0.7",
+			Method:  "GET",
+			Path:    "/dashboards",
+			Headers: map[string]string{"x-team": "platform"},
+		},
+		Time: time.Date(2024, 5, 6, 14, 0, 0, 0, time.UTC),
+	}
+	for expression, want := range map[string]bool{
+		`user.groups.exists(g, g == "oncall") && request.method == "GET"`: true,
+		`user.groups.exists(g, g == "admins")`:                            false,
+		`request.path.startsWith("/admin")`:                               false,
+		`request.headers["x-team"] == "platform"`:                         true,
+		`"user" in user.roles && user.email.endsWith("@example.com")`:     true,
+		`now.getHours() >= 8 && now.getHours() < 18`:                      true,
+	} {
+		compiled, err := Compile(expression)
+		require.NoError(t, err, expression)
+		got, err := compiled.Evaluate(input)
+		require.NoError(t, err, expression)
+		assert.Equal(t, want, got, expression)
+	}
+
+	compiled, err := Compile(`request.headers["x-missing"] == "x"`)
+	require.NoError(t, err)
+	_, err = compiled.Evaluate(input)
+	assert.Error(t, err, "missing keys fail at runtime")
+}
+
+func TestCachedIsBounded(t *testing.T) {
+	first, err := Cached(`user.role == "admin"`)
+	require.NoError(t, err)
+	again, err := Cached(`user.role == "admin"`)
+	require.NoError(t, err)
+	assert.Same(t, first, again)
+
+	for i := 0; i <= cacheLimit; i++ {
+		_, err := Cached(fmt.Sprintf(`request.path == "/%d"`, i))
+		require.NoError(t, err)
+	}
+	assert.LessOrEqual(t, len(cache), cacheLimit)
+
+	_, err = Compile(`request.path == "/sandbox"`)
+	require.NoError(t, err)
+	assert.NotContains(t, cache, `request.path == "/sandbox"`, "only stored policies are cached")
+}
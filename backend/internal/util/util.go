@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 func GetEnvOrError(key string) (string, error) {
@@ -20,3 +21,15 @@ func GetEnvOrDefault(key string, defaultValue string) (string, error) {
 	}
 	return value, nil
 }
+
+// GetEnvList reads a comma separated environment variable and returns its
+// trimmed, non-empty elements.
+func GetEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}